@@ -0,0 +1,543 @@
+package exchanges
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const (
+	BinanceBaseURL     = "https://api.binance.com"
+	binanceTradesLimit = 1000
+)
+
+type BinanceClient struct {
+	ApiKey    string
+	ApiSecret string
+	// BaseURL можно подменить на локальный сервер в тестах
+	BaseURL string
+	// Symbols — дополнительные пары для синхронизации истории (например, уже проданные монеты)
+	Symbols []string
+	// LastTradeIDs — последний сохраненный id сделки по паре: история догружается с него
+	LastTradeIDs map[string]int64
+}
+
+var (
+	_ Exchange          = (*BinanceClient)(nil)
+	_ KnownTradesSetter = (*BinanceClient)(nil)
+)
+
+func NewBinanceClient(apiKey, apiSecret string) *BinanceClient {
+	baseURL := os.Getenv("BINANCE_BASE_URL")
+	if baseURL == "" {
+		baseURL = BinanceBaseURL
+	}
+	return &BinanceClient{
+		ApiKey:    apiKey,
+		ApiSecret: apiSecret,
+		BaseURL:   baseURL,
+	}
+}
+
+func (c *BinanceClient) Name() string {
+	return ExchangeBinance
+}
+
+func (c *BinanceClient) QueueWait() time.Duration {
+	return binanceScheduler.QueueWait(c.ApiKey)
+}
+
+// SetKnownTrades добавляет пары с сохраненными сделками к синхронизации и запоминает,
+// с какого id догружать каждую
+func (c *BinanceClient) SetKnownTrades(symbols []string, lastIDs map[string]int64) {
+	c.Symbols = append(c.Symbols, symbols...)
+	c.LastTradeIDs = lastIDs
+}
+
+type binanceErrorResponse struct {
+	Code int    `json:"code"`
+	Msg  string `json:"msg"`
+}
+
+type binanceAccountResponse struct {
+	Balances []struct {
+		Asset  string `json:"asset"`
+		Free   string `json:"free"`
+		Locked string `json:"locked"`
+	} `json:"balances"`
+}
+
+type binanceTickerPrice struct {
+	Symbol string `json:"symbol"`
+	Price  string `json:"price"`
+}
+
+type binanceTrade struct {
+	ID              int64  `json:"id"`
+	Symbol          string `json:"symbol"`
+	Price           string `json:"price"`
+	Qty             string `json:"qty"`
+	Time            int64  `json:"time"`
+	IsBuyer         bool   `json:"isBuyer"`
+	IsMaker         bool   `json:"isMaker"`
+	OrderID         int64  `json:"orderId"`
+	QuoteQty        string `json:"quoteQty"`
+	Commission      string `json:"commission"`
+	CommissionAsset string `json:"commissionAsset"`
+}
+
+type binanceExchangeInfoResponse struct {
+	Symbols []struct {
+		Symbol     string `json:"symbol"`
+		Status     string `json:"status"`
+		BaseAsset  string `json:"baseAsset"`
+		QuoteAsset string `json:"quoteAsset"`
+	} `json:"symbols"`
+}
+
+// sign дописывает к параметрам timestamp, recvWindow и HMAC-SHA256 подпись
+func (c *BinanceClient) sign(params url.Values) string {
+	params.Set("timestamp", fmt.Sprintf("%d", time.Now().UnixMilli()))
+	params.Set("recvWindow", "20000")
+	queryString := params.Encode()
+
+	h := hmac.New(sha256.New, []byte(c.ApiSecret))
+	h.Write([]byte(queryString))
+	return queryString + "&signature=" + hex.EncodeToString(h.Sum(nil))
+}
+
+// get выполняет GET-запрос к Binance с retry и проверкой HTTP статуса
+func (c *BinanceClient) get(ctx context.Context, path string, params url.Values, signed bool) ([]byte, error) {
+	if params == nil {
+		params = url.Values{}
+	}
+
+	// публичные запросы расходуют только общий бюджет IP
+	schedulerKey := ""
+	if signed {
+		schedulerKey = c.ApiKey
+	}
+
+	var body []byte
+	maxAttempts := 3
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if _, err := binanceScheduler.Wait(ctx, schedulerKey); err != nil {
+			return nil, err
+		}
+
+		// подпись с timestamp — заново на каждую попытку: после паузы старая выйдет
+		// за recvWindow, и Binance ответит -1021
+		req, err := c.newRequest(ctx, path, params, signed)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, reqErr := httpClient.Do(req)
+		if reqErr != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if attempt < maxAttempts {
+				log.Printf("[Binance] Попытка %d/%d: ошибка запроса %s: %v", attempt, maxAttempts, path, reqErr)
+				if err := sleepCtx(ctx, backoffDelay(attempt)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return nil, fmt.Errorf("ошибка выполнения запроса: %w", reqErr)
+		}
+
+		body, reqErr = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if reqErr != nil {
+			return nil, fmt.Errorf("ошибка чтения ответа: %w", reqErr)
+		}
+
+		if resp.StatusCode != 200 {
+			log.Printf("[Binance] Неверный HTTP статус %d при запросе %s. Body: %s", resp.StatusCode, path, string(body))
+
+			var errResp binanceErrorResponse
+			json.Unmarshal(body, &errResp)
+			apiErr := newBinanceError(resp.StatusCode, errResp.Code, errResp.Msg)
+			// лимит IP: до Retry-After не отправляем ни одного запроса, иначе Binance
+			// переходит к бану IP (418). Сам бан повтором только продлится.
+			if resp.StatusCode == 429 || resp.StatusCode == 418 || errResp.Code == -1003 {
+				if wait, ok := retryAfter(resp.Header); ok {
+					binanceScheduler.Block(time.Now().Add(wait))
+					log.Printf("[Binance] Лимит запросов (HTTP %d), запросы приостановлены на %v", resp.StatusCode, wait)
+					if resp.StatusCode != 418 && wait <= maxRateLimitWait && attempt < maxAttempts {
+						continue
+					}
+				}
+				return nil, apiErr
+			}
+			// 4xx с кодом ошибки Binance повторять бессмысленно
+			if resp.StatusCode < 500 && errResp.Code != 0 {
+				return nil, apiErr
+			}
+			if attempt < maxAttempts {
+				if err := sleepCtx(ctx, backoffDelay(attempt)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return nil, apiErr
+		}
+		break
+	}
+	return body, nil
+}
+
+// retryAfter читает Retry-After (секунды), который Binance присылает с 429 и 418
+func retryAfter(header http.Header) (time.Duration, bool) {
+	seconds, err := strconv.Atoi(header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0, false
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+func (c *BinanceClient) newRequest(ctx context.Context, path string, params url.Values, signed bool) (*http.Request, error) {
+	var queryString string
+	if signed {
+		queryString = c.sign(params)
+	} else {
+		queryString = params.Encode()
+	}
+
+	fullURL := c.BaseURL + path
+	if queryString != "" {
+		fullURL += "?" + queryString
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", fullURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания запроса: %v", err)
+	}
+	if signed {
+		req.Header.Set("X-MBX-APIKEY", c.ApiKey)
+	}
+	return req, nil
+}
+
+func (c *BinanceClient) GetSpotBalance(ctx context.Context) (map[string]string, error) {
+	params := url.Values{}
+	params.Set("omitZeroBalances", "true")
+	body, err := c.get(ctx, "/api/v3/account", params, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var account binanceAccountResponse
+	if err := json.Unmarshal(body, &account); err != nil {
+		log.Printf("[Binance] Ошибка парсинга JSON баланса: %v. Body: %s", err, string(body))
+		return nil, fmt.Errorf("неверный формат ответа API при получении баланса")
+	}
+
+	balances := make(map[string]string)
+	for _, b := range account.Balances {
+		free, _ := strconv.ParseFloat(b.Free, 64)
+		locked, _ := strconv.ParseFloat(b.Locked, 64)
+		total := strconv.FormatFloat(free+locked, 'f', -1, 64)
+		if hasBalance(total) {
+			balances[b.Asset] = total
+		}
+	}
+
+	// Binance не отдает общую стоимость, считаем ее сами по ценам к USDT
+	prices, err := c.GetAllMarketPrices(ctx)
+	if err != nil {
+		log.Printf("[Binance] Не удалось посчитать TOTAL: %v", err)
+		return balances, nil
+	}
+	var totalValue float64
+	for asset, qtyStr := range balances {
+		qty, _ := strconv.ParseFloat(qtyStr, 64)
+		if asset == "USDT" {
+			totalValue += qty
+			continue
+		}
+		if price, ok := prices[asset+"USDT"]; ok {
+			totalValue += qty * price
+		}
+	}
+	balances["TOTAL"] = strconv.FormatFloat(totalValue, 'f', 2, 64)
+
+	return balances, nil
+}
+
+func (c *BinanceClient) getTickerPrices(ctx context.Context, params url.Values) ([]binanceTickerPrice, error) {
+	body, err := c.get(ctx, "/api/v3/ticker/price", params, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// для одного символа Binance отдает объект, для всех — массив
+	if params != nil && params.Get("symbol") != "" {
+		var ticker binanceTickerPrice
+		if err := json.Unmarshal(body, &ticker); err != nil {
+			log.Printf("[Binance] Ошибка парсинга JSON цены: %v. Body: %s", err, string(body))
+			return nil, fmt.Errorf("неверный формат ответа API при получении цены")
+		}
+		return []binanceTickerPrice{ticker}, nil
+	}
+
+	var tickers []binanceTickerPrice
+	if err := json.Unmarshal(body, &tickers); err != nil {
+		log.Printf("[Binance] Ошибка парсинга JSON цен: %v. Body: %s", err, string(body))
+		return nil, fmt.Errorf("неверный формат ответа API при получении цен")
+	}
+	return tickers, nil
+}
+
+func (c *BinanceClient) GetMarketTickers(ctx context.Context, category string) (map[string]TickerInfo, error) {
+	tickers, err := c.getTickerPrices(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	tickersMap := make(map[string]TickerInfo)
+	for _, t := range tickers {
+		tickersMap[t.Symbol] = TickerInfo{Symbol: t.Symbol, LastPrice: t.Price}
+	}
+	return tickersMap, nil
+}
+
+func (c *BinanceClient) GetAllMarketPrices(ctx context.Context) (map[string]float64, error) {
+	tickers, err := c.getTickerPrices(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	pricesMap := make(map[string]float64)
+	for _, t := range tickers {
+		price, err := strconv.ParseFloat(t.Price, 64)
+		if err == nil {
+			pricesMap[t.Symbol] = price
+		}
+	}
+	return pricesMap, nil
+}
+
+func (c *BinanceClient) GetTicker(ctx context.Context, symbol string) (TickerInfo, error) {
+	params := url.Values{}
+	params.Set("symbol", symbol)
+	tickers, err := c.getTickerPrices(ctx, params)
+	if err != nil {
+		return TickerInfo{}, err
+	}
+	if len(tickers) == 0 || tickers[0].Price == "" {
+		return TickerInfo{}, fmt.Errorf("цена для %s не найдена", symbol)
+	}
+	return TickerInfo{Symbol: tickers[0].Symbol, LastPrice: tickers[0].Price}, nil
+}
+
+func (c *BinanceClient) GetInstrumentsInfo(ctx context.Context) (map[string]InstrumentInfo, error) {
+	body, err := c.get(ctx, "/api/v3/exchangeInfo", nil, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var info binanceExchangeInfoResponse
+	if err := json.Unmarshal(body, &info); err != nil {
+		log.Printf("[Binance] Ошибка парсинга JSON инструментов: %v", err)
+		return nil, fmt.Errorf("неверный формат ответа API при получении инструментов")
+	}
+
+	instruments := make(map[string]InstrumentInfo)
+	for _, s := range info.Symbols {
+		instruments[s.Symbol] = InstrumentInfo{
+			Symbol:    s.Symbol,
+			BaseCoin:  s.BaseAsset,
+			QuoteCoin: s.QuoteAsset,
+			Status:    s.Status,
+		}
+	}
+	return instruments, nil
+}
+
+// getSymbolTrades листает myTrades по fromId: с последней сохраненной сделки пары, а для
+// новых пар — с самой первой. Окно по времени у Binance ограничено 24 часами,
+// поэтому по времени фильтруем на нашей стороне (startTime 0 — без фильтра). При ошибке возвращает и загруженные
+// страницы: они идут подряд по id, и следующая синхронизация продолжит с последней.
+func (c *BinanceClient) getSymbolTrades(ctx context.Context, symbol string, startTime, endTime int64) ([]Execution, error) {
+	var executions []Execution
+	fromID := int64(0)
+	if lastID, ok := c.LastTradeIDs[symbol]; ok {
+		fromID = lastID + 1
+	}
+
+	for {
+		params := url.Values{}
+		params.Set("symbol", symbol)
+		params.Set("limit", strconv.Itoa(binanceTradesLimit))
+		params.Set("fromId", strconv.FormatInt(fromID, 10))
+
+		body, err := c.get(ctx, "/api/v3/myTrades", params, true)
+		if err != nil {
+			return executions, fmt.Errorf("ошибка истории для %s: %w", symbol, err)
+		}
+
+		var trades []binanceTrade
+		if err := json.Unmarshal(body, &trades); err != nil {
+			log.Printf("[Binance] Ошибка парсинга JSON истории %s: %v. Body: %s", symbol, err, string(body))
+			return executions, fmt.Errorf("неверный формат ответа API при получении истории")
+		}
+
+		for _, t := range trades {
+			if (startTime > 0 && t.Time < startTime) || (endTime > 0 && t.Time > endTime) {
+				continue
+			}
+			executions = append(executions, binanceTradeToExecution(t))
+		}
+
+		if len(trades) < binanceTradesLimit {
+			break
+		}
+		fromID = trades[len(trades)-1].ID + 1
+		if err := sleepCtx(ctx, 100*time.Millisecond); err != nil {
+			return executions, err
+		}
+	}
+
+	return executions, nil
+}
+
+func binanceTradeToExecution(t binanceTrade) Execution {
+	side := "Sell"
+	if t.IsBuyer {
+		side = "Buy"
+	}
+	return Execution{
+		Symbol:      t.Symbol,
+		Price:       t.Price,
+		Quantity:    t.Qty,
+		Side:        side,
+		ExecID:      strconv.FormatInt(t.ID, 10),
+		OrderID:     strconv.FormatInt(t.OrderID, 10),
+		ExecTime:    strconv.FormatInt(t.Time, 10),
+		ExecFee:     t.Commission,
+		FeeCurrency: t.CommissionAsset,
+		ExecValue:   t.QuoteQty,
+		IsMaker:     t.IsMaker,
+	}
+}
+
+func (c *BinanceClient) GetExecutions(ctx context.Context, symbol string, startTime, endTime int64) ([]Execution, error) {
+	if symbol == "" {
+		return nil, fmt.Errorf("Binance требует символ для истории сделок")
+	}
+	return c.getSymbolTrades(ctx, symbol, startTime, endTime)
+}
+
+// tradedSymbols собирает пары для синхронизации: монеты с баланса в паре со всеми
+// котировками из QuoteCurrencies плюс явно заданные Symbols — пары уже сохраненных
+// сделок, в том числе монет, проданных полностью, и пары, добавленные пользователем.
+// Пар, которых нет в exchangeInfo, Binance не знает — myTrades по ним вернул бы ошибку.
+func (c *BinanceClient) tradedSymbols(ctx context.Context) ([]string, error) {
+	balances, err := c.GetSpotBalance(ctx)
+	if err != nil {
+		return nil, err
+	}
+	instruments, err := c.GetInstrumentsInfo(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var symbols []string
+	for _, symbol := range c.Symbols {
+		if seen[symbol] {
+			continue
+		}
+		seen[symbol] = true
+		if _, ok := instruments[symbol]; !ok {
+			log.Printf("[Binance] Пара %s не найдена в exchangeInfo, история по ней не загружается", symbol)
+			continue
+		}
+		symbols = append(symbols, symbol)
+	}
+	for asset := range balances {
+		for _, quote := range QuoteCurrencies {
+			symbol := asset + quote
+			if _, ok := instruments[symbol]; ok && !seen[symbol] {
+				seen[symbol] = true
+				symbols = append(symbols, symbol)
+			}
+		}
+	}
+	return symbols, nil
+}
+
+// GetExecutionsSince загружает историю по каждой паре из tradedSymbols. Пары без
+// сохраненных сделок загружаются целиком, без фильтра по startTime: пара, впервые
+// найденная при обычной синхронизации, иначе потеряла бы сделки до startTime.
+// При ошибке возвращает уже загруженные сделки вместе с *PartialSyncError: по времени
+// история не загружена дальше startTime (пары идут по очереди), но сохранять
+// загруженное можно — следующая синхронизация продолжит каждую пару с ее последней сделки.
+func (c *BinanceClient) GetExecutionsSince(ctx context.Context, startTime int64) ([]Execution, error) {
+	symbols, err := c.tradedSymbols(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var allTrades []Execution
+	for _, symbol := range symbols {
+		since := startTime
+		if _, ok := c.LastTradeIDs[symbol]; !ok {
+			since = 0
+		}
+		trades, err := c.getSymbolTrades(ctx, symbol, since, 0)
+		allTrades = append(allTrades, trades...)
+		if err != nil {
+			return allTrades, &PartialSyncError{SyncedUntil: startTime, Err: err}
+		}
+		if err := sleepCtx(ctx, 100*time.Millisecond); err != nil {
+			return allTrades, &PartialSyncError{SyncedUntil: startTime, Err: err}
+		}
+	}
+	return allTrades, nil
+}
+
+type binanceAPIRestrictions struct {
+	IPRestrict                 bool `json:"ipRestrict"`
+	EnableReading              bool `json:"enableReading"`
+	EnableWithdrawals          bool `json:"enableWithdrawals"`
+	EnableSpotAndMarginTrading bool `json:"enableSpotAndMarginTrading"`
+	EnableMargin               bool `json:"enableMargin"`
+	EnableFutures              bool `json:"enableFutures"`
+	EnableVanillaOptions       bool `json:"enableVanillaOptions"`
+}
+
+func (c *BinanceClient) GetKeyInfo(ctx context.Context) (KeyInfo, error) {
+	body, err := c.get(ctx, "/sapi/v1/account/apiRestrictions", url.Values{}, true)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	var r binanceAPIRestrictions
+	if err := json.Unmarshal(body, &r); err != nil {
+		log.Printf("[Binance] Ошибка парсинга информации о ключе: %v. Body: %s", err, string(body))
+		return KeyInfo{}, fmt.Errorf("неверный формат ответа API при проверке ключа")
+	}
+
+	info := KeyInfo{
+		CanTrade:     r.EnableSpotAndMarginTrading || r.EnableMargin || r.EnableFutures || r.EnableVanillaOptions,
+		CanWithdraw:  r.EnableWithdrawals,
+		IPRestricted: r.IPRestrict,
+	}
+	info.ReadOnly = !info.CanTrade && !info.CanWithdraw
+	// ExpiresAt не заполняем: Binance сообщает только срок торговых прав ключа без привязки
+	// к IP (tradingAuthorityExpirationTime), а не срок действия самого ключа
+	return info, nil
+}
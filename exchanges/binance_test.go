@@ -0,0 +1,303 @@
+package exchanges
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// binanceStub — локальный Binance: баланс, инструменты и myTrades по fromId
+type binanceStub struct {
+	secret string
+	// trades — число сделок пары, id с 0; время сделки — 1000 + id
+	trades map[string]int64
+	// failSymbol — пара, по которой myTrades отвечает ошибкой
+	failSymbol string
+
+	mu      sync.Mutex
+	fromIDs map[string][]string
+}
+
+func (s *binanceStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.URL.Path {
+	case "/api/v3/account":
+		w.Write([]byte(`{"balances":[
+			{"asset":"ETH","free":"0.5","locked":"0"},
+			{"asset":"BTC","free":"0.001","locked":"0"},
+			{"asset":"XRP","free":"0","locked":"0"}]}`))
+	case "/api/v3/ticker/price":
+		w.Write([]byte(`[{"symbol":"ETHUSDT","price":"3000"},{"symbol":"BTCUSDT","price":"60000"}]`))
+	case "/api/v3/exchangeInfo":
+		w.Write([]byte(`{"symbols":[
+			{"symbol":"ETHUSDT","status":"TRADING","baseAsset":"ETH","quoteAsset":"USDT"},
+			{"symbol":"ETHBTC","status":"TRADING","baseAsset":"ETH","quoteAsset":"BTC"},
+			{"symbol":"SOLUSDT","status":"TRADING","baseAsset":"SOL","quoteAsset":"USDT"}]}`))
+	case "/api/v3/myTrades":
+		if !validBinanceSignature(r.URL.RawQuery, s.secret) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":-1022,"msg":"Signature for this request is not valid."}`))
+			return
+		}
+		symbol := query.Get("symbol")
+		if symbol == s.failSymbol {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"code":-1100,"msg":"Illegal characters found in parameter"}`))
+			return
+		}
+		fromID, _ := strconv.ParseInt(query.Get("fromId"), 10, 64)
+		limit, _ := strconv.ParseInt(query.Get("limit"), 10, 64)
+
+		s.mu.Lock()
+		s.fromIDs[symbol] = append(s.fromIDs[symbol], query.Get("fromId"))
+		s.mu.Unlock()
+
+		var trades []binanceTrade
+		for id := fromID; id < s.trades[symbol] && id < fromID+limit; id++ {
+			trades = append(trades, binanceTrade{
+				ID: id, Symbol: symbol, Price: "100", Qty: "1", Time: 1000 + id, IsBuyer: true,
+				QuoteQty: "100", Commission: "0.1", CommissionAsset: "USDT",
+			})
+		}
+		if trades == nil {
+			trades = []binanceTrade{}
+		}
+		json.NewEncoder(w).Encode(trades)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// validBinanceSignature проверяет, что signature — HMAC остальной части запроса
+func validBinanceSignature(rawQuery, secret string) bool {
+	i := strings.LastIndex(rawQuery, "&signature=")
+	if i < 0 {
+		return false
+	}
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(rawQuery[:i]))
+	return rawQuery[i+len("&signature="):] == hex.EncodeToString(h.Sum(nil))
+}
+
+func TestBinanceGetExecutionsSincePagesByFromID(t *testing.T) {
+	stub := &binanceStub{
+		secret:  "secret",
+		trades:  map[string]int64{"ETHUSDT": 2500, "SOLUSDT": 1603},
+		fromIDs: make(map[string][]string),
+	}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	client := &BinanceClient{ApiKey: t.Name(), ApiSecret: stub.secret, BaseURL: server.URL}
+	// SOL продан полностью: на балансе его нет, пара известна по сохраненным сделкам;
+	// ADA добавлена пользователем, но Binance такой пары не знает
+	client.SetKnownTrades([]string{"SOLUSDT", "ADAUSDT"}, map[string]int64{"SOLUSDT": 1600})
+
+	trades, err := client.GetExecutionsSince(context.Background(), 1500)
+	if err != nil {
+		t.Fatalf("GetExecutionsSince: %v", err)
+	}
+
+	bySymbol := make(map[string]int)
+	for _, trade := range trades {
+		bySymbol[trade.Symbol]++
+	}
+	// ETHUSDT без сохраненных сделок загружается целиком, в том числе до startTime;
+	// SOLUSDT: id 1601 и 1602 после сохраненного 1600
+	if bySymbol["ETHUSDT"] != 2500 || bySymbol["SOLUSDT"] != 2 || bySymbol["ETHBTC"] != 0 {
+		t.Errorf("сделки по парам = %v", bySymbol)
+	}
+
+	tests := []struct {
+		symbol string
+		want   string
+	}{
+		{"ETHUSDT", "0,1000,2000"},
+		{"ETHBTC", "0"},
+		{"SOLUSDT", "1601"},
+	}
+	for _, tt := range tests {
+		if got := strings.Join(stub.fromIDs[tt.symbol], ","); got != tt.want {
+			t.Errorf("fromId для %s = %s, ожидалось %s", tt.symbol, got, tt.want)
+		}
+	}
+	// BTC на балансе, но пар с BTC в exchangeInfo нет — запрашивать нечего
+	for _, symbol := range []string{"BTCUSDT", "ADAUSDT"} {
+		if _, ok := stub.fromIDs[symbol]; ok {
+			t.Errorf("запрошена пара %s, которой нет в exchangeInfo", symbol)
+		}
+	}
+}
+
+func TestBinanceGetExecutionsSinceKeepsSyncedPairsOnError(t *testing.T) {
+	stub := &binanceStub{
+		secret:     "secret",
+		trades:     map[string]int64{"ETHUSDT": 5, "SOLUSDT": 3},
+		failSymbol: "ETHBTC",
+		fromIDs:    make(map[string][]string),
+	}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	client := &BinanceClient{ApiKey: t.Name(), ApiSecret: stub.secret, BaseURL: server.URL}
+	client.SetKnownTrades([]string{"SOLUSDT"}, nil)
+
+	// пары идут по порядку: SOLUSDT из сохраненных, затем ETHUSDT и ETHBTC с баланса
+	trades, err := client.GetExecutionsSince(context.Background(), 0)
+	var partial *PartialSyncError
+	var apiErr *APIError
+	if !errors.As(err, &partial) || !errors.As(err, &apiErr) || apiErr.HTTPStatus != http.StatusBadRequest {
+		t.Fatalf("ошибка = %v, ожидалась PartialSyncError с ошибкой API", err)
+	}
+	if partial.SyncedUntil != 0 {
+		t.Errorf("SyncedUntil = %d, ожидалось startTime", partial.SyncedUntil)
+	}
+	if len(trades) != 8 {
+		t.Errorf("сделок = %d, ожидалось 8: загруженные пары отдаются вместе с ошибкой", len(trades))
+	}
+}
+
+func TestBinanceGetSpotBalanceKeepsSmallAmounts(t *testing.T) {
+	server := httptest.NewServer(&binanceStub{secret: "secret"})
+	defer server.Close()
+
+	client := &BinanceClient{ApiKey: t.Name(), ApiSecret: "secret", BaseURL: server.URL}
+	balances, err := client.GetSpotBalance(context.Background())
+	if err != nil {
+		t.Fatalf("GetSpotBalance: %v", err)
+	}
+	if balances["BTC"] != "0.001" || balances["ETH"] != "0.5" {
+		t.Errorf("балансы = %v", balances)
+	}
+	if _, ok := balances["XRP"]; ok {
+		t.Errorf("нулевой баланс XRP не отброшен")
+	}
+	if balances["TOTAL"] != "1560.00" {
+		t.Errorf("TOTAL = %s, ожидалось 1560.00", balances["TOTAL"])
+	}
+}
+
+func TestBinanceErrorMapping(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		wantKind  error
+		wantCalls int
+	}{
+		{"неверный ключ", http.StatusUnauthorized, `{"code":-2015,"msg":"Invalid API-key"}`, ErrInvalidKey, 1},
+		{"неверная подпись", http.StatusBadRequest, `{"code":-1022,"msg":"Signature is not valid"}`, ErrInvalidKey, 1},
+		{"timestamp", http.StatusBadRequest, `{"code":-1021,"msg":"Timestamp outside recvWindow"}`, ErrTimestamp, 1},
+		{"лимит запросов", http.StatusTooManyRequests, `{"code":-1003,"msg":"Too many requests"}`, ErrRateLimited, 1},
+		{"биржа недоступна", http.StatusServiceUnavailable, ``, ErrMaintenance, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			client := &BinanceClient{ApiKey: t.Name(), ApiSecret: "secret", BaseURL: server.URL}
+			_, err := client.GetSpotBalance(context.Background())
+			if !errors.Is(err, tt.wantKind) {
+				t.Fatalf("ошибка = %v, ожидалась %v", err, tt.wantKind)
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Exchange != ExchangeBinance || apiErr.HTTPStatus != tt.status {
+				t.Errorf("APIError = %+v", apiErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("запросов = %d, ожидалось %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestBinanceRetrySignsEachAttempt(t *testing.T) {
+	var timestamps []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !validBinanceSignature(r.URL.RawQuery, "secret") {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":-1022,"msg":"Signature is not valid"}`))
+			return
+		}
+		timestamps = append(timestamps, r.URL.Query().Get("timestamp"))
+		if len(timestamps) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	client := &BinanceClient{ApiKey: t.Name(), ApiSecret: "secret", BaseURL: server.URL}
+	if _, err := client.GetExecutions(context.Background(), "ETHUSDT", 0, 0); err != nil {
+		t.Fatalf("GetExecutions: %v", err)
+	}
+	if len(timestamps) != 2 || timestamps[0] == timestamps[1] {
+		t.Errorf("timestamp попыток = %v, ожидались две разные подписи", timestamps)
+	}
+}
+
+func TestBinanceRetryAfterPausesRequests(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		wantCalls int
+		wantErr   bool
+	}{
+		// лимит: ждем Retry-After и повторяем
+		{"лимит запросов", http.StatusTooManyRequests, 2, false},
+		// бан IP: повтор только продлит его
+		{"бан IP", http.StatusTeapot, 1, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls []time.Time
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls = append(calls, time.Now())
+				if len(calls) == 1 {
+					w.Header().Set("Retry-After", "1")
+					w.WriteHeader(tt.status)
+					w.Write([]byte(`{"code":-1003,"msg":"Too many requests"}`))
+					return
+				}
+				w.Write([]byte(`[]`))
+			}))
+			defer server.Close()
+
+			client := &BinanceClient{ApiKey: t.Name(), ApiSecret: "secret", BaseURL: server.URL}
+			_, err := client.GetExecutions(context.Background(), "ETHUSDT", 0, 0)
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("ошибка = %v", err)
+			}
+			if err != nil && !errors.Is(err, ErrRateLimited) {
+				t.Errorf("ошибка = %v, ожидалась %v", err, ErrRateLimited)
+			}
+			if len(calls) != tt.wantCalls {
+				t.Fatalf("запросов = %d, ожидалось %d", len(calls), tt.wantCalls)
+			}
+			if len(calls) == 2 && calls[1].Sub(calls[0]) < 900*time.Millisecond {
+				t.Errorf("повтор через %v, раньше Retry-After", calls[1].Sub(calls[0]))
+			}
+			// после бана ждут и запросы других пользователей
+			if tt.wantErr && binanceScheduler.QueueWait("") < 500*time.Millisecond {
+				t.Errorf("очередь Binance не приостановлена: %v", binanceScheduler.QueueWait(""))
+			}
+		})
+	}
+}
@@ -1,96 +1,101 @@
 package exchanges
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
+	"net/url"
+	"os"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
+const (
+	BybitMainnetURL = "https://api.bybit.com"
+	BybitTestnetURL = "https://api-testnet.bybit.com"
+	BybitDemoURL    = "https://api-demo.bybit.com"
+)
+
 type BybitClient struct {
 	ApiKey    string
 	ApiSecret string
+	// BaseURL — адрес REST API: mainnet, testnet, demo или локальный mock-сервер
+	BaseURL string
 }
 
 type BalanceResponse struct {
 	RetCode int    `json:"retCode"`
 	RetMsg  string `json:"retMsg"`
 	Result  struct {
-		List []struct {
-			TotalWalletBalance string `json:"totalWalletBalance"`
-			Coin               []struct {
-				Coin   string `json:"coin"`
-				Equity string `json:"equity"`
-			} `json:"coin"`
-		} `json:"list"`
+		List []bybitWallet `json:"list"`
 	} `json:"result"`
 }
 
+// bybitWallet — кошелек в ответе wallet-balance и в топике wallet приватного потока
+type bybitWallet struct {
+	AccountType        string `json:"accountType"`
+	TotalWalletBalance string `json:"totalWalletBalance"`
+	Coin               []struct {
+		Coin   string `json:"coin"`
+		Equity string `json:"equity"`
+	} `json:"coin"`
+}
+
+var _ Exchange = (*BybitClient)(nil)
+
 func NewBybitClient(apiKey, apiSecret string) *BybitClient {
+	return NewBybitClientWithURL(apiKey, apiSecret, BybitBaseURL())
+}
+
+func NewBybitClientWithURL(apiKey, apiSecret, baseURL string) *BybitClient {
 	return &BybitClient{
 		ApiKey:    apiKey,
 		ApiSecret: apiSecret,
+		BaseURL:   strings.TrimRight(baseURL, "/"),
 	}
 }
 
-func (c *BybitClient) GetSpotBalance() (map[string]string, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest("GET", "https://api.bybit.com/v5/account/wallet-balance?accountType=UNIFIED", nil)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка создания запроса: %v", err)
-	}
-
-	timestamp := fmt.Sprintf("%d", time.Now().UnixMilli())
-	recvWindow := "20000"
-	params := "accountType=UNIFIED"
-
-	req.Header.Add("X-BAPI-API-KEY", c.ApiKey)
-	req.Header.Add("X-BAPI-TIMESTAMP", timestamp)
-	req.Header.Add("X-BAPI-RECV-WINDOW", recvWindow)
-	req.Header.Add("X-BAPI-SIGN", c.GenerateSignature(timestamp, recvWindow, params))
-
-	// Выполняем запрос с retry и проверкой статуса/тела
-	var resp *http.Response
-	var reqErr error
-	var body []byte
-	maxAttempts := 3
-	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		resp, reqErr = client.Do(req)
-		if reqErr != nil {
-			if attempt < maxAttempts {
-				log.Printf("[Bybit] Попытка %d/%d: ошибка выполнения запроса баланса: %v. Повтор через 2 сек...", attempt, maxAttempts, reqErr)
-				time.Sleep(2 * time.Second)
-				continue
-			}
-			return nil, fmt.Errorf("ошибка выполнения запроса: %v", reqErr)
-		}
+// BybitBaseURL определяет адрес API из окружения: BYBIT_BASE_URL задает произвольный
+// адрес (например, локальный mock), иначе BYBIT_ENV выбирает mainnet, testnet или demo
+func BybitBaseURL() string {
+	if baseURL := os.Getenv("BYBIT_BASE_URL"); baseURL != "" {
+		return baseURL
+	}
 
-		body, reqErr = io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if reqErr != nil {
-			return nil, fmt.Errorf("ошибка чтения ответа: %v", reqErr)
-		}
+	switch strings.ToLower(os.Getenv("BYBIT_ENV")) {
+	case "testnet":
+		return BybitTestnetURL
+	case "demo":
+		return BybitDemoURL
+	case "", "mainnet":
+		return BybitMainnetURL
+	default:
+		log.Printf("[Bybit] Неизвестное значение BYBIT_ENV=%q, используется mainnet", os.Getenv("BYBIT_ENV"))
+		return BybitMainnetURL
+	}
+}
 
-		if resp.StatusCode != 200 {
-			// 401 - вероятно проблема с ключами/whitelist
-			log.Printf("[Bybit] Неверный HTTP статус %d при получении баланса. Body: %s", resp.StatusCode, string(body))
-			if resp.StatusCode == 401 {
-				return nil, fmt.Errorf("неавторизовано: проверьте API-ключ/секрет и IP-whitelist")
-			}
-			if attempt < maxAttempts {
-				time.Sleep(2 * time.Second)
-				continue
-			}
-			return nil, fmt.Errorf("API вернул статус %d", resp.StatusCode)
-		}
+func (c *BybitClient) Name() string {
+	return ExchangeBybit
+}
+
+func (c *BybitClient) QueueWait() time.Duration {
+	return bybitScheduler.QueueWait(c.ApiKey)
+}
+
+func (c *BybitClient) GetSpotBalance(ctx context.Context) (map[string]string, error) {
+	params := url.Values{}
+	params.Set("accountType", "UNIFIED")
 
-		break
+	body, err := c.get(ctx, "/v5/account/wallet-balance", params, true)
+	if err != nil {
+		return nil, err
 	}
 
 	var balanceResp BalanceResponse
@@ -99,26 +104,27 @@ func (c *BybitClient) GetSpotBalance() (map[string]string, error) {
 		return nil, fmt.Errorf("неверный формат ответа API при получении баланса")
 	}
 
-	if balanceResp.RetCode != 0 {
-		return nil, fmt.Errorf("API ошибка: %s", balanceResp.RetMsg)
+	if len(balanceResp.Result.List) == 0 {
+		return make(map[string]string), nil
 	}
+	return walletBalances(balanceResp.Result.List[0]), nil
+}
 
+// walletBalances оставляет монеты с балансом от minBalance и общий TOTAL
+func walletBalances(wallet bybitWallet) map[string]string {
 	const minBalance = 0.01
 	balances := make(map[string]string)
-	totalBalance := balanceResp.Result.List[0].TotalWalletBalance
-	balances["TOTAL"] = totalBalance
-
-	if len(balanceResp.Result.List) > 0 {
-		for _, coin := range balanceResp.Result.List[0].Coin {
-			equity := coin.Equity
-			if equity != "0" && equity != "" {
-				if value, err := strconv.ParseFloat(equity, 64); err == nil && value >= minBalance {
-					balances[coin.Coin] = equity
-				}
+
+	balances["TOTAL"] = wallet.TotalWalletBalance
+	for _, coin := range wallet.Coin {
+		equity := coin.Equity
+		if equity != "0" && equity != "" {
+			if value, err := strconv.ParseFloat(equity, 64); err == nil && value >= minBalance {
+				balances[coin.Coin] = equity
 			}
 		}
 	}
-	return balances, nil
+	return balances
 }
 
 func (c *BybitClient) GenerateSignature(timestamp string, recvWindow string, params string) string {
@@ -139,38 +145,10 @@ type TickerResponse struct {
 	} `json:"result"`
 }
 
-func (c *BybitClient) GetMarketTickers(category string) (map[string]TickerInfo, error) {
-	url := fmt.Sprintf("https://api.bybit.com/v5/market/tickers?category=%s", category)
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	var resp *http.Response
-	var reqErr error
-	var body []byte
-	maxAttempts := 3
-	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		resp, reqErr = client.Get(url)
-		if reqErr != nil {
-			if attempt < maxAttempts {
-				log.Printf("[Bybit] Попытка %d/%d: ошибка получения тикеров: %v. Повтор через 2 сек...", attempt, maxAttempts, reqErr)
-				time.Sleep(2 * time.Second)
-				continue
-			}
-			return nil, reqErr
-		}
-		body, reqErr = io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if reqErr != nil {
-			return nil, reqErr
-		}
-		if resp.StatusCode != 200 {
-			log.Printf("[Bybit] Неверный HTTP статус %d при получении тикеров. Body: %s", resp.StatusCode, string(body))
-			if attempt < maxAttempts {
-				time.Sleep(2 * time.Second)
-				continue
-			}
-			return nil, fmt.Errorf("API вернул статус %d", resp.StatusCode)
-		}
-		break
+func (c *BybitClient) getTickers(ctx context.Context, params url.Values) ([]TickerInfo, error) {
+	body, err := c.get(ctx, "/v5/market/tickers", params, false)
+	if err != nil {
+		return nil, err
 	}
 
 	var responseData TickerResponse
@@ -178,62 +156,284 @@ func (c *BybitClient) GetMarketTickers(category string) (map[string]TickerInfo,
 		log.Printf("[Bybit] Ошибка парсинга JSON тикеров: %v. Body: %s", err, string(body))
 		return nil, fmt.Errorf("неверный формат ответа API при получении тикеров")
 	}
+	return responseData.Result.List, nil
+}
+
+func (c *BybitClient) GetMarketTickers(ctx context.Context, category string) (map[string]TickerInfo, error) {
+	params := url.Values{}
+	params.Set("category", category)
+
+	tickers, err := c.getTickers(ctx, params)
+	if err != nil {
+		return nil, err
+	}
 
 	tickersMap := make(map[string]TickerInfo)
-	for _, ticker := range responseData.Result.List {
+	for _, ticker := range tickers {
 		tickersMap[ticker.Symbol] = ticker
 	}
 
 	return tickersMap, nil
 }
 
-func (c *BybitClient) GetAllMarketPrices() (map[string]float64, error) {
-	url := "https://api.bybit.com/v5/market/tickers?category=spot"
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	var resp *http.Response
-	var reqErr error
-	var body []byte
-	maxAttempts := 3
-	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		resp, reqErr = client.Get(url)
-		if reqErr != nil {
-			if attempt < maxAttempts {
-				log.Printf("[Bybit] Попытка %d/%d: ошибка получения цен: %v. Повтор через 2 сек...", attempt, maxAttempts, reqErr)
-				time.Sleep(2 * time.Second)
-				continue
-			}
-			return nil, reqErr
+func (c *BybitClient) GetAllMarketPrices(ctx context.Context) (map[string]float64, error) {
+	params := url.Values{}
+	params.Set("category", "spot")
+
+	tickers, err := c.getTickers(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	pricesMap := make(map[string]float64)
+	for _, ticker := range tickers {
+		price, err := strconv.ParseFloat(ticker.LastPrice, 64)
+		if err == nil {
+			pricesMap[ticker.Symbol] = price
+		}
+	}
+
+	return pricesMap, nil
+}
+
+func (c *BybitClient) GetTicker(ctx context.Context, symbol string) (TickerInfo, error) {
+	params := url.Values{}
+	params.Set("category", "spot")
+	params.Set("symbol", symbol)
+
+	tickers, err := c.getTickers(ctx, params)
+	if err != nil {
+		return TickerInfo{}, err
+	}
+
+	if len(tickers) == 0 {
+		return TickerInfo{}, fmt.Errorf("цена для %s не найдена", symbol)
+	}
+	return tickers[0], nil
+}
+
+type klineResponse struct {
+	Result struct {
+		// [время открытия, open, high, low, close, volume, turnover], от новых к старым
+		List [][]string `json:"list"`
+	} `json:"result"`
+}
+
+const bybitKlineLimit = 1000
+
+func (c *BybitClient) GetDailyPrices(ctx context.Context, symbol string, startTime, endTime int64) ([]PricePoint, error) {
+	var points []PricePoint
+	for endTime >= startTime {
+		params := url.Values{}
+		params.Set("category", "spot")
+		params.Set("symbol", symbol)
+		params.Set("interval", "D")
+		params.Set("start", strconv.FormatInt(startTime, 10))
+		params.Set("end", strconv.FormatInt(endTime, 10))
+		params.Set("limit", strconv.Itoa(bybitKlineLimit))
+
+		body, err := c.get(ctx, "/v5/market/kline", params, false)
+		if err != nil {
+			return nil, err
 		}
-		body, reqErr = io.ReadAll(resp.Body)
-		resp.Body.Close()
-		if reqErr != nil {
-			return nil, reqErr
+		var resp klineResponse
+		if err := json.Unmarshal(body, &resp); err != nil {
+			log.Printf("[Bybit] Ошибка парсинга свечей %s: %v. Body: %s", symbol, err, string(body))
+			return nil, fmt.Errorf("неверный формат ответа API при получении свечей")
 		}
-		if resp.StatusCode != 200 {
-			log.Printf("[Bybit] Неверный HTTP статус %d при получении цен. Body: %s", resp.StatusCode, string(body))
-			if attempt < maxAttempts {
-				time.Sleep(2 * time.Second)
+
+		oldest := endTime
+		for _, kline := range resp.Result.List {
+			if len(kline) < 5 {
+				continue
+			}
+			openTime, err1 := strconv.ParseInt(kline[0], 10, 64)
+			closePrice, err2 := strconv.ParseFloat(kline[4], 64)
+			if err1 != nil || err2 != nil {
 				continue
 			}
-			return nil, fmt.Errorf("API вернул статус %d", resp.StatusCode)
+			points = append(points, PricePoint{Time: openTime, Price: closePrice})
+			if openTime < oldest {
+				oldest = openTime
+			}
 		}
-		break
+		if len(resp.Result.List) < bybitKlineLimit {
+			break
+		}
+		endTime = oldest - 1
 	}
 
-	var responseData TickerResponse
+	sort.Slice(points, func(i, j int) bool { return points[i].Time < points[j].Time })
+	return points, nil
+}
+
+type InstrumentsResponse struct {
+	RetCode int    `json:"retCode"`
+	RetMsg  string `json:"retMsg"`
+	Result  struct {
+		List []InstrumentInfo `json:"list"`
+	} `json:"result"`
+}
+
+func (c *BybitClient) GetInstrumentsInfo(ctx context.Context) (map[string]InstrumentInfo, error) {
+	params := url.Values{}
+	params.Set("category", "spot")
+
+	body, err := c.get(ctx, "/v5/market/instruments-info", params, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var responseData InstrumentsResponse
 	if err := json.Unmarshal(body, &responseData); err != nil {
-		log.Printf("[Bybit] Ошибка парсинга JSON цен: %v. Body: %s", err, string(body))
-		return nil, fmt.Errorf("неверный формат ответа API при получении цен")
+		log.Printf("[Bybit] Ошибка парсинга JSON инструментов: %v. Body: %s", err, string(body))
+		return nil, fmt.Errorf("неверный формат ответа API при получении инструментов")
 	}
 
-	pricesMap := make(map[string]float64)
-	for _, ticker := range responseData.Result.List {
-		price, err := strconv.ParseFloat(ticker.LastPrice, 64)
-		if err == nil {
-			pricesMap[ticker.Symbol] = price
+	instruments := make(map[string]InstrumentInfo)
+	for _, instrument := range responseData.Result.List {
+		instruments[instrument.Symbol] = instrument
+	}
+	return instruments, nil
+}
+
+type ExecutionResponse struct {
+	RetCode int    `json:"retCode"`
+	RetMsg  string `json:"retMsg"`
+	Result  struct {
+		List           []Execution `json:"list"`
+		NextPageCursor string      `json:"nextPageCursor"`
+	} `json:"result"`
+}
+
+// GetExecutions забирает сделки за период постранично. Bybit отдает не больше 7 дней
+// за один запрос, пустой symbol означает все спотовые пары.
+func (c *BybitClient) GetExecutions(ctx context.Context, symbol string, startTime, endTime int64) ([]Execution, error) {
+	var allTrades []Execution
+
+	cursor := ""
+	for {
+		params := url.Values{}
+		params.Add("category", "spot")
+		if symbol != "" {
+			params.Add("symbol", symbol)
+		}
+		params.Add("limit", "100")
+		params.Add("startTime", fmt.Sprintf("%d", startTime))
+		params.Add("endTime", fmt.Sprintf("%d", endTime))
+		if cursor != "" {
+			params.Add("cursor", cursor)
+		}
+
+		body, err := c.get(ctx, "/v5/execution/list", params, true)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка запроса истории: %w", err)
+		}
+
+		var responseData ExecutionResponse
+		if err := json.Unmarshal(body, &responseData); err != nil {
+			log.Printf("[Bybit] Ошибка парсинга JSON истории: %v. Body: %s", err, string(body))
+			return nil, fmt.Errorf("неверный формат ответа API при получении истории")
+		}
+
+		allTrades = append(allTrades, responseData.Result.List...)
+
+		if responseData.Result.NextPageCursor == "" {
+			break
+		}
+
+		cursor = responseData.Result.NextPageCursor
+		if err := sleepCtx(ctx, 100*time.Millisecond); err != nil {
+			return nil, err
 		}
 	}
 
-	return pricesMap, nil
+	return allTrades, nil
+}
+
+// GetExecutionsSince идет окнами по 7 дней от startTime к текущему моменту.
+// При ошибке возвращает уже загруженные окна вместе с *PartialSyncError.
+func (c *BybitClient) GetExecutionsSince(ctx context.Context, startTime int64) ([]Execution, error) {
+	var allTrades []Execution
+
+	now := time.Now().UnixMilli()
+	currentStart := startTime
+	sevenDaysMs := int64(7 * 24 * 60 * 60 * 1000)
+
+	for currentStart < now {
+		currentEnd := currentStart + sevenDaysMs
+		if currentEnd > now {
+			currentEnd = now
+		}
+
+		trades, err := c.GetExecutions(ctx, "", currentStart, currentEnd)
+		if err != nil {
+			// окна до currentStart загружены полностью — их можно сохранить
+			return allTrades, &PartialSyncError{SyncedUntil: currentStart, Err: err}
+		}
+		allTrades = append(allTrades, trades...)
+
+		currentStart = currentEnd
+		if err := sleepCtx(ctx, 100*time.Millisecond); err != nil {
+			return allTrades, &PartialSyncError{SyncedUntil: currentStart, Err: err}
+		}
+	}
+
+	return allTrades, nil
+}
+
+type apiKeyInfoResponse struct {
+	Result struct {
+		ReadOnly    int                 `json:"readOnly"`
+		Permissions map[string][]string `json:"permissions"`
+		IPs         []string            `json:"ips"`
+		ExpiredAt   string              `json:"expiredAt"`
+		UserID      int64               `json:"userID"`
+		IsMaster    bool                `json:"isMaster"`
+	} `json:"result"`
+}
+
+// разделы прав Bybit, дающие торговлю
+var bybitTradePermissions = []string{"Spot", "ContractTrade", "Options", "Derivatives", "Exchange", "CopyTrading", "BlockTrade"}
+
+func (c *BybitClient) GetKeyInfo(ctx context.Context) (KeyInfo, error) {
+	body, err := c.get(ctx, "/v5/user/query-api", url.Values{}, true)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	var resp apiKeyInfoResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		log.Printf("[Bybit] Ошибка парсинга информации о ключе: %v. Body: %s", err, string(body))
+		return KeyInfo{}, fmt.Errorf("неверный формат ответа API при проверке ключа")
+	}
+
+	r := resp.Result
+	info := KeyInfo{ReadOnly: r.ReadOnly == 1, IsMaster: r.IsMaster}
+	if r.UserID > 0 {
+		info.UID = strconv.FormatInt(r.UserID, 10)
+	}
+	for _, section := range bybitTradePermissions {
+		if len(r.Permissions[section]) > 0 {
+			info.CanTrade = true
+		}
+	}
+	for _, permission := range r.Permissions["Wallet"] {
+		if permission == "Withdraw" {
+			info.CanWithdraw = true
+		}
+	}
+	// "*" — без привязки к IP
+	for _, ip := range r.IPs {
+		if ip != "" && ip != "*" {
+			info.IPs = append(info.IPs, ip)
+		}
+	}
+	info.IPRestricted = len(info.IPs) > 0
+	if r.ExpiredAt != "" {
+		if expires, err := time.Parse(time.RFC3339, r.ExpiredAt); err == nil {
+			info.ExpiresAt = expires
+		}
+	}
+	return info, nil
 }
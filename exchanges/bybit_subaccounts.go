@@ -0,0 +1,95 @@
+package exchanges
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+)
+
+// SubAccount — субаккаунт, видимый по ключу мастер-аккаунта
+type SubAccount struct {
+	UID      string
+	Username string
+	// Active — субаккаунт не заморожен и вход в него не запрещен
+	Active bool
+}
+
+// SubAccountProvider реализуют биржи, где ключ мастер-аккаунта видит субаккаунты
+// и их балансы. Историю сделок субаккаунта так получить нельзя — для нее нужен его ключ.
+type SubAccountProvider interface {
+	GetSubAccounts(ctx context.Context) ([]SubAccount, error)
+	// GetSubAccountBalance возвращает количество монет субаккаунта без "TOTAL"
+	GetSubAccountBalance(ctx context.Context, uid string) (map[string]string, error)
+}
+
+type subMembersResponse struct {
+	Result struct {
+		SubMembers []struct {
+			UID      string `json:"uid"`
+			Username string `json:"username"`
+			Status   int    `json:"status"`
+		} `json:"subMembers"`
+	} `json:"result"`
+}
+
+func (c *BybitClient) GetSubAccounts(ctx context.Context) ([]SubAccount, error) {
+	body, err := c.get(ctx, "/v5/user/query-sub-members", url.Values{}, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp subMembersResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		log.Printf("[Bybit] Ошибка парсинга субаккаунтов: %v. Body: %s", err, string(body))
+		return nil, fmt.Errorf("неверный формат ответа API при получении субаккаунтов")
+	}
+
+	subAccounts := make([]SubAccount, 0, len(resp.Result.SubMembers))
+	for _, member := range resp.Result.SubMembers {
+		subAccounts = append(subAccounts, SubAccount{
+			UID:      member.UID,
+			Username: member.Username,
+			// 1 — обычный статус, 2 — вход запрещен, 4 — заморожен
+			Active: member.Status == 1,
+		})
+	}
+	return subAccounts, nil
+}
+
+type coinsBalanceResponse struct {
+	Result struct {
+		Balance []struct {
+			Coin          string `json:"coin"`
+			WalletBalance string `json:"walletBalance"`
+		} `json:"balance"`
+	} `json:"result"`
+}
+
+func (c *BybitClient) GetSubAccountBalance(ctx context.Context, uid string) (map[string]string, error) {
+	params := url.Values{}
+	params.Set("memberId", uid)
+	params.Set("accountType", "UNIFIED")
+
+	body, err := c.get(ctx, "/v5/asset/transfer/query-account-coins-balance", params, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var resp coinsBalanceResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		log.Printf("[Bybit] Ошибка парсинга баланса субаккаунта %s: %v. Body: %s", uid, err, string(body))
+		return nil, fmt.Errorf("неверный формат ответа API при получении баланса субаккаунта")
+	}
+
+	const minBalance = 0.01
+	balances := make(map[string]string)
+	for _, coin := range resp.Result.Balance {
+		if value, err := strconv.ParseFloat(coin.WalletBalance, 64); err == nil && value >= minBalance {
+			balances[coin.Coin] = coin.WalletBalance
+		}
+	}
+	return balances, nil
+}
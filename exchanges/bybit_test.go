@@ -0,0 +1,54 @@
+package exchanges
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestBybitErrorMapping(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		wantKind  error
+		wantCalls int
+	}{
+		{"неверный ключ", http.StatusUnauthorized, ``, ErrInvalidKey, 1},
+		// 403 — бан IP: повтор его только продлит
+		{"бан IP", http.StatusForbidden, ``, ErrRateLimited, 1},
+		{"биржа недоступна", http.StatusServiceUnavailable, ``, ErrMaintenance, bybitMaxAttempts},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/v5/market/time" {
+					fmt.Fprintf(w, `{"retCode":0,"retMsg":"OK","result":{"timeNano":"%d"}}`, time.Now().UnixNano())
+					return
+				}
+				calls++
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			client := NewBybitClientWithURL(t.Name(), "secret", server.URL)
+			_, err := client.GetSpotBalance(context.Background())
+			if !errors.Is(err, tt.wantKind) {
+				t.Fatalf("ошибка = %v, ожидалась %v", err, tt.wantKind)
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Exchange != ExchangeBybit || apiErr.HTTPStatus != tt.status {
+				t.Errorf("APIError = %+v", apiErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("запросов = %d, ожидалось %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package exchanges
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	BybitPublicSpotWSURL        = "wss://stream.bybit.com/v5/public/spot"
+	BybitTestnetPublicSpotWSURL = "wss://stream-testnet.bybit.com/v5/public/spot"
+
+	// Bybit закрывает соединение без ping дольше 20 секунд
+	wsPingInterval = 20 * time.Second
+	// если за это время не пришло ни одного сообщения (даже pong), соединение мертво
+	wsReadTimeout  = 2*wsPingInterval + 5*time.Second
+	wsWriteTimeout = 5 * time.Second
+	// спотовый поток принимает не больше 10 топиков в одном запросе подписки
+	wsMaxArgsPerRequest = 10
+)
+
+// BybitPublicWSURL выбирает адрес публичного спотового потока так же, как BybitBaseURL:
+// BYBIT_WS_URL задает произвольный адрес (например, локальный стенд), иначе по BYBIT_ENV.
+// У demo-окружения публичных потоков нет, цены берутся с mainnet.
+func BybitPublicWSURL() string {
+	if wsURL := os.Getenv("BYBIT_WS_URL"); wsURL != "" {
+		return wsURL
+	}
+	if strings.ToLower(os.Getenv("BYBIT_ENV")) == "testnet" {
+		return BybitTestnetPublicSpotWSURL
+	}
+	return BybitPublicSpotWSURL
+}
+
+// wsSession — общее для потоков Bybit: переподключение с задержкой, ping
+// и последовательная запись в соединение
+type wsSession struct {
+	name string
+	url  string
+	// onConnect вызывается сразу после подключения: авторизация, подписки
+	onConnect func(conn *websocket.Conn) error
+	// onDisconnect вызывается после разрыва соединения
+	onDisconnect func()
+	onMessage    func(data []byte)
+
+	mu   sync.Mutex
+	conn *websocket.Conn
+
+	// gorilla/websocket не допускает одновременную запись из нескольких горутин
+	writeMu sync.Mutex
+}
+
+// run держит соединение до отмены контекста. Ошибки ключа (неверный ключ, IP, права)
+// переподключением не исправить — на них run завершается.
+func (w *wsSession) run(ctx context.Context) error {
+	attempt := 0
+	for ctx.Err() == nil {
+		connectedAt := time.Now()
+		err := w.runOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if errors.Is(err, ErrInvalidKey) || errors.Is(err, ErrIPNotAllowed) || errors.Is(err, ErrPermissionDenied) {
+			log.Printf("[%s] Поток остановлен: %v", w.name, err)
+			return err
+		}
+
+		// соединение, прожившее дольше минуты, считаем успешным и сбрасываем задержку
+		if time.Since(connectedAt) > time.Minute {
+			attempt = 0
+		}
+		attempt++
+		delay := backoffDelay(attempt)
+		log.Printf("[%s] Соединение потеряно: %v. Переподключение через %v", w.name, err, delay.Round(time.Millisecond))
+		if err := sleepCtx(ctx, delay); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+func (w *wsSession) runOnce(ctx context.Context) error {
+	dialer := websocket.Dialer{HandshakeTimeout: 10 * time.Second}
+	conn, _, err := dialer.DialContext(ctx, w.url, nil)
+	if err != nil {
+		return fmt.Errorf("ошибка подключения: %w", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+	})
+
+	w.mu.Lock()
+	w.conn = conn
+	w.mu.Unlock()
+	defer func() {
+		w.mu.Lock()
+		w.conn = nil
+		w.mu.Unlock()
+		if w.onDisconnect != nil {
+			w.onDisconnect()
+		}
+	}()
+
+	if w.onConnect != nil {
+		if err := w.onConnect(conn); err != nil {
+			return err
+		}
+	}
+
+	// закрытие соединения прерывает ReadMessage в цикле ниже
+	stop := make(chan struct{})
+	defer close(stop)
+	go w.keepAlive(ctx, conn, stop)
+
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(wsReadTimeout))
+		w.onMessage(data)
+	}
+}
+
+// current возвращает активное соединение или nil
+func (w *wsSession) current() *websocket.Conn {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.conn
+}
+
+// keepAlive шлет ping в формате Bybit и закрывает соединение при отмене контекста
+func (w *wsSession) keepAlive(ctx context.Context, conn *websocket.Conn, stop <-chan struct{}) {
+	ticker := time.NewTicker(wsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ctx.Done():
+			w.writeMu.Lock()
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteTimeout))
+			w.writeMu.Unlock()
+			conn.Close()
+			return
+		case <-ticker.C:
+			if err := w.writeJSON(conn, map[string]string{"op": "ping"}); err != nil {
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+type wsRequest struct {
+	Op   string   `json:"op"`
+	Args []string `json:"args"`
+}
+
+// subscribe подписывает или отписывает топики пачками по wsMaxArgsPerRequest
+func (w *wsSession) subscribe(conn *websocket.Conn, op string, topics []string) error {
+	for start := 0; start < len(topics); start += wsMaxArgsPerRequest {
+		end := start + wsMaxArgsPerRequest
+		if end > len(topics) {
+			end = len(topics)
+		}
+		if err := w.writeJSON(conn, wsRequest{Op: op, Args: topics[start:end]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *wsSession) writeJSON(conn *websocket.Conn, v interface{}) error {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	return conn.WriteJSON(v)
+}
+
+// wsResponse — ответ на операции auth, subscribe и ping
+type wsResponse struct {
+	Op      string `json:"op"`
+	Success *bool  `json:"success"`
+	RetMsg  string `json:"ret_msg"`
+}
+
+// PriceStream держит подписку на топики tickers публичного WebSocket Bybit и хранит
+// последние цены. При обрыве переподключается и заново подписывается на все символы.
+type PriceStream struct {
+	URL string
+	// OnPrice вызывается на каждое обновление цены из горутины чтения потока
+	OnPrice func(symbol string, price float64)
+
+	mu      sync.Mutex
+	prices  map[string]float64
+	symbols map[string]bool
+
+	session *wsSession
+}
+
+func NewPriceStream(wsURL string) *PriceStream {
+	s := &PriceStream{
+		URL:     wsURL,
+		prices:  make(map[string]float64),
+		symbols: make(map[string]bool),
+	}
+	s.session = &wsSession{
+		name:      "Bybit WS",
+		url:       wsURL,
+		onConnect: s.onConnect,
+		onMessage: s.handleMessage,
+	}
+	return s
+}
+
+// Price возвращает последнюю цену символа из потока
+func (s *PriceStream) Price(symbol string) (float64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	price, ok := s.prices[symbol]
+	return price, ok
+}
+
+func tickerTopics(symbols []string) []string {
+	topics := make([]string, 0, len(symbols))
+	for _, symbol := range symbols {
+		topics = append(topics, "tickers."+symbol)
+	}
+	return topics
+}
+
+// SetSymbols задает набор символов для подписки: новые подписываются сразу,
+// лишние отписываются. Без соединения набор применится при подключении.
+func (s *PriceStream) SetSymbols(symbols []string) {
+	wanted := make(map[string]bool, len(symbols))
+	for _, symbol := range symbols {
+		wanted[symbol] = true
+	}
+
+	s.mu.Lock()
+	var added, removed []string
+	for symbol := range wanted {
+		if !s.symbols[symbol] {
+			added = append(added, symbol)
+		}
+	}
+	for symbol := range s.symbols {
+		if !wanted[symbol] {
+			removed = append(removed, symbol)
+			delete(s.prices, symbol)
+		}
+	}
+	s.symbols = wanted
+	s.mu.Unlock()
+
+	conn := s.session.current()
+	if conn == nil {
+		return
+	}
+	if err := s.session.subscribe(conn, "subscribe", tickerTopics(added)); err != nil {
+		log.Printf("[Bybit WS] Ошибка подписки: %v", err)
+	}
+	if err := s.session.subscribe(conn, "unsubscribe", tickerTopics(removed)); err != nil {
+		log.Printf("[Bybit WS] Ошибка отписки: %v", err)
+	}
+}
+
+// Run подключается к потоку и держит соединение до отмены контекста
+func (s *PriceStream) Run(ctx context.Context) {
+	s.session.run(ctx)
+}
+
+func (s *PriceStream) onConnect(conn *websocket.Conn) error {
+	s.mu.Lock()
+	symbols := make([]string, 0, len(s.symbols))
+	for symbol := range s.symbols {
+		symbols = append(symbols, symbol)
+	}
+	s.mu.Unlock()
+
+	if err := s.session.subscribe(conn, "subscribe", tickerTopics(symbols)); err != nil {
+		return err
+	}
+	log.Printf("[Bybit WS] Подключено к %s, символов: %d", s.URL, len(symbols))
+	return nil
+}
+
+type wsTickerMessage struct {
+	wsResponse
+	Topic string `json:"topic"`
+	Data  struct {
+		Symbol    string `json:"symbol"`
+		LastPrice string `json:"lastPrice"`
+	} `json:"data"`
+}
+
+func (s *PriceStream) handleMessage(data []byte) {
+	var msg wsTickerMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("[Bybit WS] Ошибка парсинга сообщения: %v. Body: %s", err, string(data))
+		return
+	}
+
+	// ответы на subscribe/ping; неуспешная подписка — обычно несуществующий символ
+	if msg.Op != "" {
+		if msg.Success != nil && !*msg.Success {
+			log.Printf("[Bybit WS] Ошибка операции %s: %s", msg.Op, msg.RetMsg)
+		}
+		return
+	}
+	if !strings.HasPrefix(msg.Topic, "tickers.") {
+		return
+	}
+
+	price, err := strconv.ParseFloat(msg.Data.LastPrice, 64)
+	if err != nil || price <= 0 {
+		return
+	}
+	symbol := msg.Data.Symbol
+
+	s.mu.Lock()
+	if !s.symbols[symbol] {
+		// обновление по уже отписанному символу
+		s.mu.Unlock()
+		return
+	}
+	s.prices[symbol] = price
+	onPrice := s.OnPrice
+	s.mu.Unlock()
+
+	if onPrice != nil {
+		onPrice(symbol, price)
+	}
+}
@@ -0,0 +1,207 @@
+package exchanges
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	BybitPrivateStreamURL        = "wss://stream.bybit.com/v5/private"
+	BybitTestnetPrivateStreamURL = "wss://stream-testnet.bybit.com/v5/private"
+	BybitDemoPrivateStreamURL    = "wss://stream-demo.bybit.com/v5/private"
+)
+
+// BybitPrivateWSURL — адрес приватного потока: BYBIT_PRIVATE_WS_URL или по BYBIT_ENV
+func BybitPrivateWSURL() string {
+	if wsURL := os.Getenv("BYBIT_PRIVATE_WS_URL"); wsURL != "" {
+		return wsURL
+	}
+	switch strings.ToLower(os.Getenv("BYBIT_ENV")) {
+	case "testnet":
+		return BybitTestnetPrivateStreamURL
+	case "demo":
+		return BybitDemoPrivateStreamURL
+	default:
+		return BybitPrivateStreamURL
+	}
+}
+
+// ExecutionStream — приватный поток пользователя: исполнения по споту (execution.spot)
+// и изменения кошелька (wallet)
+type ExecutionStream struct {
+	ApiKey    string
+	ApiSecret string
+	// OnConnect вызывается после авторизации и подписки, в том числе после переподключения:
+	// пока соединения не было, исполнения могли пройти мимо потока. Вызывается до чтения
+	// сообщений, поэтому не должен блокироваться.
+	OnConnect func()
+	// OnExecutions получает спотовые исполнения из одного сообщения
+	OnExecutions func(fills []Execution)
+
+	mu     sync.Mutex
+	wallet map[string]string
+
+	session *wsSession
+}
+
+func NewExecutionStream(apiKey, apiSecret string) *ExecutionStream {
+	return NewExecutionStreamWithURL(apiKey, apiSecret, BybitPrivateWSURL())
+}
+
+func NewExecutionStreamWithURL(apiKey, apiSecret, wsURL string) *ExecutionStream {
+	s := &ExecutionStream{
+		ApiKey:    apiKey,
+		ApiSecret: apiSecret,
+	}
+	s.session = &wsSession{
+		name:      "Bybit WS private",
+		url:       wsURL,
+		onConnect: s.onConnect,
+		onMessage: s.handleMessage,
+		onDisconnect: func() {
+			// без соединения снимок кошелька может устареть
+			s.mu.Lock()
+			s.wallet = nil
+			s.mu.Unlock()
+		},
+	}
+	return s
+}
+
+// Run держит поток до отмены контекста. Возвращает ошибку, если биржа отклонила ключ.
+func (s *ExecutionStream) Run(ctx context.Context) error {
+	return s.session.run(ctx)
+}
+
+// Balances — последний снимок спотового кошелька из потока. Bybit присылает его
+// только при изменениях, поэтому сразу после подключения снимка нет.
+func (s *ExecutionStream) Balances() (map[string]string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.wallet == nil {
+		return nil, false
+	}
+	balances := make(map[string]string, len(s.wallet))
+	for coin, value := range s.wallet {
+		balances[coin] = value
+	}
+	return balances, true
+}
+
+type wsAuthRequest struct {
+	Op   string        `json:"op"`
+	Args []interface{} `json:"args"`
+}
+
+func (s *ExecutionStream) onConnect(conn *websocket.Conn) error {
+	// подпись действительна до expires; время берем с поправкой на часы биржи
+	expires := bybitClock(BybitBaseURL()).now().Add(10 * time.Second).UnixMilli()
+	h := hmac.New(sha256.New, []byte(s.ApiSecret))
+	h.Write([]byte(fmt.Sprintf("GET/realtime%d", expires)))
+	signature := hex.EncodeToString(h.Sum(nil))
+
+	auth := wsAuthRequest{Op: "auth", Args: []interface{}{s.ApiKey, expires, signature}}
+	if err := s.session.writeJSON(conn, auth); err != nil {
+		return err
+	}
+
+	_, data, err := conn.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("нет ответа на авторизацию: %w", err)
+	}
+	var resp wsResponse
+	if err := json.Unmarshal(data, &resp); err != nil || resp.Op != "auth" {
+		return fmt.Errorf("неожиданный ответ на авторизацию: %s", string(data))
+	}
+	if resp.Success == nil || !*resp.Success {
+		return &APIError{Exchange: ExchangeBybit, Message: resp.RetMsg, Kind: ErrInvalidKey}
+	}
+
+	if err := s.session.subscribe(conn, "subscribe", []string{"execution.spot", "wallet"}); err != nil {
+		return err
+	}
+	if s.OnConnect != nil {
+		s.OnConnect()
+	}
+	return nil
+}
+
+type wsPrivateMessage struct {
+	wsResponse
+	Topic string          `json:"topic"`
+	Data  json.RawMessage `json:"data"`
+}
+
+type wsExecution struct {
+	Execution
+	Category string `json:"category"`
+	ExecType string `json:"execType"`
+}
+
+func (s *ExecutionStream) handleMessage(data []byte) {
+	var msg wsPrivateMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Printf("[Bybit WS private] Ошибка парсинга сообщения: %v", err)
+		return
+	}
+	if msg.Op != "" {
+		if msg.Success != nil && !*msg.Success {
+			log.Printf("[Bybit WS private] Ошибка операции %s: %s", msg.Op, msg.RetMsg)
+		}
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(msg.Topic, "execution"):
+		s.handleExecutions(msg.Data)
+	case msg.Topic == "wallet":
+		s.handleWallet(msg.Data)
+	}
+}
+
+func (s *ExecutionStream) handleExecutions(data json.RawMessage) {
+	var executions []wsExecution
+	if err := json.Unmarshal(data, &executions); err != nil {
+		log.Printf("[Bybit WS private] Ошибка парсинга исполнений: %v", err)
+		return
+	}
+
+	var fills []Execution
+	for _, e := range executions {
+		// только сделки по споту: комиссии фандинга и ликвидации в PnL не входят
+		if e.Category != "spot" || (e.ExecType != "" && e.ExecType != "Trade") {
+			continue
+		}
+		fills = append(fills, e.Execution)
+	}
+	if len(fills) > 0 && s.OnExecutions != nil {
+		s.OnExecutions(fills)
+	}
+}
+
+func (s *ExecutionStream) handleWallet(data json.RawMessage) {
+	var wallets []bybitWallet
+	if err := json.Unmarshal(data, &wallets); err != nil {
+		log.Printf("[Bybit WS private] Ошибка парсинга кошелька: %v", err)
+		return
+	}
+	for _, wallet := range wallets {
+		if wallet.AccountType != "UNIFIED" {
+			continue
+		}
+		s.mu.Lock()
+		s.wallet = walletBalances(wallet)
+		s.mu.Unlock()
+	}
+}
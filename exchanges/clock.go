@@ -0,0 +1,117 @@
+package exchanges
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	bybitTimestampCode = 10002
+	// как часто перепроверять расхождение часов, даже если ошибок не было
+	clockResyncInterval = 30 * time.Minute
+)
+
+// serverClock хранит расхождение локальных часов с часами биржи. Подпись с
+// timestamp вне recvWindow Bybit отклоняет с retCode 10002.
+type serverClock struct {
+	mu       sync.Mutex
+	offset   time.Duration
+	syncedAt time.Time
+}
+
+// часы отдельно для каждого адреса API: у mainnet, testnet и mock они разные
+var (
+	bybitClocksMu sync.Mutex
+	bybitClocks   = make(map[string]*serverClock)
+)
+
+func bybitClock(baseURL string) *serverClock {
+	bybitClocksMu.Lock()
+	defer bybitClocksMu.Unlock()
+
+	clock, ok := bybitClocks[baseURL]
+	if !ok {
+		clock = &serverClock{}
+		bybitClocks[baseURL] = clock
+	}
+	return clock
+}
+
+func (s *serverClock) now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Add(s.offset)
+}
+
+func (s *serverClock) stale() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Since(s.syncedAt) > clockResyncInterval
+}
+
+// postpone откладывает следующую синхронизацию, сохраняя прежнее смещение
+func (s *serverClock) postpone() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.syncedAt = time.Now()
+}
+
+func (s *serverClock) set(offset time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.offset = offset
+	s.syncedAt = time.Now()
+}
+
+type bybitServerTimeResponse struct {
+	Result struct {
+		TimeNano string `json:"timeNano"`
+	} `json:"result"`
+}
+
+// syncClock запрашивает /v5/market/time и запоминает смещение. Время ответа сервера
+// относим к середине запроса, чтобы не учитывать задержку сети дважды.
+func (c *BybitClient) syncClock(ctx context.Context) error {
+	sentAt := time.Now()
+	body, err := c.get(ctx, "/v5/market/time", nil, false)
+	if err != nil {
+		return err
+	}
+	receivedAt := time.Now()
+
+	var resp bybitServerTimeResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return fmt.Errorf("неверный формат ответа API при получении времени сервера")
+	}
+	nanos, err := strconv.ParseInt(resp.Result.TimeNano, 10, 64)
+	if err != nil {
+		return fmt.Errorf("неверное время сервера: %q", resp.Result.TimeNano)
+	}
+
+	localMid := sentAt.Add(receivedAt.Sub(sentAt) / 2)
+	offset := time.Unix(0, nanos).Sub(localMid)
+	bybitClock(c.BaseURL).set(offset)
+
+	if offset > time.Second || offset < -time.Second {
+		log.Printf("[Bybit] Часы расходятся с сервером на %v, подпись будет скорректирована", offset.Round(time.Millisecond))
+	}
+	return nil
+}
+
+// timestamp — время для подписи с учетом смещения часов биржи
+func (c *BybitClient) timestamp(ctx context.Context) string {
+	clock := bybitClock(c.BaseURL)
+	if clock.stale() {
+		if err := c.syncClock(ctx); err != nil {
+			// не критично: подпишем по локальным часам, при 10002 попробуем еще раз
+			log.Printf("[Bybit] Не удалось синхронизировать время с сервером: %v", err)
+			clock.postpone()
+		}
+	}
+	return strconv.FormatInt(clock.now().UnixMilli(), 10)
+}
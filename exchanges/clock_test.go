@@ -0,0 +1,107 @@
+package exchanges
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+const serverSkew = 5 * time.Second
+
+// skewedBybitServer — Bybit, чьи часы спешат на serverSkew. Подписанные запросы с
+// timestamp, отстающим больше чем на секунду, он отклоняет с retCode 10002.
+func skewedBybitServer(t *testing.T, timeCalls, calls *int) *httptest.Server {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serverNow := time.Now().Add(serverSkew)
+		if r.URL.Path == "/v5/market/time" {
+			*timeCalls++
+			fmt.Fprintf(w, `{"retCode":0,"retMsg":"OK","result":{"timeNano":"%d"}}`, serverNow.UnixNano())
+			return
+		}
+		*calls++
+		ts, _ := strconv.ParseInt(r.Header.Get("X-BAPI-TIMESTAMP"), 10, 64)
+		if d := serverNow.Sub(time.UnixMilli(ts)); d > time.Second || d < -time.Second {
+			fmt.Fprint(w, `{"retCode":10002,"retMsg":"invalid request, please check your server timestamp or recv_window param"}`)
+			return
+		}
+		fmt.Fprint(w, `{"retCode":0,"retMsg":"OK","result":{"list":[]}}`)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestBybitSyncClockOffset(t *testing.T) {
+	var timeCalls, calls int
+	server := skewedBybitServer(t, &timeCalls, &calls)
+	client := NewBybitClientWithURL(t.Name(), "secret", server.URL)
+
+	if err := client.syncClock(context.Background()); err != nil {
+		t.Fatalf("syncClock: %v", err)
+	}
+	clock := bybitClock(server.URL)
+	clock.mu.Lock()
+	offset := clock.offset
+	clock.mu.Unlock()
+	if d := offset - serverSkew; d > 200*time.Millisecond || d < -200*time.Millisecond {
+		t.Errorf("смещение %v, ожидалось около %v", offset, serverSkew)
+	}
+	if clock.stale() {
+		t.Error("часы помечены устаревшими сразу после синхронизации")
+	}
+
+	ts, err := strconv.ParseInt(client.timestamp(context.Background()), 10, 64)
+	if err != nil {
+		t.Fatalf("timestamp: %v", err)
+	}
+	if d := time.UnixMilli(ts).Sub(time.Now().Add(serverSkew)); d > 200*time.Millisecond || d < -200*time.Millisecond {
+		t.Errorf("timestamp расходится с часами сервера на %v", d)
+	}
+	if timeCalls != 1 {
+		t.Errorf("запросов времени = %d, свежие часы не должны синхронизироваться повторно", timeCalls)
+	}
+}
+
+func TestBybitResyncOnTimestampError(t *testing.T) {
+	var timeCalls, calls int
+	server := skewedBybitServer(t, &timeCalls, &calls)
+	client := NewBybitClientWithURL(t.Name(), "secret", server.URL)
+	// часы считаются свежими, но смещение устарело: первая подпись получит 10002
+	bybitClock(server.URL).set(0)
+
+	if _, err := client.GetSpotBalance(context.Background()); err != nil {
+		t.Fatalf("GetSpotBalance: %v", err)
+	}
+	if timeCalls != 1 {
+		t.Errorf("запросов времени = %d, ожидалась одна синхронизация после 10002", timeCalls)
+	}
+	if calls != 2 {
+		t.Errorf("запросов баланса = %d, ожидалось 2: отклоненный и повтор", calls)
+	}
+}
+
+func TestBybitTimestampErrorResyncsOnce(t *testing.T) {
+	var calls int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v5/market/time" {
+			fmt.Fprintf(w, `{"retCode":0,"retMsg":"OK","result":{"timeNano":"%d"}}`, time.Now().UnixNano())
+			return
+		}
+		calls++
+		fmt.Fprint(w, `{"retCode":10002,"retMsg":"invalid request"}`)
+	}))
+	defer server.Close()
+	client := NewBybitClientWithURL(t.Name(), "secret", server.URL)
+
+	_, err := client.GetSpotBalance(context.Background())
+	if err == nil {
+		t.Fatal("ошибка 10002 после синхронизации не возвращена")
+	}
+	if calls != 2 {
+		t.Errorf("запросов = %d, после синхронизации повтор должен быть один", calls)
+	}
+}
@@ -0,0 +1,104 @@
+package exchanges
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// Категории ошибок бирж. Проверяются через errors.Is, по ним handlers подбирают
+// подсказку пользователю.
+var (
+	ErrInvalidKey       = errors.New("неверный API-ключ, секрет или подпись")
+	ErrIPNotAllowed     = errors.New("IP сервера не входит в белый список ключа")
+	ErrPermissionDenied = errors.New("у API-ключа нет нужных прав")
+	ErrRateLimited      = errors.New("превышен лимит запросов к бирже")
+	ErrMaintenance      = errors.New("биржа временно недоступна")
+	ErrTimestamp        = errors.New("время запроса не совпадает со временем биржи")
+)
+
+// APIError — ошибка, которую вернула биржа: HTTP статус и код ошибки из тела ответа.
+// Kind — одна из категорий выше или nil, если код нам не знаком.
+type APIError struct {
+	Exchange   string
+	HTTPStatus int
+	Code       string
+	Message    string
+	Kind       error
+}
+
+func (e *APIError) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("API вернул статус %d", e.HTTPStatus)
+	}
+	return fmt.Sprintf("API ошибка: %s (код %s)", e.Message, e.Code)
+}
+
+func (e *APIError) Unwrap() error {
+	return e.Kind
+}
+
+func newBybitError(status, retCode int, message string) *APIError {
+	err := &APIError{Exchange: ExchangeBybit, HTTPStatus: status, Message: message}
+	if retCode != 0 {
+		err.Code = strconv.Itoa(retCode)
+	}
+
+	switch {
+	case retCode == 10003 || retCode == 10004 || retCode == 33004 || status == 401:
+		err.Kind = ErrInvalidKey
+	case retCode == 10010:
+		err.Kind = ErrIPNotAllowed
+	case retCode == 10005:
+		err.Kind = ErrPermissionDenied
+	case retCode == bybitRateLimitCode || retCode == 10018 || status == 403 || status == 429:
+		// 403 у Bybit — бан IP за превышение лимита
+		err.Kind = ErrRateLimited
+	case retCode == bybitTimestampCode:
+		err.Kind = ErrTimestamp
+	case retCode == 10016 || status >= 500:
+		err.Kind = ErrMaintenance
+	}
+	return err
+}
+
+func newBinanceError(status, code int, message string) *APIError {
+	err := &APIError{Exchange: ExchangeBinance, HTTPStatus: status, Message: message}
+	if code != 0 {
+		err.Code = strconv.Itoa(code)
+	}
+
+	switch {
+	// -2015 Binance возвращает и для неверного ключа, и для IP, и для прав —
+	// различить их нельзя, считаем ключ неверным
+	case code == -2014 || code == -2015 || code == -1022 || code == -1002 || status == 401:
+		err.Kind = ErrInvalidKey
+	case code == -1003 || status == 418 || status == 429:
+		err.Kind = ErrRateLimited
+	case code == -1021:
+		err.Kind = ErrTimestamp
+	case code == -1001 || code == -1016 || status >= 500:
+		err.Kind = ErrMaintenance
+	}
+	return err
+}
+
+func newOKXError(status int, code, message string) *APIError {
+	err := &APIError{Exchange: ExchangeOKX, HTTPStatus: status, Code: code, Message: message}
+
+	switch {
+	case code == "50111" || code == "50113" || code == "50105" || code == "50119" || status == 401:
+		err.Kind = ErrInvalidKey
+	case code == "50110":
+		err.Kind = ErrIPNotAllowed
+	case code == "50030" || code == "50120":
+		err.Kind = ErrPermissionDenied
+	case code == "50011" || code == "50061" || status == 429:
+		err.Kind = ErrRateLimited
+	case code == "50102" || code == "50112":
+		err.Kind = ErrTimestamp
+	case code == "50001" || code == "50013" || status >= 500:
+		err.Kind = ErrMaintenance
+	}
+	return err
+}
@@ -0,0 +1,167 @@
+package exchanges
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Exchange — общий контракт биржи. handlers, storage и spotpnl работают только
+// через него, поэтому новая биржа подключается реализацией этого интерфейса.
+type Exchange interface {
+	// Name возвращает короткое имя биржи: "bybit", "binance" и т.д.
+	Name() string
+	// GetSpotBalance возвращает количество монет на споте, ключ "TOTAL" — общая стоимость в USD
+	GetSpotBalance(ctx context.Context) (map[string]string, error)
+	GetMarketTickers(ctx context.Context, category string) (map[string]TickerInfo, error)
+	GetAllMarketPrices(ctx context.Context) (map[string]float64, error)
+	GetTicker(ctx context.Context, symbol string) (TickerInfo, error)
+	// GetExecutions возвращает сделки по символу за период [startTime, endTime] (мс)
+	GetExecutions(ctx context.Context, symbol string, startTime, endTime int64) ([]Execution, error)
+	// GetExecutionsSince возвращает все спотовые сделки начиная с startTime (мс).
+	// Если загрузку прервали, может вернуть часть сделок вместе с *PartialSyncError.
+	GetExecutionsSince(ctx context.Context, startTime int64) ([]Execution, error)
+	GetInstrumentsInfo(ctx context.Context) (map[string]InstrumentInfo, error)
+	// GetKeyInfo проверяет ключ и возвращает его права и ограничения
+	GetKeyInfo(ctx context.Context) (KeyInfo, error)
+	// QueueWait — сколько запрос с этими ключами простоит в очереди планировщика
+	QueueWait() time.Duration
+}
+
+// Execution — одно исполнение (fill). Поля и JSON-теги повторяют /v5/execution/list
+// Bybit, остальные биржи приводятся к ним. ExecFee — уплаченная комиссия (положительная)
+// в валюте FeeCurrency, ExecValue — стоимость сделки в котируемой валюте.
+type Execution struct {
+	Symbol      string `json:"symbol"`
+	Price       string `json:"execPrice"`
+	Quantity    string `json:"execQty"`
+	Side        string `json:"side"`
+	ExecID      string `json:"execId"`
+	OrderID     string `json:"orderId"`
+	ExecTime    string `json:"execTime"`
+	ExecFee     string `json:"execFee"`
+	FeeCurrency string `json:"feeCurrency"`
+	ExecValue   string `json:"execValue"`
+	IsMaker     bool   `json:"isMaker"`
+}
+
+// ExecTimeMs — время исполнения в миллисекундах, 0 если неизвестно
+func (e Execution) ExecTimeMs() int64 {
+	t, _ := strconv.ParseInt(e.ExecTime, 10, 64)
+	return t
+}
+
+// PartialSyncError — синхронизация истории прервана (отмена, таймаут, ошибка API),
+// но сделки до SyncedUntil (мс) загружены полностью и их можно сохранить
+type PartialSyncError struct {
+	SyncedUntil int64
+	Err         error
+}
+
+func (e *PartialSyncError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PartialSyncError) Unwrap() error {
+	return e.Err
+}
+
+// HistoryLimitError — биржа хранит историю короче запрошенной: сделки до Since (мс)
+// недоступны. Возвращается вместе со сделками после Since, они загружены полностью.
+type HistoryLimitError struct {
+	Exchange string
+	Since    int64
+}
+
+func (e *HistoryLimitError) Error() string {
+	return fmt.Sprintf("%s отдает историю сделок только с %s",
+		DisplayName(e.Exchange), time.UnixMilli(e.Since).Format("02.01.2006"))
+}
+
+// KeyInfo — права и ограничения API-ключа
+type KeyInfo struct {
+	ReadOnly    bool
+	CanTrade    bool
+	CanWithdraw bool
+	// IPRestricted — ключ работает только с разрешенных адресов; IPs — их список, если биржа его отдает
+	IPRestricted bool
+	IPs          []string
+	// ExpiresAt — когда ключ перестанет работать; нулевое значение — бессрочный
+	ExpiresAt time.Time
+	// UID — идентификатор аккаунта на бирже, IsMaster — ключ мастер-аккаунта (видит субаккаунты)
+	UID      string
+	IsMaster bool
+}
+
+type InstrumentInfo struct {
+	Symbol    string `json:"symbol"`
+	BaseCoin  string `json:"baseCoin"`
+	QuoteCoin string `json:"quoteCoin"`
+	Status    string `json:"status"`
+}
+
+const (
+	ExchangeBybit   = "bybit"
+	ExchangeBinance = "binance"
+	ExchangeOKX     = "okx"
+)
+
+// SupportedExchanges — биржи, которые пользователь может выбрать при вводе ключей
+var SupportedExchanges = []string{ExchangeBybit, ExchangeBinance, ExchangeOKX}
+
+// Credentials — ключи пользователя для конкретной биржи
+type Credentials struct {
+	Exchange  string
+	ApiKey    string
+	ApiSecret string
+	// Passphrase нужен только OKX
+	Passphrase string
+}
+
+// NewExchange создает клиент нужной биржи. Пустое имя — Bybit, как у старых пользователей.
+func NewExchange(creds Credentials) (Exchange, error) {
+	switch creds.Exchange {
+	case "", ExchangeBybit:
+		return NewBybitClient(creds.ApiKey, creds.ApiSecret), nil
+	case ExchangeBinance:
+		return NewBinanceClient(creds.ApiKey, creds.ApiSecret), nil
+	case ExchangeOKX:
+		return NewOKXClient(creds.ApiKey, creds.ApiSecret, creds.Passphrase), nil
+	default:
+		return nil, fmt.Errorf("неизвестная биржа: %s", creds.Exchange)
+	}
+}
+
+// DisplayName возвращает название биржи для сообщений пользователю
+func DisplayName(exchange string) string {
+	switch exchange {
+	case ExchangeBinance:
+		return "Binance"
+	case ExchangeOKX:
+		return "OKX"
+	default:
+		return "Bybit"
+	}
+}
+
+// hasBalance сообщает, что на балансе есть монета. Порог по количеству отбросил бы
+// дорогие монеты (0.005 BTC), поэтому Binance и OKX убирают из баланса только нули.
+func hasBalance(quantity string) bool {
+	value, err := strconv.ParseFloat(quantity, 64)
+	return err == nil && value > 0
+}
+
+// RequiresPassphrase сообщает, нужен ли бирже passphrase помимо ключа и секрета
+func RequiresPassphrase(exchange string) bool {
+	return exchange == ExchangeOKX
+}
+
+// KnownTradesSetter реализуют биржи, у которых история сделок запрашивается по каждой
+// паре отдельно (Binance). Перед синхронизацией им передаются пары с сохраненными
+// сделками и последний id сделки в каждой: так не теряются монеты, которых уже нет
+// на балансе, и история не загружается заново с первой сделки. lastIDs == nil — пары
+// листаются с первой сделки.
+type KnownTradesSetter interface {
+	SetKnownTrades(symbols []string, lastIDs map[string]int64)
+}
@@ -0,0 +1,471 @@
+package exchanges
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	OKXBaseURL     = "https://www.okx.com"
+	okxFillsLimit  = 100
+	okxTimeLayout  = "2006-01-02T15:04:05.000Z"
+	okxSuccessCode = "0"
+	// okxFillsHistoryWindow — сколько хранит fills-history; более старые сделки OKX
+	// отдает только архивом CSV по отдельной заявке
+	okxFillsHistoryWindow = 90 * 24 * time.Hour
+)
+
+type OKXClient struct {
+	ApiKey     string
+	ApiSecret  string
+	Passphrase string
+	// BaseURL можно подменить на локальный сервер в тестах
+	BaseURL string
+}
+
+var _ Exchange = (*OKXClient)(nil)
+
+func NewOKXClient(apiKey, apiSecret, passphrase string) *OKXClient {
+	baseURL := os.Getenv("OKX_BASE_URL")
+	if baseURL == "" {
+		baseURL = OKXBaseURL
+	}
+	return &OKXClient{
+		ApiKey:     apiKey,
+		ApiSecret:  apiSecret,
+		Passphrase: passphrase,
+		BaseURL:    baseURL,
+	}
+}
+
+func (c *OKXClient) Name() string {
+	return ExchangeOKX
+}
+
+func (c *OKXClient) QueueWait() time.Duration {
+	return okxScheduler.QueueWait(c.ApiKey)
+}
+
+type okxResponse struct {
+	Code string          `json:"code"`
+	Msg  string          `json:"msg"`
+	Data json.RawMessage `json:"data"`
+}
+
+type okxBalance struct {
+	TotalEq string `json:"totalEq"`
+	Details []struct {
+		Ccy string `json:"ccy"`
+		Eq  string `json:"eq"`
+	} `json:"details"`
+}
+
+type okxTicker struct {
+	InstID string `json:"instId"`
+	Last   string `json:"last"`
+}
+
+type okxInstrument struct {
+	InstID   string `json:"instId"`
+	BaseCcy  string `json:"baseCcy"`
+	QuoteCcy string `json:"quoteCcy"`
+	State    string `json:"state"`
+}
+
+type okxFill struct {
+	InstID   string `json:"instId"`
+	TradeID  string `json:"tradeId"`
+	OrdID    string `json:"ordId"`
+	BillID   string `json:"billId"`
+	Side     string `json:"side"`
+	FillPx   string `json:"fillPx"`
+	FillSz   string `json:"fillSz"`
+	Fee      string `json:"fee"`
+	FeeCcy   string `json:"feeCcy"`
+	ExecType string `json:"execType"`
+	Ts       string `json:"ts"`
+}
+
+// GenerateSignature — base64(HMAC-SHA256(timestamp + method + requestPath + body))
+func (c *OKXClient) GenerateSignature(timestamp, method, requestPath, body string) string {
+	h := hmac.New(sha256.New, []byte(c.ApiSecret))
+	h.Write([]byte(timestamp + method + requestPath + body))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// get выполняет GET-запрос к OKX с retry и возвращает поле data ответа
+func (c *OKXClient) get(ctx context.Context, path string, params url.Values, signed bool) (json.RawMessage, error) {
+	// публичные запросы расходуют только общий бюджет IP
+	schedulerKey := ""
+	if signed {
+		schedulerKey = c.ApiKey
+	}
+
+	var body []byte
+	maxAttempts := 3
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		if _, err := okxScheduler.Wait(ctx, schedulerKey); err != nil {
+			return nil, err
+		}
+
+		// подпись с меткой времени — на каждую попытку: после ожидания очереди и пауз
+		// прежняя метка могла устареть
+		req, err := c.newRequest(ctx, path, params, signed)
+		if err != nil {
+			return nil, err
+		}
+		resp, reqErr := httpClient.Do(req)
+		if reqErr != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if attempt < maxAttempts {
+				log.Printf("[OKX] Попытка %d/%d: ошибка запроса %s: %v", attempt, maxAttempts, path, reqErr)
+				if err := sleepCtx(ctx, backoffDelay(attempt)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return nil, fmt.Errorf("ошибка выполнения запроса: %w", reqErr)
+		}
+
+		body, reqErr = io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if reqErr != nil {
+			return nil, fmt.Errorf("ошибка чтения ответа: %w", reqErr)
+		}
+
+		if resp.StatusCode != 200 {
+			log.Printf("[OKX] Неверный HTTP статус %d при запросе %s. Body: %s", resp.StatusCode, path, string(body))
+			var errResp okxResponse
+			json.Unmarshal(body, &errResp)
+			apiErr := newOKXError(resp.StatusCode, errResp.Code, errResp.Msg)
+			if resp.StatusCode == 401 {
+				return nil, apiErr
+			}
+			if attempt < maxAttempts {
+				if err := sleepCtx(ctx, backoffDelay(attempt)); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			return nil, apiErr
+		}
+		break
+	}
+
+	var responseData okxResponse
+	if err := json.Unmarshal(body, &responseData); err != nil {
+		log.Printf("[OKX] Ошибка парсинга JSON %s: %v. Body: %s", path, err, string(body))
+		return nil, fmt.Errorf("неверный формат ответа API")
+	}
+	if responseData.Code != okxSuccessCode {
+		return nil, newOKXError(200, responseData.Code, responseData.Msg)
+	}
+	return responseData.Data, nil
+}
+
+func (c *OKXClient) newRequest(ctx context.Context, path string, params url.Values, signed bool) (*http.Request, error) {
+	requestPath := path
+	if len(params) > 0 {
+		requestPath += "?" + params.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.BaseURL+requestPath, nil)
+	if err != nil {
+		return nil, fmt.Errorf("ошибка создания запроса: %v", err)
+	}
+	if signed {
+		timestamp := time.Now().UTC().Format(okxTimeLayout)
+		req.Header.Set("OK-ACCESS-KEY", c.ApiKey)
+		req.Header.Set("OK-ACCESS-SIGN", c.GenerateSignature(timestamp, "GET", requestPath, ""))
+		req.Header.Set("OK-ACCESS-TIMESTAMP", timestamp)
+		req.Header.Set("OK-ACCESS-PASSPHRASE", c.Passphrase)
+	}
+	return req, nil
+}
+
+// okxSymbol приводит instId OKX ("BTC-USDT") к формату остальных бирж ("BTCUSDT")
+func okxSymbol(instID string) string {
+	return strings.ReplaceAll(instID, "-", "")
+}
+
+// okxInstID восстанавливает instId по символу, подбирая котировку по суффиксу
+func okxInstID(symbol string) string {
+	if strings.Contains(symbol, "-") {
+		return symbol
+	}
+	if base, quote, ok := SplitSymbol(symbol); ok {
+		return base + "-" + quote
+	}
+	return symbol
+}
+
+func (c *OKXClient) GetSpotBalance(ctx context.Context) (map[string]string, error) {
+	data, err := c.get(ctx, "/api/v5/account/balance", nil, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []okxBalance
+	if err := json.Unmarshal(data, &accounts); err != nil {
+		log.Printf("[OKX] Ошибка парсинга баланса: %v", err)
+		return nil, fmt.Errorf("неверный формат ответа API при получении баланса")
+	}
+
+	balances := make(map[string]string)
+	if len(accounts) == 0 {
+		return balances, nil
+	}
+
+	balances["TOTAL"] = accounts[0].TotalEq
+	for _, d := range accounts[0].Details {
+		if hasBalance(d.Eq) {
+			balances[d.Ccy] = d.Eq
+		}
+	}
+	return balances, nil
+}
+
+func (c *OKXClient) getTickers(ctx context.Context) ([]okxTicker, error) {
+	params := url.Values{}
+	params.Set("instType", "SPOT")
+	data, err := c.get(ctx, "/api/v5/market/tickers", params, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var tickers []okxTicker
+	if err := json.Unmarshal(data, &tickers); err != nil {
+		log.Printf("[OKX] Ошибка парсинга тикеров: %v", err)
+		return nil, fmt.Errorf("неверный формат ответа API при получении тикеров")
+	}
+	return tickers, nil
+}
+
+func (c *OKXClient) GetMarketTickers(ctx context.Context, category string) (map[string]TickerInfo, error) {
+	tickers, err := c.getTickers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tickersMap := make(map[string]TickerInfo)
+	for _, t := range tickers {
+		symbol := okxSymbol(t.InstID)
+		tickersMap[symbol] = TickerInfo{Symbol: symbol, LastPrice: t.Last}
+	}
+	return tickersMap, nil
+}
+
+func (c *OKXClient) GetAllMarketPrices(ctx context.Context) (map[string]float64, error) {
+	tickers, err := c.getTickers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pricesMap := make(map[string]float64)
+	for _, t := range tickers {
+		price, err := strconv.ParseFloat(t.Last, 64)
+		if err == nil {
+			pricesMap[okxSymbol(t.InstID)] = price
+		}
+	}
+	return pricesMap, nil
+}
+
+func (c *OKXClient) GetTicker(ctx context.Context, symbol string) (TickerInfo, error) {
+	params := url.Values{}
+	params.Set("instId", okxInstID(symbol))
+	data, err := c.get(ctx, "/api/v5/market/ticker", params, false)
+	if err != nil {
+		return TickerInfo{}, err
+	}
+
+	var tickers []okxTicker
+	if err := json.Unmarshal(data, &tickers); err != nil {
+		return TickerInfo{}, fmt.Errorf("неверный формат ответа API при получении цены")
+	}
+	if len(tickers) == 0 {
+		return TickerInfo{}, fmt.Errorf("цена для %s не найдена", symbol)
+	}
+	return TickerInfo{Symbol: okxSymbol(tickers[0].InstID), LastPrice: tickers[0].Last}, nil
+}
+
+func (c *OKXClient) GetInstrumentsInfo(ctx context.Context) (map[string]InstrumentInfo, error) {
+	params := url.Values{}
+	params.Set("instType", "SPOT")
+	data, err := c.get(ctx, "/api/v5/public/instruments", params, false)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []okxInstrument
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("неверный формат ответа API при получении инструментов")
+	}
+
+	instruments := make(map[string]InstrumentInfo)
+	for _, inst := range list {
+		symbol := okxSymbol(inst.InstID)
+		instruments[symbol] = InstrumentInfo{
+			Symbol:    symbol,
+			BaseCoin:  inst.BaseCcy,
+			QuoteCoin: inst.QuoteCcy,
+			Status:    inst.State,
+		}
+	}
+	return instruments, nil
+}
+
+func okxFillToExecution(f okxFill) Execution {
+	side := "Sell"
+	if f.Side == "buy" {
+		side = "Buy"
+	}
+	// OKX отдает списанную комиссию отрицательной, а ребейт — положительным
+	fee := f.Fee
+	if value, err := strconv.ParseFloat(f.Fee, 64); err == nil {
+		fee = strconv.FormatFloat(-value, 'f', -1, 64)
+	}
+	execValue := ""
+	price, priceErr := strconv.ParseFloat(f.FillPx, 64)
+	qty, qtyErr := strconv.ParseFloat(f.FillSz, 64)
+	if priceErr == nil && qtyErr == nil {
+		execValue = strconv.FormatFloat(price*qty, 'f', -1, 64)
+	}
+	return Execution{
+		Symbol:      okxSymbol(f.InstID),
+		Price:       f.FillPx,
+		Quantity:    f.FillSz,
+		Side:        side,
+		ExecID:      f.TradeID,
+		OrderID:     f.OrdID,
+		ExecTime:    f.Ts,
+		ExecFee:     fee,
+		FeeCurrency: f.FeeCcy,
+		ExecValue:   execValue,
+		IsMaker:     f.ExecType == "M",
+	}
+}
+
+// getFills листает fills-history от новых сделок к старым через параметр after.
+// OKX хранит в этом эндпоинте только последние 3 месяца.
+func (c *OKXClient) getFills(ctx context.Context, instID string, startTime, endTime int64) ([]Execution, error) {
+	var executions []Execution
+	after := ""
+
+	for {
+		params := url.Values{}
+		params.Set("instType", "SPOT")
+		params.Set("limit", strconv.Itoa(okxFillsLimit))
+		if instID != "" {
+			params.Set("instId", instID)
+		}
+		if startTime > 0 {
+			params.Set("begin", strconv.FormatInt(startTime, 10))
+		}
+		if endTime > 0 {
+			params.Set("end", strconv.FormatInt(endTime, 10))
+		}
+		if after != "" {
+			params.Set("after", after)
+		}
+
+		data, err := c.get(ctx, "/api/v5/trade/fills-history", params, true)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка истории сделок: %w", err)
+		}
+
+		var fills []okxFill
+		if err := json.Unmarshal(data, &fills); err != nil {
+			log.Printf("[OKX] Ошибка парсинга истории: %v", err)
+			return nil, fmt.Errorf("неверный формат ответа API при получении истории")
+		}
+
+		for _, f := range fills {
+			executions = append(executions, okxFillToExecution(f))
+		}
+
+		if len(fills) < okxFillsLimit {
+			break
+		}
+		after = fills[len(fills)-1].BillID
+		if err := sleepCtx(ctx, 100*time.Millisecond); err != nil {
+			return nil, err
+		}
+	}
+
+	return executions, nil
+}
+
+func (c *OKXClient) GetExecutions(ctx context.Context, symbol string, startTime, endTime int64) ([]Execution, error) {
+	instID := ""
+	if symbol != "" {
+		instID = okxInstID(symbol)
+	}
+	return c.getFills(ctx, instID, startTime, endTime)
+}
+
+// GetExecutionsSince загружает сделки с startTime. Старше 3 месяцев fills-history
+// не хранит: тогда отдает доступную часть вместе с *HistoryLimitError.
+func (c *OKXClient) GetExecutionsSince(ctx context.Context, startTime int64) ([]Execution, error) {
+	since := time.Now().Add(-okxFillsHistoryWindow).UnixMilli()
+	if startTime >= since {
+		return c.getFills(ctx, "", startTime, 0)
+	}
+	executions, err := c.getFills(ctx, "", since, 0)
+	if err != nil {
+		return nil, err
+	}
+	return executions, &HistoryLimitError{Exchange: c.Name(), Since: since}
+}
+
+type okxAccountConfig struct {
+	// Perm — права через запятую: read_only, trade, withdraw
+	Perm string `json:"perm"`
+	// IP — привязанные адреса через запятую, пусто — без привязки
+	IP string `json:"ip"`
+}
+
+func (c *OKXClient) GetKeyInfo(ctx context.Context) (KeyInfo, error) {
+	data, err := c.get(ctx, "/api/v5/account/config", nil, true)
+	if err != nil {
+		return KeyInfo{}, err
+	}
+
+	var configs []okxAccountConfig
+	if err := json.Unmarshal(data, &configs); err != nil || len(configs) == 0 {
+		log.Printf("[OKX] Ошибка парсинга информации о ключе: %v. Body: %s", err, string(data))
+		return KeyInfo{}, fmt.Errorf("неверный формат ответа API при проверке ключа")
+	}
+
+	var info KeyInfo
+	for _, perm := range strings.Split(configs[0].Perm, ",") {
+		switch strings.TrimSpace(perm) {
+		case "trade":
+			info.CanTrade = true
+		case "withdraw":
+			info.CanWithdraw = true
+		}
+	}
+	info.ReadOnly = !info.CanTrade && !info.CanWithdraw
+	for _, ip := range strings.Split(configs[0].IP, ",") {
+		if ip = strings.TrimSpace(ip); ip != "" {
+			info.IPs = append(info.IPs, ip)
+		}
+	}
+	info.IPRestricted = len(info.IPs) > 0
+	return info, nil
+}
@@ -0,0 +1,176 @@
+package exchanges
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// okxFillsStub отдает fillsCount сделок от новых к старым страницами по limit через after
+type okxFillsStub struct {
+	fillsCount int
+	afters     []string
+	begins     []string
+}
+
+func (s *okxFillsStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/api/v5/trade/fills-history" {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	s.afters = append(s.afters, query.Get("after"))
+	s.begins = append(s.begins, query.Get("begin"))
+
+	// billId совпадает с номером сделки, новые — с большими номерами
+	from := s.fillsCount
+	if after := query.Get("after"); after != "" {
+		from, _ = strconv.Atoi(after)
+		from--
+	}
+	limit, _ := strconv.Atoi(query.Get("limit"))
+
+	fills := []okxFill{}
+	for id := from; id >= 1 && len(fills) < limit; id-- {
+		fills = append(fills, okxFill{
+			InstID: "BTC-USDT", TradeID: strconv.Itoa(id), OrdID: "1", BillID: strconv.Itoa(id),
+			Side: "buy", FillPx: "100", FillSz: "0.5", Fee: "-0.05", FeeCcy: "USDT",
+			Ts: strconv.FormatInt(time.Now().UnixMilli(), 10),
+		})
+	}
+	data, _ := json.Marshal(fills)
+	fmt.Fprintf(w, `{"code":"0","msg":"","data":%s}`, data)
+}
+
+func TestOKXGetExecutionsSincePagesByAfter(t *testing.T) {
+	stub := &okxFillsStub{fillsCount: 250}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	client := &OKXClient{ApiKey: t.Name(), ApiSecret: "secret", Passphrase: "pass", BaseURL: server.URL}
+	startTime := time.Now().Add(-24 * time.Hour).UnixMilli()
+	trades, err := client.GetExecutionsSince(context.Background(), startTime)
+	if err != nil {
+		t.Fatalf("GetExecutionsSince: %v", err)
+	}
+	if len(trades) != 250 {
+		t.Fatalf("сделок = %d, ожидалось 250", len(trades))
+	}
+	if got := strings.Join(stub.afters, ","); got != ",151,51" {
+		t.Errorf("after по страницам = %q, ожидалось \",151,51\"", got)
+	}
+	if stub.begins[0] != strconv.FormatInt(startTime, 10) {
+		t.Errorf("begin = %s, ожидалось %d", stub.begins[0], startTime)
+	}
+
+	first := trades[0]
+	if first.Symbol != "BTCUSDT" || first.Side != "Buy" || first.ExecFee != "0.05" || first.ExecValue != "50" {
+		t.Errorf("первая сделка = %+v", first)
+	}
+}
+
+func TestOKXGetExecutionsSinceReportsHistoryLimit(t *testing.T) {
+	stub := &okxFillsStub{fillsCount: 3}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+
+	client := &OKXClient{ApiKey: t.Name(), ApiSecret: "secret", Passphrase: "pass", BaseURL: server.URL}
+	startTime := time.Now().AddDate(0, 0, -725).UnixMilli()
+	trades, err := client.GetExecutionsSince(context.Background(), startTime)
+
+	var limited *HistoryLimitError
+	if !errors.As(err, &limited) {
+		t.Fatalf("ошибка = %v, ожидалась HistoryLimitError", err)
+	}
+	if len(trades) != 3 {
+		t.Errorf("сделок = %d, ожидалось 3: доступная часть отдается вместе с ошибкой", len(trades))
+	}
+	// запрос начинается с границы хранения, а не с запрошенного startTime
+	if stub.begins[0] != strconv.FormatInt(limited.Since, 10) {
+		t.Errorf("begin = %s, граница = %d", stub.begins[0], limited.Since)
+	}
+	if age := time.Since(time.UnixMilli(limited.Since)); age < okxFillsHistoryWindow-time.Minute || age > okxFillsHistoryWindow+time.Minute {
+		t.Errorf("граница истории %v назад, ожидалось %v", age, okxFillsHistoryWindow)
+	}
+}
+
+func TestOKXErrorMapping(t *testing.T) {
+	tests := []struct {
+		name      string
+		status    int
+		body      string
+		wantKind  error
+		wantCalls int
+	}{
+		{"неверный ключ", http.StatusUnauthorized, `{"code":"50111","msg":"Invalid OK-ACCESS-KEY"}`, ErrInvalidKey, 1},
+		{"ключ в ответе 200", http.StatusOK, `{"code":"50113","msg":"Invalid Sign"}`, ErrInvalidKey, 1},
+		{"IP не в белом списке", http.StatusOK, `{"code":"50110","msg":"Your IP is not included"}`, ErrIPNotAllowed, 1},
+		{"нет прав", http.StatusOK, `{"code":"50120","msg":"API key doesn't have permission"}`, ErrPermissionDenied, 1},
+		{"timestamp", http.StatusOK, `{"code":"50102","msg":"Timestamp request expired"}`, ErrTimestamp, 1},
+		{"лимит запросов", http.StatusTooManyRequests, `{"code":"50011","msg":"Too Many Requests"}`, ErrRateLimited, 3},
+		{"биржа недоступна", http.StatusServiceUnavailable, ``, ErrMaintenance, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls int
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				calls++
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body))
+			}))
+			defer server.Close()
+
+			client := &OKXClient{ApiKey: t.Name(), ApiSecret: "secret", Passphrase: "pass", BaseURL: server.URL}
+			_, err := client.GetSpotBalance(context.Background())
+			if !errors.Is(err, tt.wantKind) {
+				t.Fatalf("ошибка = %v, ожидалась %v", err, tt.wantKind)
+			}
+			var apiErr *APIError
+			if !errors.As(err, &apiErr) || apiErr.Exchange != ExchangeOKX || apiErr.HTTPStatus != tt.status {
+				t.Errorf("APIError = %+v", apiErr)
+			}
+			if calls != tt.wantCalls {
+				t.Errorf("запросов = %d, ожидалось %d", calls, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestOKXRetrySignsEachAttempt(t *testing.T) {
+	client := &OKXClient{ApiKey: t.Name(), ApiSecret: "secret", Passphrase: "pass"}
+	var timestamps []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timestamp := r.Header.Get("OK-ACCESS-TIMESTAMP")
+		if r.Header.Get("OK-ACCESS-SIGN") != client.GenerateSignature(timestamp, "GET", r.URL.RequestURI(), "") {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":"50113","msg":"Invalid Sign"}`))
+			return
+		}
+		timestamps = append(timestamps, timestamp)
+		if len(timestamps) == 1 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.Write([]byte(`{"code":"0","msg":"","data":[{"totalEq":"10","details":[{"ccy":"BTC","eq":"0.0001"}]}]}`))
+	}))
+	defer server.Close()
+	client.BaseURL = server.URL
+
+	balances, err := client.GetSpotBalance(context.Background())
+	if err != nil {
+		t.Fatalf("GetSpotBalance: %v", err)
+	}
+	if balances["BTC"] != "0.0001" {
+		t.Errorf("малый баланс BTC потерян: %v", balances)
+	}
+	if len(timestamps) != 2 || timestamps[0] == timestamps[1] {
+		t.Errorf("timestamp попыток = %v, ожидались две разные подписи", timestamps)
+	}
+}
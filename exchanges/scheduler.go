@@ -0,0 +1,179 @@
+package exchanges
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Scheduler распределяет запросы к бирже во времени. У каждого API-ключа и у всего
+// процесса (все пользователи ходят с одного IP) свой бюджет запросов в секунду,
+// поэтому алерты, ежедневные уведомления и нажатия кнопок не выбивают лимиты друг другу.
+// Запросы сверх бюджета не отклоняются, а ждут своей очереди.
+type Scheduler struct {
+	mu        sync.Mutex
+	keyRate   float64
+	keyBurst  int
+	ip        *budget
+	keys      map[string]*budget
+	lastSweep time.Time
+}
+
+// как часто удалять бюджеты ключей, которые давно не использовались
+const schedulerSweepInterval = time.Minute
+
+// budget — бюджет запросов по алгоритму GCRA: tat — момент, когда бюджет полностью
+// восстановится, tolerance — сколько запросов можно сделать подряд без ожидания
+type budget struct {
+	interval  time.Duration
+	tolerance time.Duration
+	tat       time.Time
+}
+
+func newBudget(rate float64, burst int) *budget {
+	interval := time.Duration(float64(time.Second) / rate)
+	return &budget{
+		interval:  interval,
+		tolerance: interval * time.Duration(burst-1),
+	}
+}
+
+// earliest — ближайший момент, когда бюджет позволит сделать запрос
+func (b *budget) earliest(now time.Time) time.Time {
+	t := b.tat.Add(-b.tolerance)
+	if t.Before(now) {
+		return now
+	}
+	return t
+}
+
+// commit расходует бюджет на запрос в момент at и возвращает резерв для отмены
+func (b *budget) commit(at time.Time) reservation {
+	r := reservation{budget: b, prev: b.tat}
+	if b.tat.Before(at) {
+		b.tat = at
+	}
+	b.tat = b.tat.Add(b.interval)
+	r.tat = b.tat
+	return r
+}
+
+// reservation — место в очереди бюджета, занятое одним запросом
+type reservation struct {
+	budget *budget
+	prev   time.Time
+	tat    time.Time
+}
+
+// cancel возвращает место отмененного запроса. Если после него никто не резервировал,
+// бюджет восстанавливается точно, иначе освобождается один интервал.
+func (r reservation) cancel() {
+	if r.budget == nil {
+		return
+	}
+	if r.budget.tat.Equal(r.tat) {
+		r.budget.tat = r.prev
+		return
+	}
+	r.budget.tat = r.budget.tat.Add(-r.budget.interval)
+}
+
+// NewScheduler создает планировщик: keyRate/keyBurst — бюджет одного ключа,
+// ipRate/ipBurst — общий бюджет процесса
+func NewScheduler(keyRate float64, keyBurst int, ipRate float64, ipBurst int) *Scheduler {
+	return &Scheduler{
+		keyRate:  keyRate,
+		keyBurst: keyBurst,
+		ip:       newBudget(ipRate, ipBurst),
+		keys:     make(map[string]*budget),
+	}
+}
+
+// Лимиты взяты с запасом от документации бирж: Bybit — 600 запросов за 5 сек на IP,
+// 10-20 в секунду на UID; Binance — 6000 веса в минуту; OKX — 10-20 запросов за 2 сек.
+var (
+	bybitScheduler   = NewScheduler(5, 5, 50, 50)
+	binanceScheduler = NewScheduler(2, 5, 20, 20)
+	okxScheduler     = NewScheduler(4, 4, 20, 20)
+)
+
+// sweep удаляет бюджеты, восстановившиеся полностью: такой бюджет не отличается от
+// нового, а без удаления карта росла бы с каждым ключом, который видел процесс
+func (s *Scheduler) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < schedulerSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for apiKey, b := range s.keys {
+		if !b.tat.After(now) {
+			delete(s.keys, apiKey)
+		}
+	}
+}
+
+func (s *Scheduler) keyBudget(apiKey string) *budget {
+	if apiKey == "" {
+		return nil
+	}
+	b, ok := s.keys[apiKey]
+	if !ok {
+		b = newBudget(s.keyRate, s.keyBurst)
+		s.keys[apiKey] = b
+	}
+	return b
+}
+
+// Wait резервирует место в очереди ключа и IP и ждет его. Пустой apiKey — публичный
+// запрос, он расходует только бюджет IP. Возвращает время ожидания. Если контекст
+// отменен раньше, место возвращается в бюджет: отмененный запрос лимит не расходует.
+func (s *Scheduler) Wait(ctx context.Context, apiKey string) (time.Duration, error) {
+	s.mu.Lock()
+	now := time.Now()
+	s.sweep(now)
+	at := s.ip.earliest(now)
+	kb := s.keyBudget(apiKey)
+	var keyReservation reservation
+	if kb != nil {
+		if t := kb.earliest(now); t.After(at) {
+			at = t
+		}
+		keyReservation = kb.commit(at)
+	}
+	ipReservation := s.ip.commit(at)
+	s.mu.Unlock()
+
+	wait := at.Sub(now)
+	if err := sleepCtx(ctx, wait); err != nil {
+		s.mu.Lock()
+		keyReservation.cancel()
+		ipReservation.cancel()
+		s.mu.Unlock()
+		return wait, err
+	}
+	return wait, nil
+}
+
+// Block задерживает все запросы процесса до until: биржа сообщила, что лимит IP
+// исчерпан, и запросы до этого момента продлили бы блокировку
+func (s *Scheduler) Block(until time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if tat := until.Add(s.ip.tolerance); tat.After(s.ip.tat) {
+		s.ip.tat = tat
+	}
+}
+
+// QueueWait показывает, сколько придется ждать запросу с этим ключом прямо сейчас
+func (s *Scheduler) QueueWait(apiKey string) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	at := s.ip.earliest(now)
+	if kb, ok := s.keys[apiKey]; ok && apiKey != "" {
+		if t := kb.earliest(now); t.After(at) {
+			at = t
+		}
+	}
+	return at.Sub(now)
+}
@@ -0,0 +1,137 @@
+package exchanges
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func waitOrFail(t *testing.T, s *Scheduler, apiKey string) time.Duration {
+	t.Helper()
+	wait, err := s.Wait(context.Background(), apiKey)
+	if err != nil {
+		t.Fatalf("Wait(%q): %v", apiKey, err)
+	}
+	return wait
+}
+
+func TestSchedulerKeyBudget(t *testing.T) {
+	// 20 запросов в секунду на ключ (интервал 50 мс), 3 подряд без ожидания
+	s := NewScheduler(20, 3, 1000, 1000)
+
+	for i := 0; i < 3; i++ {
+		if wait := waitOrFail(t, s, "a"); wait != 0 {
+			t.Fatalf("запрос %d в пределах burst ждал %v", i+1, wait)
+		}
+	}
+	if wait := s.QueueWait("a"); wait <= 0 || wait > 50*time.Millisecond {
+		t.Errorf("QueueWait после burst = %v, ожидалось до 50 мс", wait)
+	}
+	if wait := waitOrFail(t, s, "a"); wait <= 0 || wait > 50*time.Millisecond {
+		t.Errorf("запрос сверх burst ждал %v, ожидалось до 50 мс", wait)
+	}
+	// бюджет другого ключа не тронут
+	if wait := waitOrFail(t, s, "b"); wait != 0 {
+		t.Errorf("другой ключ ждал %v", wait)
+	}
+	if wait := s.QueueWait("unknown"); wait != 0 {
+		t.Errorf("QueueWait нового ключа = %v", wait)
+	}
+}
+
+func TestSchedulerIPBudgetShared(t *testing.T) {
+	// у ключей большой бюджет, но общий бюджет IP — 2 запроса подряд
+	s := NewScheduler(1000, 1000, 20, 2)
+
+	waitOrFail(t, s, "a")
+	waitOrFail(t, s, "")
+	if wait := waitOrFail(t, s, "b"); wait <= 0 {
+		t.Errorf("запрос сверх бюджета IP не ждал")
+	}
+	if wait := s.QueueWait("c"); wait <= 0 {
+		t.Errorf("QueueWait не учитывает бюджет IP")
+	}
+}
+
+func TestSchedulerWaitCancelled(t *testing.T) {
+	s := NewScheduler(1, 1, 1000, 1000)
+	waitOrFail(t, s, "a")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if _, err := s.Wait(ctx, "a"); err == nil {
+		t.Fatal("Wait не прервался при отмене контекста")
+	}
+	if elapsed := time.Since(started); elapsed > 500*time.Millisecond {
+		t.Errorf("Wait ждал %v после отмены контекста", elapsed)
+	}
+}
+
+func TestSchedulerCancelledWaitReturnsBudget(t *testing.T) {
+	// и у ключа, и у IP один запрос в секунду без запаса
+	s := NewScheduler(1, 1, 1, 1)
+	waitOrFail(t, s, "a")
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		if _, err := s.Wait(ctx, "a"); err == nil {
+			t.Fatal("Wait не прервался при отмене контекста")
+		}
+		cancel()
+	}
+	// отмененные запросы очередь не удлинили: следующий ждет не дольше интервала
+	if wait := s.QueueWait("a"); wait > time.Second {
+		t.Errorf("QueueWait после отмен = %v, ожидалось не больше секунды", wait)
+	}
+	if wait := s.QueueWait(""); wait > time.Second {
+		t.Errorf("QueueWait по IP после отмен = %v, ожидалось не больше секунды", wait)
+	}
+}
+
+func TestReservationCancelAfterLaterReservation(t *testing.T) {
+	b := newBudget(1, 1)
+	now := time.Now()
+	first := b.commit(now)
+	b.commit(b.earliest(now))
+	// после отмены первого места второе остается, очередь короче на один интервал
+	first.cancel()
+	if got, want := b.tat, now.Add(time.Second); !got.Equal(want) {
+		t.Errorf("tat после отмены = %v, ожидалось %v", got.Sub(now), want.Sub(now))
+	}
+}
+
+func TestSchedulerEvictsIdleKeys(t *testing.T) {
+	// интервал ключа 30 секунд, 3 запроса подряд без ожидания
+	s := NewScheduler(1.0/30, 3, 1000, 1000)
+	waitOrFail(t, s, "idle")
+	for i := 0; i < 3; i++ {
+		waitOrFail(t, s, "busy")
+	}
+
+	s.mu.Lock()
+	start := s.lastSweep
+	// бюджет idle восстановится через 30 секунд, busy — через 90
+	s.sweep(start.Add(time.Minute))
+	_, idle := s.keys["idle"]
+	_, busy := s.keys["busy"]
+	// повторная проверка раньше интервала ничего не удаляет
+	s.sweep(start.Add(100 * time.Second))
+	_, busyAfter := s.keys["busy"]
+	s.sweep(start.Add(2 * time.Minute))
+	left := len(s.keys)
+	s.mu.Unlock()
+
+	if idle {
+		t.Error("восстановившийся бюджет не удален")
+	}
+	if !busy {
+		t.Error("бюджет с резервом удален: следующий запрос обошел бы лимит")
+	}
+	if !busyAfter {
+		t.Error("ключи удалялись чаще интервала")
+	}
+	if left != 0 {
+		t.Errorf("после простоя осталось ключей: %d", left)
+	}
+}
@@ -0,0 +1,35 @@
+package exchanges
+
+import (
+	"context"
+	"strings"
+)
+
+// QuoteCurrencies — котировки спотовых пар. По ним символ в формате Bybit ("ETHBTC")
+// делится на монету и котировку.
+var QuoteCurrencies = []string{"USDT", "USDC", "FDUSD", "DAI", "BTC", "ETH", "EUR", "TRY", "BRL"}
+
+// SplitSymbol делит символ на монету и котировку: "ETHBTC" → "ETH", "BTC".
+// ok = false, если котировка не из QuoteCurrencies.
+func SplitSymbol(symbol string) (base, quote string, ok bool) {
+	for _, q := range QuoteCurrencies {
+		if strings.HasSuffix(symbol, q) && len(symbol) > len(q) {
+			return strings.TrimSuffix(symbol, q), q, true
+		}
+	}
+	return symbol, "", false
+}
+
+// PricePoint — цена пары на момент времени (мс)
+type PricePoint struct {
+	Time  int64
+	Price float64
+}
+
+// DailyPriceProvider реализуют биржи, которые отдают дневные свечи спотовых пар.
+// По ним сделки в парах к другим котировкам пересчитываются по курсу на дату сделки.
+type DailyPriceProvider interface {
+	// GetDailyPrices возвращает цены закрытия дневных свечей пары за [startTime, endTime] (мс)
+	// по возрастанию времени
+	GetDailyPrices(ctx context.Context, symbol string, startTime, endTime int64) ([]PricePoint, error)
+}
@@ -0,0 +1,231 @@
+package exchanges
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	bybitMaxAttempts   = 4
+	bybitRecvWindow    = "20000"
+	bybitRateLimitCode = 10006
+
+	backoffBase = 500 * time.Millisecond
+	backoffMax  = 8 * time.Second
+	// дольше этого ждать сброса лимита не имеет смысла — пользователь ждет ответа
+	maxRateLimitWait = 30 * time.Second
+)
+
+var httpClient = &http.Client{Timeout: 10 * time.Second}
+
+// sleepCtx ждет d, но прерывается при отмене контекста
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// backoffDelay — экспоненциальная задержка перед попыткой attempt (с 1) с jitter,
+// чтобы одновременные запросы разных пользователей не повторялись синхронно
+func backoffDelay(attempt int) time.Duration {
+	delay := backoffBase << (attempt - 1)
+	if delay > backoffMax || delay <= 0 {
+		delay = backoffMax
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// rateLimiter помнит, до какого момента Bybit просит не обращаться к эндпоинту.
+// Лимиты Bybit считаются на UID и эндпоинт, поэтому ключ — apiKey + path.
+type rateLimiter struct {
+	mu      sync.Mutex
+	resetAt map[string]time.Time
+}
+
+var bybitLimits = &rateLimiter{resetAt: make(map[string]time.Time)}
+
+func (l *rateLimiter) wait(ctx context.Context, key string) error {
+	l.mu.Lock()
+	resetAt, ok := l.resetAt[key]
+	l.mu.Unlock()
+	if !ok {
+		return nil
+	}
+
+	wait := time.Until(resetAt)
+	if wait <= 0 {
+		return nil
+	}
+	if wait > maxRateLimitWait {
+		wait = maxRateLimitWait
+	}
+	log.Printf("[Bybit] Лимит запросов исчерпан, ждем %v до сброса", wait.Round(time.Millisecond))
+	return sleepCtx(ctx, wait)
+}
+
+func (l *rateLimiter) block(key string, until time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if until.After(l.resetAt[key]) {
+		l.resetAt[key] = until
+	}
+}
+
+// update читает X-Bapi-Limit-Status (сколько запросов осталось в окне)
+// и X-Bapi-Limit-Reset-Timestamp (мс, когда окно сбросится)
+func (l *rateLimiter) update(key string, header http.Header) {
+	resetAt, ok := limitResetTime(header)
+	if !ok {
+		return
+	}
+	if remaining, err := strconv.Atoi(header.Get("X-Bapi-Limit-Status")); err == nil && remaining <= 0 {
+		l.block(key, resetAt)
+	}
+}
+
+func limitResetTime(header http.Header) (time.Time, bool) {
+	resetMs, err := strconv.ParseInt(header.Get("X-Bapi-Limit-Reset-Timestamp"), 10, 64)
+	if err != nil || resetMs <= 0 {
+		return time.Time{}, false
+	}
+	return time.UnixMilli(resetMs), true
+}
+
+type bybitEnvelope struct {
+	RetCode int    `json:"retCode"`
+	RetMsg  string `json:"retMsg"`
+}
+
+// get — единый конвейер GET-запросов к Bybit: подпись, повторы с экспоненциальной
+// задержкой, учет лимитов из заголовков и retCode 10006. Возвращает тело ответа
+// с retCode 0, иначе ошибку.
+func (c *BybitClient) get(ctx context.Context, path string, params url.Values, signed bool) ([]byte, error) {
+	queryString := ""
+	if params != nil {
+		queryString = params.Encode()
+	}
+	fullURL := c.BaseURL + path
+	if queryString != "" {
+		fullURL += "?" + queryString
+	}
+	limitKey := c.ApiKey + path
+	// публичные запросы расходуют только общий бюджет IP
+	schedulerKey := ""
+	if signed {
+		schedulerKey = c.ApiKey
+	}
+
+	var lastErr error
+	clockResynced := false
+	for attempt := 1; attempt <= bybitMaxAttempts; attempt++ {
+		if attempt > 1 {
+			if err := sleepCtx(ctx, backoffDelay(attempt-1)); err != nil {
+				return nil, err
+			}
+		}
+		if err := bybitLimits.wait(ctx, limitKey); err != nil {
+			return nil, err
+		}
+		if _, err := bybitScheduler.Wait(ctx, schedulerKey); err != nil {
+			return nil, err
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "GET", fullURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка создания запроса: %v", err)
+		}
+		// подписываем на каждой попытке, чтобы timestamp не устарел
+		if signed {
+			timestamp := c.timestamp(ctx)
+			req.Header.Set("X-BAPI-API-KEY", c.ApiKey)
+			req.Header.Set("X-BAPI-TIMESTAMP", timestamp)
+			req.Header.Set("X-BAPI-RECV-WINDOW", bybitRecvWindow)
+			req.Header.Set("X-BAPI-SIGN", c.GenerateSignature(timestamp, bybitRecvWindow, queryString))
+		}
+
+		res, err := httpClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			lastErr = fmt.Errorf("ошибка выполнения запроса: %w", err)
+			log.Printf("[Bybit] Попытка %d/%d: %s: %v", attempt, bybitMaxAttempts, path, err)
+			continue
+		}
+
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			lastErr = fmt.Errorf("ошибка чтения ответа: %w", err)
+			continue
+		}
+		bybitLimits.update(limitKey, res.Header)
+
+		if res.StatusCode != 200 {
+			log.Printf("[Bybit] Попытка %d/%d: HTTP статус %d для %s. Body: %s", attempt, bybitMaxAttempts, res.StatusCode, path, string(body))
+			// 401 - вероятно проблема с ключами/whitelist, 403 - бан IP за превышение
+			// лимита: повторы не помогут, а бан только продлят
+			var envelope bybitEnvelope
+			json.Unmarshal(body, &envelope)
+			apiErr := newBybitError(res.StatusCode, envelope.RetCode, envelope.RetMsg)
+			if res.StatusCode == 401 || res.StatusCode == 403 {
+				return nil, apiErr
+			}
+			lastErr = apiErr
+			continue
+		}
+
+		var envelope bybitEnvelope
+		if err := json.Unmarshal(body, &envelope); err != nil {
+			// Логируем тело для диагностики, но не возвращаем его пользователю
+			log.Printf("[Bybit] Попытка %d/%d: ошибка парсинга JSON %s: %v. Body: %s", attempt, bybitMaxAttempts, path, err, string(body))
+			lastErr = fmt.Errorf("неверный формат ответа API")
+			continue
+		}
+
+		if envelope.RetCode == bybitRateLimitCode {
+			if resetAt, ok := limitResetTime(res.Header); ok {
+				bybitLimits.block(limitKey, resetAt)
+			}
+			log.Printf("[Bybit] Попытка %d/%d: превышен лимит запросов для %s", attempt, bybitMaxAttempts, path)
+			lastErr = newBybitError(res.StatusCode, envelope.RetCode, envelope.RetMsg)
+			continue
+		}
+		// часы разошлись с сервером: обновляем смещение и повторяем один раз
+		if envelope.RetCode == bybitTimestampCode && signed && !clockResynced {
+			clockResynced = true
+			log.Printf("[Bybit] Timestamp отклонен сервером (%s), синхронизирую время", envelope.RetMsg)
+			lastErr = newBybitError(res.StatusCode, envelope.RetCode, envelope.RetMsg)
+			if err := c.syncClock(ctx); err != nil {
+				return nil, lastErr
+			}
+			attempt--
+			continue
+		}
+		if envelope.RetCode != 0 {
+			return nil, newBybitError(res.StatusCode, envelope.RetCode, envelope.RetMsg)
+		}
+
+		return body, nil
+	}
+
+	return nil, lastErr
+}
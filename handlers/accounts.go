@@ -0,0 +1,226 @@
+package handlers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"telegram-date-bot/exchanges"
+	"telegram-date-bot/storage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// portfolioView — аккаунты, по которым пользователь сейчас смотрит портфель:
+// выбранный в настройках или все сразу
+type portfolioView struct {
+	accounts []storage.User
+	// accountID — id единственного аккаунта или storage.AllAccounts
+	accountID int64
+	// total — сколько всего аккаунтов у пользователя
+	total int
+}
+
+func getPortfolioView(chatID int64) (portfolioView, error) {
+	accounts, err := storage.GetAccounts(chatID)
+	if err != nil {
+		return portfolioView{}, fmt.Errorf("ошибка получения данных")
+	}
+	if len(accounts) == 0 {
+		return portfolioView{}, fmt.Errorf("ключи не установлены")
+	}
+
+	activeID, err := storage.GetActiveAccountID(chatID)
+	if err != nil {
+		return portfolioView{}, fmt.Errorf("ошибка получения данных")
+	}
+	if activeID == storage.AllAccounts && len(accounts) > 1 {
+		return portfolioView{accounts: accounts, accountID: storage.AllAccounts, total: len(accounts)}, nil
+	}
+	active := accounts[0]
+	for _, account := range accounts {
+		if account.AccountID == activeID {
+			active = account
+		}
+	}
+	return portfolioView{accounts: withSubAccounts(active, accounts), accountID: active.AccountID, total: len(accounts)}, nil
+}
+
+// withSubAccounts — аккаунт и, если у мастер-аккаунта включены субаккаунты,
+// привязанные к нему аккаунты с ключами субаккаунтов
+func withSubAccounts(account storage.User, accounts []storage.User) []storage.User {
+	result := []storage.User{account}
+	if !account.IncludeSubs {
+		return result
+	}
+	for _, sub := range accounts {
+		if sub.ParentID == account.AccountID {
+			result = append(result, sub)
+		}
+	}
+	return result
+}
+
+// accountIDs — id аккаунтов, сделки которых входят в отчет
+func (v portfolioView) accountIDs() []int64 {
+	ids := make([]int64, 0, len(v.accounts))
+	for _, account := range v.accounts {
+		ids = append(ids, account.AccountID)
+	}
+	return ids
+}
+
+// clients создает клиенты бирж для всех аккаунтов представления
+func (v portfolioView) clients() ([]exchanges.Exchange, error) {
+	clients := make([]exchanges.Exchange, 0, len(v.accounts))
+	for _, account := range v.accounts {
+		client, err := newExchangeClient(account)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	return clients, nil
+}
+
+// header — строка с названием аккаунта над отчетом; пока аккаунт один, не нужна
+func (v portfolioView) header() string {
+	if v.total <= 1 {
+		return ""
+	}
+	if v.accountID == storage.AllAccounts {
+		return fmt.Sprintf("👥 Все аккаунты (%d)\n\n", len(v.accounts))
+	}
+	if len(v.accounts) > 1 {
+		return fmt.Sprintf("👤 Аккаунт: %s + субаккаунты с ключами (%d)\n\n", accountLabel(v.accounts[0]), len(v.accounts)-1)
+	}
+	return fmt.Sprintf("👤 Аккаунт: %s\n\n", accountLabel(v.accounts[0]))
+}
+
+// accountPrefix — название аккаунта перед ошибкой, когда в отчете их несколько
+func (v portfolioView) accountPrefix(account storage.User) string {
+	if len(v.accounts) <= 1 {
+		return ""
+	}
+	return fmt.Sprintf("[%s] ", accountLabel(account))
+}
+
+// accountLabel — «Основной · Bybit»; если название совпадает с биржей, только название
+func accountLabel(account storage.User) string {
+	exchangeName := exchanges.DisplayName(account.Exchange)
+	if account.AccountName == exchangeName {
+		return account.AccountName
+	}
+	return account.AccountName + " · " + exchangeName
+}
+
+// queueNoticeAll — предупреждение об очереди по первому аккаунту, где она есть
+func queueNoticeAll(clients []exchanges.Exchange) string {
+	for _, client := range clients {
+		if notice := queueNotice(client); notice != "" {
+			return notice
+		}
+	}
+	return ""
+}
+
+// mergeBalances добавляет количества монет из add в total
+func mergeBalances(total, add map[string]string) {
+	for coin, quantityStr := range add {
+		quantity, _ := strconv.ParseFloat(quantityStr, 64)
+		current, _ := strconv.ParseFloat(total[coin], 64)
+		total[coin] = strconv.FormatFloat(current+quantity, 'f', -1, 64)
+	}
+}
+
+func createAccountsKeyboard(accounts []storage.User, activeID int64) tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	for i, account := range accounts {
+		text := accountLabel(account)
+		if account.AccountID == activeID || (i == 0 && activeID == 0) {
+			text = "✅ " + text
+		}
+		callbackData := fmt.Sprintf("select_account_%d", account.AccountID)
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(text, callbackData)))
+	}
+	for i, account := range accounts {
+		if account.AccountID == activeID || (i == 0 && activeID == 0) {
+			if row := subAccountsButton(account); row != nil {
+				rows = append(rows, row)
+			}
+		}
+	}
+	if len(accounts) > 1 {
+		text := "👥 Все аккаунты"
+		if activeID == storage.AllAccounts {
+			text = "✅ " + text
+		}
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(text, "select_account_all")))
+	}
+	rows = append(rows,
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("➕ Добавить аккаунт", "set_api_keys")),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("« Назад", "back_to_settings")),
+	)
+	return tgbotapi.NewInlineKeyboardMarkup(rows...)
+}
+
+// HandleAccounts показывает аккаунты пользователя и позволяет выбрать активный
+func HandleAccounts(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+	showAccounts(bot, update, "")
+}
+
+func showAccounts(bot *tgbotapi.BotAPI, update tgbotapi.Update, notice string) {
+	chatID := getChatID(update)
+
+	accounts, err := storage.GetAccounts(chatID)
+	if err != nil {
+		sendError(bot, chatID, "Ошибка получения аккаунтов")
+		return
+	}
+	activeID, _ := storage.GetActiveAccountID(chatID)
+
+	text := notice
+	if len(accounts) == 0 {
+		text += "👤 Аккаунтов пока нет. Добавьте ключи API, чтобы начать."
+	} else {
+		text += "👤 Выберите аккаунт, по которому показывать баланс и PnL, или все аккаунты сразу.\n\n" +
+			"Чтобы добавить еще один аккаунт той же биржи, при вводе ключей допишите через пробел его название."
+	}
+	editMenuMessage(bot, update, text, createAccountsKeyboard(accounts, activeID))
+}
+
+// HandleSelectAccount делает аккаунт активным; arg — id аккаунта или "all"
+func HandleSelectAccount(bot *tgbotapi.BotAPI, update tgbotapi.Update, arg string) {
+	chatID := getChatID(update)
+
+	accountID := storage.AllAccounts
+	if arg != "all" {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			sendError(bot, chatID, "Неверный аккаунт")
+			return
+		}
+		accountID = id
+	}
+
+	if err := storage.SetActiveAccount(chatID, accountID); err != nil {
+		sendError(bot, chatID, fmt.Sprintf("Не удалось выбрать аккаунт: %v", err))
+		return
+	}
+
+	notice := "✅ Показываю все аккаунты вместе.\n\n"
+	if accountID != storage.AllAccounts {
+		view, err := getPortfolioView(chatID)
+		if err == nil {
+			notice = fmt.Sprintf("✅ Активный аккаунт: %s\n\n", accountLabel(view.accounts[0]))
+		}
+	}
+	showAccounts(bot, update, notice)
+}
+
+// accountNameFromInput — название аккаунта из сообщения с ключами, по умолчанию название биржи
+func accountNameFromInput(exchange string, extra []string) string {
+	if name := storage.CleanAccountName(strings.Join(extra, " ")); name != "" {
+		return name
+	}
+	return exchanges.DisplayName(exchange)
+}
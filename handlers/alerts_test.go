@@ -0,0 +1,259 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"telegram-date-bot/storage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/gorilla/websocket"
+)
+
+// wsStub — публичный поток Bybit: пересылает в ops операции клиента (кроме ping)
+// и отправляет клиенту сообщения из ticks
+type wsStub struct {
+	ops   chan string
+	ticks chan string
+}
+
+func (s *wsStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			var req struct {
+				Op   string   `json:"op"`
+				Args []string `json:"args"`
+			}
+			if err := conn.ReadJSON(&req); err != nil {
+				return
+			}
+			if req.Op != "ping" {
+				s.ops <- req.Op + " " + strings.Join(req.Args, ",")
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case tick := <-s.ticks:
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(tick)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func tickerMessage(symbol string, price float64) string {
+	return fmt.Sprintf(`{"topic":"tickers.%s","type":"snapshot","data":{"symbol":"%s","lastPrice":"%g"}}`, symbol, symbol, price)
+}
+
+// newTestBot — бот, который отправляет сообщения в локальный сервер Telegram; тексты
+// отправленных сообщений приходят в sent
+func newTestBot(t *testing.T) (*tgbotapi.BotAPI, <-chan string) {
+	sent := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/getMe"):
+			w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"test","username":"test_bot"}}`))
+		case strings.HasSuffix(r.URL.Path, "/sendMessage"):
+			r.ParseForm()
+			sent <- r.FormValue("chat_id") + ": " + r.FormValue("text")
+			w.Write([]byte(`{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":42,"type":"private"}}}`))
+		default:
+			w.Write([]byte(`{"ok":true,"result":true}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	bot, err := tgbotapi.NewBotAPIWithClient("test", server.URL+"/bot%s/%s", server.Client())
+	if err != nil {
+		t.Fatalf("бот: %v", err)
+	}
+	return bot, sent
+}
+
+func initTestDB(t *testing.T) {
+	if err := storage.InitDB(filepath.Join(t.TempDir(), "bot.db")); err != nil {
+		t.Fatalf("база: %v", err)
+	}
+	t.Cleanup(func() { storage.DB.Close() })
+}
+
+func expectOp(t *testing.T, ops <-chan string, want string) {
+	t.Helper()
+	select {
+	case op := <-ops:
+		if op != want {
+			t.Fatalf("операция потока %q, ожидалась %q", op, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("нет операции %q", want)
+	}
+}
+
+func expectMessage(t *testing.T, sent <-chan string, want string) {
+	t.Helper()
+	select {
+	case text := <-sent:
+		if !strings.Contains(text, want) {
+			t.Fatalf("сообщение %q, ожидалось с %q", text, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("нет сообщения с %q", want)
+	}
+}
+
+func TestAlertFiresOnceFromPriceStream(t *testing.T) {
+	initTestDB(t)
+	for _, alert := range []struct {
+		symbol    string
+		price     float64
+		direction string
+	}{
+		{"BTCUSDT", 70000, "up"},
+		{"BTCUSDT", 50000, "down"},
+		{"ETHUSDT", 4000, "up"},
+	} {
+		if err := storage.AddAlert(42, alert.symbol, alert.price, alert.direction); err != nil {
+			t.Fatalf("алерт: %v", err)
+		}
+	}
+
+	stub := &wsStub{ops: make(chan string, 10), ticks: make(chan string)}
+	wsServer := httptest.NewServer(stub)
+	defer wsServer.Close()
+	t.Setenv("BYBIT_WS_URL", "ws"+strings.TrimPrefix(wsServer.URL, "http"))
+
+	bot, sent := newTestBot(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go StartAlertChecker(ctx, bot)
+
+	select {
+	case op := <-stub.ops:
+		if op != "subscribe tickers.BTCUSDT,tickers.ETHUSDT" && op != "subscribe tickers.ETHUSDT,tickers.BTCUSDT" {
+			t.Fatalf("подписка %q", op)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("поток не подписался на символы алертов")
+	}
+
+	stub.ticks <- tickerMessage("BTCUSDT", 65000)
+	stub.ticks <- tickerMessage("BTCUSDT", 71000)
+	expectMessage(t, sent, "42: 🔔 Сработал алерт! 🔔\n\nМонета: *BTCUSDT*\nЦена достигла: *71000.00$*")
+
+	// перечитывание алертов (его делает и REST-проверка раз в 180 секунд) не возвращает
+	// сработавший алерт: BTC остается в подписке из-за второго алерта, но следующая
+	// цена выше цели сообщения не дает
+	reloadAlerts()
+	stub.ticks <- tickerMessage("BTCUSDT", 72000)
+	stub.ticks <- tickerMessage("ETHUSDT", 4100)
+	// сообщения идут по порядку цен потока: повтор по BTC пришел бы раньше этого
+	expectMessage(t, sent, "Монета: *ETHUSDT*")
+	// по ETH алертов не осталось — символ отписывается
+	expectOp(t, stub.ops, "unsubscribe tickers.ETHUSDT")
+
+	active, err := storage.GetAllActiveAlerts()
+	if err != nil {
+		t.Fatalf("алерты: %v", err)
+	}
+	if len(active) != 1 || active[0].Symbol != "BTCUSDT" || active[0].Direction != "down" {
+		t.Errorf("активные алерты после срабатывания: %+v", active)
+	}
+}
+
+func TestAlertDeliveryDoesNotBlockPriceChecks(t *testing.T) {
+	initTestDB(t)
+	for _, symbol := range []string{"BTCUSDT", "ETHUSDT"} {
+		if err := storage.AddAlert(42, symbol, 100, "up"); err != nil {
+			t.Fatalf("алерт: %v", err)
+		}
+	}
+	reloadAlerts()
+
+	// Telegram отвечает, только когда тест отпустит release
+	release := make(chan struct{})
+	sent := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/getMe"):
+			w.Write([]byte(`{"ok":true,"result":{"id":1,"is_bot":true,"first_name":"test","username":"test_bot"}}`))
+		case strings.HasSuffix(r.URL.Path, "/sendMessage"):
+			<-release
+			r.ParseForm()
+			sent <- r.FormValue("text")
+			w.Write([]byte(`{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":42,"type":"private"}}}`))
+		}
+	}))
+	defer server.Close()
+	bot, err := tgbotapi.NewBotAPIWithClient("test", server.URL+"/bot%s/%s", server.Client())
+	if err != nil {
+		t.Fatalf("бот: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go deliverFiredAlerts(ctx, bot)
+
+	checked := make(chan struct{})
+	go func() {
+		evaluateAlerts(map[string]float64{"BTCUSDT": 110})
+		// пока сообщение о BTC висит в Telegram, следующие цены и перечитывание
+		// алертов не ждут его и не возвращают сработавший алерт в память
+		reloadAlerts()
+		evaluateAlerts(map[string]float64{"ETHUSDT": 110, "BTCUSDT": 120})
+		close(checked)
+	}()
+	select {
+	case <-checked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("проверка цен ждет отправки сообщения")
+	}
+
+	close(release)
+	expectMessage(t, sent, "Монета: *BTCUSDT*")
+	expectMessage(t, sent, "Монета: *ETHUSDT*")
+	select {
+	case text := <-sent:
+		t.Errorf("лишнее сообщение: %q", text)
+	case <-time.After(200 * time.Millisecond):
+	}
+	if active, _ := storage.GetAllActiveAlerts(); len(active) != 0 {
+		t.Errorf("активные алерты после срабатывания: %+v", active)
+	}
+}
+
+func TestFormatAlertPrice(t *testing.T) {
+	tests := []struct {
+		symbol string
+		price  float64
+		want   string
+	}{
+		{"BTCUSDT", 71000, "71000.00$"},
+		{"BTCUSDC", 71000.5, "71000.50$"},
+		{"PEPEUSDT", 0.00001234, "0.00001234$"},
+		{"ETHBTC", 0.05123, "0.05123 BTC"},
+		{"BTCEUR", 65000, "65000.00 EUR"},
+	}
+	for _, tt := range tests {
+		if got := formatAlertPrice(tt.symbol, tt.price); got != tt.want {
+			t.Errorf("%s %v: %q, ожидалось %q", tt.symbol, tt.price, got, tt.want)
+		}
+	}
+}
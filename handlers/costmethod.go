@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"fmt"
+	"log"
+	"telegram-date-bot/spotAllPNL"
+	"telegram-date-bot/storage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const costMethodsText = "🧮 Как считать реализованный PnL — с какими покупками сопоставлять продажи:\n\n" +
+	"• FIFO — сначала продаются самые ранние покупки\n" +
+	"• LIFO — сначала продаются самые поздние покупки\n" +
+	"• HIFO — сначала продаются самые дорогие покупки, PnL получается минимальным\n" +
+	"• Средняя — все покупки сливаются в одну позицию по скользящей средней цене"
+
+// userCostMethod — выбранный пользователем метод расчета PnL
+func userCostMethod(chatID int64) spotAllPNL.CostMethod {
+	settings, err := storage.GetUserSettings(chatID)
+	if err != nil {
+		log.Printf("Ошибка чтения настроек пользователя %d: %v", chatID, err)
+	}
+	return spotAllPNL.ParseCostMethod(settings.CostMethod)
+}
+
+func createCostMethodKeyboard(current spotAllPNL.CostMethod) tgbotapi.InlineKeyboardMarkup {
+	var buttons []tgbotapi.InlineKeyboardButton
+	for _, method := range spotAllPNL.CostMethods {
+		text := method.Title()
+		if method == current {
+			text = "✅ " + text
+		}
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(text, "cost_method_"+string(method)))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(buttons...),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("« Назад", "back_to_settings")),
+	)
+}
+
+// HandleCostMethod показывает методы расчета PnL; arg — выбранный метод или "menu"
+func HandleCostMethod(bot *tgbotapi.BotAPI, update tgbotapi.Update, arg string) {
+	chatID := getChatID(update)
+
+	if arg == "menu" {
+		editMenuMessage(bot, update, costMethodsText, createCostMethodKeyboard(userCostMethod(chatID)))
+		return
+	}
+
+	method := spotAllPNL.ParseCostMethod(arg)
+	if err := storage.SetCostMethod(chatID, string(method)); err != nil {
+		sendError(bot, chatID, fmt.Sprintf("Не удалось сохранить метод: %v", err))
+		return
+	}
+	text := fmt.Sprintf("✅ Реализованный PnL считается методом %s.\n\n%s", method.Title(), costMethodsText)
+	editMenuMessage(bot, update, text, createCostMethodKeyboard(method))
+}
@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"telegram-date-bot/exchanges"
+	"telegram-date-bot/rates"
+	"telegram-date-bot/storage"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+const currencyText = "💱 В какой валюте показывать баланс, PnL, уведомления и CSV-отчеты.\n\n" +
+	"Прошлые сделки пересчитываются по курсу на дату сделки, текущие монеты — по текущему курсу. " +
+	"Доллар считается по USDT, рубль — по курсу ЦБ РФ."
+
+// rateSource — откуда берутся курсы для пересчета в валюту отчета. По умолчанию — спот
+// Bybit и курс рубля ЦБ; создается при первом обращении, когда окружение уже загружено.
+var (
+	rateSource     rates.Source
+	rateSourceOnce sync.Once
+)
+
+// SetRateSource подменяет источник курсов, например файлом с курсами для тестов.
+// Вызывается до запуска обработчиков.
+func SetRateSource(source rates.Source) {
+	rateSource = source
+}
+
+func currentRateSource() rates.Source {
+	rateSourceOnce.Do(func() {
+		if rateSource == nil {
+			rateSource = rates.Combine(rates.NewExchangeSource(newPublicExchangeClient()), rates.NewCBRSource())
+		}
+	})
+	return rateSource
+}
+
+// userCurrency — выбранная пользователем валюта отчета
+func userCurrency(chatID int64) rates.Currency {
+	settings, err := storage.GetUserSettings(chatID)
+	if err != nil {
+		log.Printf("Ошибка чтения настроек пользователя %d: %v", chatID, err)
+	}
+	return rates.ParseCurrency(settings.ReportCurrency)
+}
+
+// newConverter — пересчет в валюту currency по текущим курсам. Для сделок trades
+// подгружаются дневные курсы на даты сделок.
+func newConverter(ctx context.Context, currency rates.Currency, trades []exchanges.Execution) (*rates.Converter, error) {
+	source := currentRateSource()
+	prices, err := source.Prices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conv := rates.NewConverter(currency.Coin, prices)
+	if len(trades) == 0 {
+		return conv, nil
+	}
+	if err := conv.LoadHistory(ctx, source, trades); err != nil {
+		log.Printf("[Rates] Дневные курсы не загружены, сделки пересчитаны по текущим: %v", err)
+	}
+	return conv, nil
+}
+
+// normalizeTrades приводит сделки во всех парах к валюте отчета, чтобы история монеты
+// по разным котировкам (ETHUSDT, ETHBTC) считалась вместе
+func normalizeTrades(ctx context.Context, currency rates.Currency, trades []exchanges.Execution) ([]exchanges.Execution, error) {
+	conv, err := newConverter(ctx, currency, trades)
+	if err != nil {
+		return nil, err
+	}
+	return conv.Normalize(trades), nil
+}
+
+func createCurrencyKeyboard(current rates.Currency) tgbotapi.InlineKeyboardMarkup {
+	var buttons []tgbotapi.InlineKeyboardButton
+	for _, currency := range rates.Currencies {
+		text := currency.Code + " " + currency.Sign
+		if currency.Code == current.Code {
+			text = "✅ " + text
+		}
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(text, "report_currency_"+currency.Code))
+	}
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(buttons...),
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("« Назад", "back_to_settings")),
+	)
+}
+
+// HandleReportCurrency показывает валюты отчета; arg — выбранная валюта или "menu"
+func HandleReportCurrency(bot *tgbotapi.BotAPI, update tgbotapi.Update, arg string) {
+	chatID := getChatID(update)
+
+	if arg == "menu" {
+		editMenuMessage(bot, update, currencyText, createCurrencyKeyboard(userCurrency(chatID)))
+		return
+	}
+
+	currency := rates.ParseCurrency(arg)
+	if err := storage.SetReportCurrency(chatID, currency.Code); err != nil {
+		sendError(bot, chatID, fmt.Sprintf("Не удалось сохранить валюту: %v", err))
+		return
+	}
+	text := fmt.Sprintf("✅ Суммы показываются в %s.\n\n%s", currency.Code, currencyText)
+	editMenuMessage(bot, update, text, createCurrencyKeyboard(currency))
+}
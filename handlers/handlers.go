@@ -1,13 +1,16 @@
 package handlers
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"regexp"
 	"strconv"
 	"strings"
-	"telegram-date-bot/database"
+	"sync"
 	"telegram-date-bot/exchanges"
+	"telegram-date-bot/rates"
 	"telegram-date-bot/spotAllPNL"
 	"telegram-date-bot/spotpnl"
 	"telegram-date-bot/storage"
@@ -18,38 +21,193 @@ import (
 
 // состояния нужны, чтобы бот понимал, ключи АПИ или уведлмления ему ожидать.
 const (
-	StateNone         = ""
-	StateWaitingKeys  = "waiting_keys"
-	StateWaitingAlert = "waiting_alert"
+	StateNone              = ""
+	StateWaitingKeys       = "waiting_keys"
+	StateWaitingPassphrase = "waiting_passphrase"
+	StateWaitingAlert      = "waiting_alert"
 )
 
 var userStates = make(map[int64]string)
 
-func getUserAndValidateKeys(chatID int64) (database.User, error) {
-	user, err := database.GetUser(chatID)
-	if err != nil {
-		return user, fmt.Errorf("ошибка получения данных")
+// порог ожидания в очереди запросов к бирже, после которого предупреждаем пользователя
+const queueNoticeThreshold = 2 * time.Second
+
+// максимальная длительность синхронизации истории по кнопке
+const syncTimeout = 15 * time.Minute
+
+// активные синхронизации истории: chatID -> отмена (кнопка «Отменить»)
+var (
+	activeSyncsMu sync.Mutex
+	activeSyncs   = make(map[int64]context.CancelFunc)
+)
+
+// долгие обработчики выполняются в горутинах, чтобы бот принимал нажатие «Отменить»
+var handlersWG sync.WaitGroup
+
+// биржа, для которой пользователь сейчас вводит ключи
+var pendingKeyExchange = make(map[int64]string)
+
+// ключ, секрет и название аккаунта, ожидающие passphrase (OKX)
+var pendingKeys = make(map[int64][3]string)
+
+// инструкции по созданию API ключа для каждой биржи
+var apiKeyGuides = map[string]string{
+	exchanges.ExchangeBybit:   "https://www.bybit.com/ru-RU/help-center/article/How-to-create-your-API-key/",
+	exchanges.ExchangeBinance: "https://www.binance.com/ru/support/faq/360002502072",
+	exchanges.ExchangeOKX:     "https://www.okx.com/help/how-can-i-do-api-trading-with-okx",
+}
+
+// создает клиент биржи по ключам аккаунта
+func newExchangeClient(user storage.User) (exchanges.Exchange, error) {
+	return exchanges.NewExchange(exchanges.Credentials{
+		Exchange:   user.Exchange,
+		ApiKey:     user.ApiKey,
+		ApiSecret:  user.ApiSecret,
+		Passphrase: user.Passphrase,
+	})
+}
+
+// клиент без ключей для публичных данных (цены, тикеры)
+func newPublicExchangeClient() exchanges.Exchange {
+	return exchanges.NewBybitClient("", "")
+}
+
+// текст о постановке в очередь, если запросов с этими ключами сейчас слишком много
+func queueNotice(client exchanges.Exchange) string {
+	wait := client.QueueWait()
+	if wait < queueNoticeThreshold {
+		return ""
+	}
+	return fmt.Sprintf("⏳ Ваш запрос в очереди, ожидание ~%d сек...", int(wait.Round(time.Second).Seconds()))
+}
+
+// startSync регистрирует синхронизацию пользователя. Одновременно у пользователя может
+// идти только одна синхронизация — иначе они перезаписывают кэш друг друга.
+func startSync(ctx context.Context, chatID int64) (context.Context, func(), bool) {
+	activeSyncsMu.Lock()
+	defer activeSyncsMu.Unlock()
+
+	if _, busy := activeSyncs[chatID]; busy {
+		return nil, nil, false
+	}
+
+	syncCtx, cancel := context.WithTimeout(ctx, syncTimeout)
+	activeSyncs[chatID] = cancel
+	done := func() {
+		activeSyncsMu.Lock()
+		delete(activeSyncs, chatID)
+		activeSyncsMu.Unlock()
+		cancel()
+	}
+	return syncCtx, done, true
+}
+
+func cancelSync(chatID int64) bool {
+	activeSyncsMu.Lock()
+	defer activeSyncsMu.Unlock()
+
+	cancel, ok := activeSyncs[chatID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+func createCancelSyncKeyboard() tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("✖️ Отменить", "cancel_sync"),
+		),
+	)
+}
+
+// текст ошибки синхронизации истории для пользователя
+func syncErrorText(err error) string {
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "⏹ Синхронизация отменена. Загруженная часть истории сохранена — продолжу с того же места при следующем запросе."
+	case errors.Is(err, context.DeadlineExceeded):
+		return "⌛ Синхронизация заняла слишком много времени. Загруженная часть сохранена, попробуйте еще раз."
+	default:
+		return exchangeErrorText("Ошибка получения истории", err)
 	}
+}
 
-	if user.BybitApiKey == "" || user.BybitApiSecret == "" {
-		return user, fmt.Errorf("ключи не установлены")
+// historyLimitNotice — предупреждение об аккаунтах, биржа которых отдала историю
+// не за весь период: ранние сделки не учтены в PnL и средней цене
+func historyLimitNotice(chatID int64, view portfolioView) string {
+	var notice string
+	for _, account := range view.accounts {
+		since, err := storage.GetTradesHistoryLimit(chatID, account.AccountID)
+		if err != nil {
+			log.Printf("[Cache] Ошибка чтения границы истории: %v", err)
+			continue
+		}
+		if since == 0 {
+			continue
+		}
+		notice += fmt.Sprintf("\n\n⚠️ %s%s хранит историю сделок только с %s — более ранние сделки не загружены, PnL и средняя цена могут быть неточными.",
+			view.accountPrefix(account), exchanges.DisplayName(account.Exchange), time.UnixMilli(since).Format("02.01.2006"))
+	}
+	return notice
+}
+
+// exchangeErrorText — текст ошибки биржи с подсказкой, что делать пользователю
+func exchangeErrorText(prefix string, err error) string {
+	text := fmt.Sprintf("❌ %s: %v", prefix, err)
+	if hint := exchangeErrorHint(err); hint != "" {
+		text += "\n\n" + hint
+	}
+	return text
+}
+
+// exchangeErrorHint подбирает подсказку по типу ошибки биржи
+func exchangeErrorHint(err error) string {
+	exchangeName := "биржи"
+	var apiErr *exchanges.APIError
+	if errors.As(err, &apiErr) {
+		exchangeName = exchanges.DisplayName(apiErr.Exchange)
+	}
+
+	switch {
+	case errors.Is(err, exchanges.ErrInvalidKey):
+		return fmt.Sprintf("🔑 %s не принимает ключ. Проверьте, что ключ и секрет скопированы полностью и ключ не удален и не истек, затем введите их заново в настройках.", exchangeName)
+	case errors.Is(err, exchanges.ErrIPNotAllowed):
+		return fmt.Sprintf("🌐 Ключ привязан к IP-адресам, и адреса бота среди них нет. Уберите ограничение по IP в настройках ключа на %s или создайте новый ключ.", exchangeName)
+	case errors.Is(err, exchanges.ErrPermissionDenied):
+		return fmt.Sprintf("🔒 У ключа не хватает прав. Включите для него доступ на чтение (Read) для спота на %s.", exchangeName)
+	case errors.Is(err, exchanges.ErrRateLimited):
+		return "⏳ Биржа ограничила частоту запросов. Подождите минуту и попробуйте снова."
+	case errors.Is(err, exchanges.ErrMaintenance):
+		return fmt.Sprintf("🛠 %s временно недоступна или на обслуживании. Попробуйте позже.", exchangeName)
+	case errors.Is(err, exchanges.ErrTimestamp):
+		return "🕒 Не удалось согласовать время с биржей. Попробуйте еще раз через пару минут."
 	}
+	return ""
+}
 
-	return user, nil
+// runAsync запускает обработчик в отдельной горутине с учетом в WaitForHandlers
+func runAsync(fn func()) {
+	handlersWG.Add(1)
+	go func() {
+		defer handlersWG.Done()
+		fn()
+	}()
 }
 
-// конвертирует кэшированные сделки в формат spotAllPNL
-func convertToSpotAllPNLExecutions(cachedTrades []spotpnl.Execution) []spotAllPNL.Execution {
-	allTrades := make([]spotAllPNL.Execution, 0, len(cachedTrades))
-	for _, t := range cachedTrades {
-		allTrades = append(allTrades, spotAllPNL.Execution{
-			Symbol:   t.Symbol,
-			Price:    t.Price,
-			Quantity: t.Quantity,
-			Side:     t.Side,
-		})
+// WaitForHandlers ждет завершения запущенных обработчиков при остановке бота
+func WaitForHandlers(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		handlersWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
 	}
-	return allTrades
 }
 
 func sendError(bot *tgbotapi.BotAPI, chatID int64, text string) {
@@ -84,7 +242,7 @@ func HandleStart(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 
 	welcomeText := fmt.Sprintf(
 		"Приветствую, %s! 👋\n"+
-			"Я помогу отслеживать твой портфель на Bybit:\n\n"+
+			"Я помогу отслеживать твой портфель на Bybit, Binance и OKX:\n\n"+
 			"📊 Мониторинг текущего спот баланса\n"+
 			"📈 Расчет PNL за 2 года по спот-торговле\n"+
 			"📈 Детальная аналитика по каждой монете\n"+
@@ -112,23 +270,38 @@ func CreateMainMenuKeyboard() tgbotapi.InlineKeyboardMarkup {
 	return tgbotapi.NewInlineKeyboardMarkup(row1, row2)
 }
 
-func CreateSettingsMenuKeyboard(notificationsEnabled bool) tgbotapi.InlineKeyboardMarkup {
+func CreateSettingsMenuKeyboard(settings storage.UserSettings) tgbotapi.InlineKeyboardMarkup {
 	setKeysBtn := tgbotapi.NewInlineKeyboardButtonData("🔑 Настроить ключи API", "set_api_keys")
+	accountsBtn := tgbotapi.NewInlineKeyboardButtonData("👤 Аккаунты", "manage_accounts")
+	costMethodBtn := tgbotapi.NewInlineKeyboardButtonData("🧮 PnL: "+spotAllPNL.ParseCostMethod(settings.CostMethod).Title(), "cost_method_menu")
+	currencyBtn := tgbotapi.NewInlineKeyboardButtonData("💱 Валюта: "+rates.ParseCurrency(settings.ReportCurrency).Code, "report_currency_menu")
 	exportBtn := tgbotapi.NewInlineKeyboardButtonData("📄 Экспорт в CSV", "export_csv")
+	resyncBtn := tgbotapi.NewInlineKeyboardButtonData("🔄 Загрузить историю заново", "resync_history")
 	backBtn := tgbotapi.NewInlineKeyboardButtonData("« Назад", "back_to_main")
 
 	var notificationBtn tgbotapi.InlineKeyboardButton
-	if notificationsEnabled {
+	if settings.NotificationsEnabled {
 		notificationBtn = tgbotapi.NewInlineKeyboardButtonData("✅ Уведомления (Вкл)", "toggle_notifications_off")
 	} else {
 		notificationBtn = tgbotapi.NewInlineKeyboardButtonData("❌ Уведомления (Выкл)", "toggle_notifications_on")
 	}
 
-	row1 := tgbotapi.NewInlineKeyboardRow(setKeysBtn, exportBtn)
-	row2 := tgbotapi.NewInlineKeyboardRow(notificationBtn)
-	row3 := tgbotapi.NewInlineKeyboardRow(backBtn)
+	var fillsBtn tgbotapi.InlineKeyboardButton
+	if settings.FillNotifications {
+		fillsBtn = tgbotapi.NewInlineKeyboardButtonData("✅ Исполнения ордеров (Вкл)", "toggle_fills_off")
+	} else {
+		fillsBtn = tgbotapi.NewInlineKeyboardButtonData("❌ Исполнения ордеров (Выкл)", "toggle_fills_on")
+	}
 
-	return tgbotapi.NewInlineKeyboardMarkup(row1, row2, row3)
+	row1 := tgbotapi.NewInlineKeyboardRow(setKeysBtn, exportBtn)
+	row2 := tgbotapi.NewInlineKeyboardRow(accountsBtn, costMethodBtn)
+	row3 := tgbotapi.NewInlineKeyboardRow(currencyBtn)
+	row4 := tgbotapi.NewInlineKeyboardRow(notificationBtn)
+	row5 := tgbotapi.NewInlineKeyboardRow(fillsBtn)
+	row6 := tgbotapi.NewInlineKeyboardRow(resyncBtn)
+	row7 := tgbotapi.NewInlineKeyboardRow(backBtn)
+
+	return tgbotapi.NewInlineKeyboardMarkup(row1, row2, row3, row4, row5, row6, row7)
 }
 
 func createAlertsMenuKeyboard() tgbotapi.InlineKeyboardMarkup {
@@ -142,66 +315,112 @@ func createAlertsMenuKeyboard() tgbotapi.InlineKeyboardMarkup {
 	return tgbotapi.NewInlineKeyboardMarkup(row1, row2)
 }
 
+func createExchangeSelectKeyboard() tgbotapi.InlineKeyboardMarkup {
+	var buttons []tgbotapi.InlineKeyboardButton
+	for _, exchange := range exchanges.SupportedExchanges {
+		buttons = append(buttons, tgbotapi.NewInlineKeyboardButtonData(exchanges.DisplayName(exchange), "set_keys_"+exchange))
+	}
+	backBtn := tgbotapi.NewInlineKeyboardButtonData("« Назад", "back_to_settings")
+
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(buttons...),
+		tgbotapi.NewInlineKeyboardRow(backBtn),
+	)
+}
+
 func HandleSetKeys(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+	editMenuMessage(bot, update, "🔑 Выберите биржу, для которой хотите добавить ключи:", createExchangeSelectKeyboard())
+}
+
+func HandleSetKeysForExchange(bot *tgbotapi.BotAPI, update tgbotapi.Update, exchange string) {
 	chatID := update.CallbackQuery.Message.Chat.ID
 
+	guide, ok := apiKeyGuides[exchange]
+	if !ok {
+		sendError(bot, chatID, "Неизвестная биржа")
+		return
+	}
+
 	// Устанавливаем состояние ожидания ключей
 	userStates[chatID] = StateWaitingKeys
+	pendingKeyExchange[chatID] = exchange
 
-	msg := tgbotapi.NewMessage(chatID,
-		`Отправьте ключи в формате:
-API_KEY API_SECRET
+	passphraseNote := ""
+	if exchanges.RequiresPassphrase(exchange) {
+		passphraseNote = "\nPassphrase запрошу следующим сообщением\n"
+	}
 
-Инструкция: [как создать API ключ](https://www.bybit.com/ru-RU/help-center/article/How-to-create-your-API-key/)
+	msg := tgbotapi.NewMessage(chatID, fmt.Sprintf(
+		`Отправьте ключи %s в формате:
+API_KEY API_SECRET
+%s
+Инструкция: [как создать API ключ](%s)
 
-🔑 Ваши ключи в безопасности`)
+Для второго аккаунта той же биржи допишите через пробел его название
+Боту достаточно прав только на чтение, ключи с правом вывода не принимаются
+🗑 Сообщение с ключами я удалю сразу после получения
+🔑 Ваши ключи в безопасности`, exchanges.DisplayName(exchange), passphraseNote, guide))
 	msg.ParseMode = "MarkdownV2"
 	bot.Send(msg)
 }
 
-func HandleTextMessageAPI(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+func HandleTextMessageAPI(ctx context.Context, bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	chatID := update.Message.Chat.ID
 	text := update.Message.Text
 
 	// Проверяем состояние пользователя
 	state := userStates[chatID]
 
+	// сообщение с секретом не должно оставаться в истории чата
+	if state == StateWaitingKeys || state == StateWaitingPassphrase {
+		deleteSecretMessage(bot, update.Message)
+	}
+
 	switch state {
 	case StateWaitingKeys:
 		// Обрабатываем ввод API ключей
 		parts := strings.Fields(text)
 
-		if len(parts) != 2 {
-			msg := tgbotapi.NewMessage(chatID, "❌ Неверный формат. Отправьте: API_KEY API_SECRET")
+		if len(parts) < 2 {
+			msg := tgbotapi.NewMessage(chatID, "❌ Неверный формат. Отправьте: API_KEY API_SECRET или API_KEY API_SECRET название")
 			bot.Send(msg)
 			return
 		}
 
-		// Сохраняем в users.json (для совместимости)
-		user := database.User{
-			ChatID:         chatID,
-			BybitApiKey:    parts[0],
-			BybitApiSecret: parts[1],
+		exchange := pendingKeyExchange[chatID]
+		if exchange == "" {
+			exchange = exchanges.ExchangeBybit
 		}
 
-		err := database.SaveUser(user)
-		if err != nil {
-			msg := tgbotapi.NewMessage(chatID, "❌ Ошибка сохранения ключей")
-			bot.Send(msg)
+		name := accountNameFromInput(exchange, parts[2:])
+
+		// OKX дополнительно требует passphrase — запрашиваем его отдельным сообщением
+		if exchanges.RequiresPassphrase(exchange) {
+			pendingKeys[chatID] = [3]string{parts[0], parts[1], name}
+			userStates[chatID] = StateWaitingPassphrase
+			bot.Send(tgbotapi.NewMessage(chatID, "Теперь отправьте passphrase, который вы указали при создании API ключа"))
 			return
 		}
 
-		// Сохраняем также в SQLite базу данных
-		err = storage.SaveOrUpdateUser(chatID, parts[0], parts[1])
-		if err != nil {
-			log.Printf("Ошибка сохранения в SQLite: %v", err)
-		}
+		clearKeyInput(chatID)
+		runAsync(func() { checkAndSaveKeys(ctx, bot, chatID, name, exchange, parts[0], parts[1], "") })
 
-		msg := tgbotapi.NewMessage(chatID, "✅ Ключи сохранены!")
-		bot.Send(msg)
+	case StateWaitingPassphrase:
+		keys, ok := pendingKeys[chatID]
+		passphrase := strings.TrimSpace(text)
+		if !ok {
+			delete(userStates, chatID)
+			sendError(bot, chatID, "Ключи не найдены, начните ввод заново через меню ⚙️")
+			return
+		}
+		if passphrase == "" || strings.ContainsAny(passphrase, " \t\n") {
+			bot.Send(tgbotapi.NewMessage(chatID, "❌ Неверный формат. Отправьте только passphrase одним сообщением"))
+			return
+		}
 
-		// Сбрасываем состояние
-		delete(userStates, chatID)
+		exchange := pendingKeyExchange[chatID]
+		clearKeyInput(chatID)
+		runAsync(func() { checkAndSaveKeys(ctx, bot, chatID, keys[2], exchange, keys[0], keys[1], passphrase) })
 
 	case StateWaitingAlert:
 		// Обрабатываем создание алерта
@@ -212,7 +431,7 @@ func HandleTextMessageAPI(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 			symbolPart := matches[1]
 			pricePart := matches[2]
 
-			CreateAlertFromText(bot, update, symbolPart, pricePart)
+			CreateAlertFromText(ctx, bot, update, symbolPart, pricePart)
 
 			// Сбрасываем состояние
 			delete(userStates, chatID)
@@ -229,7 +448,143 @@ func HandleTextMessageAPI(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	}
 }
 
-func HandleCallback(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+// deleteSecretMessage удаляет сообщение пользователя с ключами или passphrase
+func deleteSecretMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message) {
+	if _, err := bot.Request(tgbotapi.NewDeleteMessage(message.Chat.ID, message.MessageID)); err != nil {
+		log.Printf("Не удалось удалить сообщение с ключами пользователя %d: %v", message.Chat.ID, err)
+	}
+}
+
+// clearKeyInput сбрасывает состояние ввода ключей
+func clearKeyInput(chatID int64) {
+	delete(userStates, chatID)
+	delete(pendingKeyExchange, chatID)
+	delete(pendingKeys, chatID)
+}
+
+// клавиатура для повторного ввода ключей той же биржи
+func retryKeysKeyboard(exchange string) tgbotapi.InlineKeyboardMarkup {
+	return tgbotapi.NewInlineKeyboardMarkup(
+		tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("🔑 Ввести ключи заново", "set_keys_"+exchange)),
+	)
+}
+
+// checkAndSaveKeys проверяет ключ на бирже и сохраняет его, если он подходит боту.
+// Ключи с правом вывода не сохраняются: боту нужно только чтение.
+func checkAndSaveKeys(ctx context.Context, bot *tgbotapi.BotAPI, chatID int64, name, exchange, apiKey, apiSecret, passphrase string) {
+	status, _ := bot.Send(tgbotapi.NewMessage(chatID, "🔍 Проверяю ключ..."))
+	defer bot.Request(tgbotapi.NewDeleteMessage(chatID, status.MessageID))
+
+	client, err := newExchangeClient(storage.User{UserID: chatID, Exchange: exchange, ApiKey: apiKey, ApiSecret: apiSecret, Passphrase: passphrase})
+	if err != nil {
+		sendError(bot, chatID, err.Error())
+		return
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	info, err := client.GetKeyInfo(checkCtx)
+	if err != nil {
+		log.Printf("Ключ пользователя %d не прошел проверку: %v", chatID, err)
+		msg := tgbotapi.NewMessage(chatID, exchangeErrorText("Ключ не прошел проверку", err))
+		msg.ReplyMarkup = retryKeysKeyboard(exchange)
+		bot.Send(msg)
+		return
+	}
+
+	if info.CanWithdraw {
+		msg := tgbotapi.NewMessage(chatID, fmt.Sprintf(
+			"⛔️ У ключа включен вывод средств — такой ключ бот не сохраняет.\n\n"+
+				"Если его украдут, с аккаунта можно будет вывести деньги. Удалите этот ключ на %s "+
+				"и создайте новый только с правами на чтение.", exchanges.DisplayName(exchange)))
+		msg.ReplyMarkup = retryKeysKeyboard(exchange)
+		bot.Send(msg)
+		return
+	}
+
+	account, ok := saveUserKeys(bot, chatID, name, exchange, apiKey, apiSecret, passphrase)
+	if !ok {
+		return
+	}
+
+	if err := storage.SetAccountIdentity(account.AccountID, info.UID, info.IsMaster); err != nil {
+		log.Printf("Ошибка сохранения UID аккаунта %d: %v", account.AccountID, err)
+	}
+
+	text := fmt.Sprintf("✅ Ключи %s проверены и сохранены, аккаунт «%s» выбран активным.\n\n%s",
+		exchanges.DisplayName(exchange), account.AccountName, formatKeyInfo(info))
+	if info.IsMaster {
+		text += "\n\n🧩 Это ключ мастер-аккаунта: в Настройки → Аккаунты можно показывать его субаккаунты вместе с ним."
+	}
+	if _, ok := client.(exchanges.KnownTradesSetter); ok {
+		text += fmt.Sprintf("\n\n📜 %s отдает историю сделок отдельно по каждой паре, и бот ищет пары по монетам на балансе. "+
+			"Монеты, проданные полностью до подключения, в PnL не попадут — добавьте их пары командой "+
+			"/resync, например: /resync SOLUSDT ADAUSDT", exchanges.DisplayName(exchange))
+	}
+	bot.Send(tgbotapi.NewMessage(chatID, text))
+}
+
+// formatKeyInfo описывает права, привязку к IP и срок действия ключа
+func formatKeyInfo(info exchanges.KeyInfo) string {
+	var sb strings.Builder
+
+	if info.CanTrade {
+		sb.WriteString("🔓 Права: чтение и торговля\n")
+	} else {
+		sb.WriteString("🔒 Права: только чтение\n")
+	}
+
+	switch {
+	case len(info.IPs) > 0:
+		sb.WriteString(fmt.Sprintf("🌐 IP: %s\n", strings.Join(info.IPs, ", ")))
+	case info.IPRestricted:
+		sb.WriteString("🌐 IP: только разрешенные адреса\n")
+	default:
+		sb.WriteString("🌐 IP: без привязки\n")
+	}
+
+	if info.ExpiresAt.IsZero() {
+		sb.WriteString("⏳ Срок действия: бессрочный")
+	} else {
+		days := int(time.Until(info.ExpiresAt).Hours() / 24)
+		sb.WriteString(fmt.Sprintf("⏳ Действует до %s (дней: %d)", info.ExpiresAt.Format("02.01.2006"), days))
+	}
+
+	if info.CanTrade {
+		sb.WriteString("\n\n⚠️ ВНИМАНИЕ: этим ключом можно торговать от вашего имени! " +
+			"Боту торговля не нужна — безопаснее заменить его ключом только на чтение.")
+	}
+	return sb.String()
+}
+
+// сохраняет ключи как аккаунт пользователя; возвращает false, если сохранить не удалось
+func saveUserKeys(bot *tgbotapi.BotAPI, chatID int64, name, exchange, apiKey, apiSecret, passphrase string) (storage.User, bool) {
+	accountID, err := storage.SaveAccount(chatID, name, exchange, apiKey, apiSecret, passphrase)
+	if err != nil {
+		log.Printf("Ошибка сохранения ключей пользователя %d: %v", chatID, err)
+		msg := tgbotapi.NewMessage(chatID, "❌ Ошибка сохранения ключей")
+		bot.Send(msg)
+		return storage.User{}, false
+	}
+	account := storage.User{
+		UserID:      chatID,
+		AccountID:   accountID,
+		AccountName: name,
+		Exchange:    exchange,
+		ApiKey:      apiKey,
+		ApiSecret:   apiSecret,
+		Passphrase:  passphrase,
+	}
+
+	// История сделок от прежних ключей этого аккаунта больше не актуальна
+	if err := storage.ClearTradesCache(chatID, accountID); err != nil {
+		log.Printf("Ошибка очистки кэша сделок: %v", err)
+	}
+	startUserStream(bot, account)
+	return account, true
+}
+
+func HandleCallback(ctx context.Context, bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	callback := tgbotapi.NewCallback(update.CallbackQuery.ID, "")
 	bot.Request(callback)
 
@@ -240,30 +595,78 @@ func HandleCallback(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 		return
 	}
 
+	if strings.HasPrefix(callbackData, "set_keys_") {
+		HandleSetKeysForExchange(bot, update, strings.TrimPrefix(callbackData, "set_keys_"))
+		return
+	}
+
+	if strings.HasPrefix(callbackData, "select_account_") {
+		HandleSelectAccount(bot, update, strings.TrimPrefix(callbackData, "select_account_"))
+		return
+	}
+
+	if strings.HasPrefix(callbackData, "cost_method_") {
+		HandleCostMethod(bot, update, strings.TrimPrefix(callbackData, "cost_method_"))
+		return
+	}
+
+	if strings.HasPrefix(callbackData, "report_currency_") {
+		HandleReportCurrency(bot, update, strings.TrimPrefix(callbackData, "report_currency_"))
+		return
+	}
+
+	if strings.HasPrefix(callbackData, "toggle_subs_") {
+		runAsync(func() { HandleToggleSubAccounts(ctx, bot, update, strings.TrimPrefix(callbackData, "toggle_subs_")) })
+		return
+	}
+
 	switch callbackData {
 	case "show_balance":
-		HandleBalance(bot, update)
+		runAsync(func() { HandleBalance(ctx, bot, update) })
 	case "show_total_pnl":
-		HandleTotalPNL(bot, update)
+		runAsync(func() { HandleTotalPNL(ctx, bot, update) })
+	case "cancel_sync":
+		chatID := getChatID(update)
+		if !cancelSync(chatID) {
+			bot.Send(tgbotapi.NewMessage(chatID, "Нет активной синхронизации."))
+		}
 
 	case "open_settings", "back_to_settings":
 		chatID := getChatID(update)
 		userSettings, _ := storage.GetUserSettings(chatID)
-		keyboard := CreateSettingsMenuKeyboard(userSettings.NotificationsEnabled)
+		keyboard := CreateSettingsMenuKeyboard(userSettings)
 		editMenuMessage(bot, update, "⚙️ Настройки:", keyboard)
 
 	case "toggle_notifications_on":
 		chatID := getChatID(update)
 		storage.SetNotificationsEnabled(chatID, true)
-		keyboard := CreateSettingsMenuKeyboard(true)
+		userSettings, _ := storage.GetUserSettings(chatID)
+		keyboard := CreateSettingsMenuKeyboard(userSettings)
 		editMenuMessage(bot, update, "✅ Уведомления включены!", keyboard)
 
 	case "toggle_notifications_off":
 		chatID := getChatID(update)
 		storage.SetNotificationsEnabled(chatID, false)
-		keyboard := CreateSettingsMenuKeyboard(false)
+		userSettings, _ := storage.GetUserSettings(chatID)
+		keyboard := CreateSettingsMenuKeyboard(userSettings)
 		editMenuMessage(bot, update, "❌ Уведомления выключены.", keyboard)
 
+	case "toggle_fills_on":
+		chatID := getChatID(update)
+		storage.SetFillNotifications(chatID, true)
+		userSettings, _ := storage.GetUserSettings(chatID)
+		text := "✅ Буду присылать исполнения ордеров."
+		if view, err := getPortfolioView(chatID); err == nil && view.accounts[0].Exchange != exchanges.ExchangeBybit {
+			text = "✅ Включено. Исполнения в реальном времени пока приходят только для Bybit."
+		}
+		editMenuMessage(bot, update, text, CreateSettingsMenuKeyboard(userSettings))
+
+	case "toggle_fills_off":
+		chatID := getChatID(update)
+		storage.SetFillNotifications(chatID, false)
+		userSettings, _ := storage.GetUserSettings(chatID)
+		editMenuMessage(bot, update, "❌ Исполнения ордеров выключены.", CreateSettingsMenuKeyboard(userSettings))
+
 	case "manage_alerts":
 		ManageAlerts(bot, update)
 	case "alert_create":
@@ -277,59 +680,119 @@ func HandleCallback(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 		ShowAlertsList(bot, update)
 	case "set_api_keys":
 		HandleSetKeys(bot, update)
+	case "manage_accounts":
+		HandleAccounts(bot, update)
+	case "resync_history":
+		HandleResync(ctx, bot, update)
 	case "export_csv":
-		HandleExportCSV(bot, update)
+		runAsync(func() { HandleExportCSV(ctx, bot, update) })
 	case "back_to_main":
 		HandleBackToMainMenu(bot, update)
 	case "show_pie_chart":
-		HandleBarChart(bot, update)
+		runAsync(func() { HandleBarChart(ctx, bot, update) })
 	}
 }
 
-func HandleBalance(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+func HandleBalance(ctx context.Context, bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	chatID := getChatID(update)
-	sentMsg, _ := bot.Send(tgbotapi.NewMessage(chatID, "Обновляю данные портфеля... ⏳"))
+	progressMsg := tgbotapi.NewMessage(chatID, "Обновляю данные портфеля... ⏳")
+	progressMsg.ReplyMarkup = createCancelSyncKeyboard()
+	sentMsg, _ := bot.Send(progressMsg)
 
-	user, err := getUserAndValidateKeys(chatID)
+	view, err := getPortfolioView(chatID)
 	if err != nil {
 		editMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, "❌ "+err.Error())
 		bot.Request(editMsg)
 		return
 	}
 
-	client := exchanges.NewBybitClient(user.BybitApiKey, user.BybitApiSecret)
+	view, subAccounts, err := discoverSubAccounts(ctx, chatID, view)
+	if err != nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, exchangeErrorText("Ошибка получения субаккаунтов", err))
+		bot.Request(editMsg)
+		return
+	}
 
-	cachedTrades, err := storage.GetAllTradesWithCache(client, chatID)
+	clients, err := view.clients()
 	if err != nil {
-		editMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, fmt.Sprintf("❌ Ошибка получения истории: %v", err))
+		editMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, "❌ "+err.Error())
 		bot.Request(editMsg)
 		return
 	}
 
-	allTrades := convertToSpotAllPNLExecutions(cachedTrades)
+	if notice := queueNoticeAll(clients); notice != "" {
+		bot.Request(tgbotapi.NewEditMessageTextAndMarkup(chatID, sentMsg.MessageID, notice, createCancelSyncKeyboard()))
+	}
 
-	balances, err := client.GetSpotBalance()
-	if err != nil {
-		editMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, fmt.Sprintf("❌ Ошибка получения баланса: %v", err))
+	syncCtx, done, ok := startSync(ctx, chatID)
+	if !ok {
+		editMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, "⏳ Синхронизация истории уже идет, дождитесь ее завершения")
 		bot.Request(editMsg)
 		return
 	}
+	defer done()
+
+	balances := make(map[string]string)
+	perAccount := make(map[int64]map[string]string)
+	for i, account := range view.accounts {
+		client := clients[i]
+		if err := storage.SyncTrades(syncCtx, client, chatID, account.AccountID); err != nil {
+			editMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, view.accountPrefix(account)+syncErrorText(err))
+			bot.Request(editMsg)
+			return
+		}
+
+		// свежий баланс из приватного потока избавляет от лишнего запроса
+		accountBalances, ok := liveBalances(account.AccountID)
+		if !ok {
+			accountBalances, err = client.GetSpotBalance(syncCtx)
+		}
+		if err != nil {
+			editMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, view.accountPrefix(account)+exchangeErrorText("Ошибка получения баланса", err))
+			bot.Request(editMsg)
+			return
+		}
+		mergeBalances(balances, accountBalances)
+		perAccount[account.AccountID] = accountBalances
+	}
 
-	allPrices, err := client.GetAllMarketPrices()
+	// субаккаунты без своих ключей добавляем по балансам, полученным ключом мастер-аккаунта
+	subBalances, err := subAccountsBalances(syncCtx, view, subAccounts, perAccount)
 	if err != nil {
-		editMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, fmt.Sprintf("❌ Ошибка получения цен: %v", err))
+		editMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, exchangeErrorText("Ошибка получения баланса", err))
 		bot.Request(editMsg)
 		return
 	}
+	for _, entries := range subBalances {
+		for _, entry := range entries {
+			if !entry.hasKey {
+				mergeBalances(balances, entry.balances)
+			}
+		}
+	}
 
-	groupedTrades := spotAllPNL.GroupTradesBySymbol(allTrades)
-	tradeAnalysis := spotAllPNL.AnalyzeTradeHistory(groupedTrades)
+	trades, err := storage.GetAccountsExecutions(chatID, view.accountIDs(), "", 0, 0)
+	if err != nil {
+		log.Printf("[Balance] Ошибка чтения сделок: %v", err)
+	}
+	// монеты на балансе — по текущему курсу, сделки — по курсу на дату сделки
+	currency := userCurrency(chatID)
+	conv, err := newConverter(syncCtx, currency, trades)
+	if err != nil {
+		editMsg := tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, exchangeErrorText("Ошибка получения цен", err))
+		bot.Request(editMsg)
+		return
+	}
+	// цена текущей позиции по скользящей средней: покупки до полного закрытия прошлых
+	// позиций на нее не влияют. Сделки во всех парах монеты пересчитаны в валюту отчета.
+	tradeAnalysis := spotAllPNL.AnalyzeTradeHistory(spotAllPNL.GroupTradesBySymbol(conv.Normalize(trades)), spotAllPNL.MethodAverage)
 
 	var assetsForDisplay []spotpnl.DisplayAsset
 
 	var missingSymbols []string
+	var cash float64
 	for coinName, quantityStr := range balances {
-		if coinName == "USDT" || coinName == "USDC" || coinName == "TOTAL" {
+		if coinName == "TOTAL" {
 			continue
 		}
 
@@ -338,7 +801,18 @@ func HandleBalance(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 			continue
 		}
 
-		symbol := coinName + "USDT"
+		// стейблкоины и сама валюта отчета — деньги, а не позиция: строки с PnL для них
+		// нет, но в общую стоимость они входят (BTC при отчете в BTC, USDT при отчете в EUR)
+		if conv.IsCash(coinName) {
+			if rate, ok := conv.Rate(coinName); ok {
+				cash += quantity * rate
+			} else {
+				missingSymbols = append(missingSymbols, coinName)
+			}
+			continue
+		}
+
+		symbol := coinName + conv.Currency
 		asset := spotpnl.DisplayAsset{
 			Name:     coinName,
 			Symbol:   symbol,
@@ -346,21 +820,25 @@ func HandleBalance(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 		}
 
 		if analysis, ok := tradeAnalysis[symbol]; ok {
-			asset.AvgBuyPrice = analysis.AvgBuyPrice
+			asset.AvgBuyPrice = analysis.OpenAvgPrice()
 		}
 
-		if price, ok := allPrices[symbol]; ok {
+		// без пары к валюте отчета цена считается через BTC, ETH или стейблкоины
+		if price, ok := conv.Rate(coinName); ok {
 			asset.CurrentPrice = price
 		}
 
-		// Если тикер не найден в общем списке — попробуем получить цену индивидуально и логируем
-		if asset.CurrentPrice == 0 {
-			log.Printf("[Balance] Тикер не найден в списке: %s — пробую fallback GetCurrentPrice", symbol)
-			price, err := spotpnl.GetCurrentPrice(symbol)
+		// Если тикер не найден в общем списке — попробуем получить цену к USDT на бирже
+		// первого аккаунта и пересчитать ее в валюту отчета
+		usdRate, usdOK := conv.Rate("USDT")
+		if asset.CurrentPrice == 0 && usdOK {
+			usdSymbol := coinName + "USDT"
+			log.Printf("[Balance] Тикер не найден в списке: %s — пробую fallback GetCurrentPrice", usdSymbol)
+			price, err := spotpnl.GetCurrentPrice(syncCtx, clients[0], usdSymbol)
 			if err != nil {
-				log.Printf("[Balance] Fallback не дал цену для %s: %v", symbol, err)
+				log.Printf("[Balance] Fallback не дал цену для %s: %v", usdSymbol, err)
 			} else {
-				asset.CurrentPrice = price
+				asset.CurrentPrice = price * usdRate
 			}
 		}
 
@@ -382,7 +860,9 @@ func HandleBalance(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 		assetsForDisplay = append(assetsForDisplay, asset)
 	}
 
-	finalMessage := spotpnl.FormatBalancePNLMessage(assetsForDisplay)
+	finalMessage := view.header() + spotpnl.FormatBalancePNLMessage(assetsForDisplay, cash, currency) +
+		formatSubAccountsBreakdown(view, subBalances, perAccount, conv, currency)
+	finalMessage += historyLimitNotice(chatID, view)
 	if len(missingSymbols) > 0 {
 		finalMessage = finalMessage + "\n\n⚠️ Не найдены цены для: " + strings.Join(missingSymbols, ", ")
 	}
@@ -399,37 +879,131 @@ func HandleBalance(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	bot.Request(editMsg)
 }
 
-func HandleTotalPNL(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+func HandleTotalPNL(ctx context.Context, bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	chatID := update.CallbackQuery.Message.Chat.ID
 
-	user, err := getUserAndValidateKeys(chatID)
+	view, err := getPortfolioView(chatID)
 	if err != nil {
 		sendError(bot, chatID, err.Error())
 		return
 	}
 
-	client := exchanges.NewBybitClient(user.BybitApiKey, user.BybitApiSecret)
+	cachedTrades, ok := syncTradesWithProgress(ctx, bot, chatID, view, "Считаю реализованный PnL... ⏳", false, nil)
+	if !ok {
+		return
+	}
 
-	cachedTrades, err := storage.GetAllTradesWithCache(client, chatID)
+	currency := userCurrency(chatID)
+	allTrades, err := normalizeTrades(ctx, currency, cachedTrades)
 	if err != nil {
-		sendError(bot, chatID, fmt.Sprintf("Ошибка расчета общего PNL: %v", err))
+		sendError(bot, chatID, fmt.Sprintf("Ошибка получения курсов: %v", err))
 		return
 	}
-
-	allTrades := convertToSpotAllPNLExecutions(cachedTrades)
 	allGroupes := spotAllPNL.GroupTradesBySymbol(allTrades)
-	totalPNL := spotAllPNL.AnalyzeTradeHistory(allGroupes)
-	formatTotalPNL := spotAllPNL.FormatTotalPNLMessage(totalPNL)
+	costMethod := userCostMethod(chatID)
+	totalPNL := spotAllPNL.AnalyzeTradeHistory(allGroupes, costMethod)
+	formatTotalPNL := view.header() + spotAllPNL.FormatTotalPNLMessage(totalPNL, costMethod, currency)
 
 	msg := tgbotapi.NewMessage(chatID, formatTotalPNL)
 	msg.ParseMode = "Markdown"
 	bot.Send(msg)
 }
 
+// syncTradesWithProgress обновляет кэш сделок всех аккаунтов представления, показывая
+// сообщение с кнопкой отмены, и возвращает их сделки вместе.
+// rebuild сначала удаляет кэш, и история загружается с нуля. pairs — дополнительные
+// пары для бирж, где история запрашивается по каждой паре (Binance).
+// При ошибке или отмене сообщает об этом пользователю и возвращает false.
+func syncTradesWithProgress(ctx context.Context, bot *tgbotapi.BotAPI, chatID int64, view portfolioView, progressText string, rebuild bool, pairs []string) ([]spotpnl.Execution, bool) {
+	clients, err := view.clients()
+	if err != nil {
+		sendError(bot, chatID, err.Error())
+		return nil, false
+	}
+	if notice := queueNoticeAll(clients); notice != "" {
+		bot.Send(tgbotapi.NewMessage(chatID, notice))
+	}
+
+	progressMsg := tgbotapi.NewMessage(chatID, progressText)
+	progressMsg.ReplyMarkup = createCancelSyncKeyboard()
+	sentMsg, _ := bot.Send(progressMsg)
+
+	syncCtx, done, ok := startSync(ctx, chatID)
+	if !ok {
+		bot.Request(tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, "⏳ Синхронизация истории уже идет, дождитесь ее завершения"))
+		return nil, false
+	}
+	defer done()
+
+	for i, account := range view.accounts {
+		setter, perPair := clients[i].(exchanges.KnownTradesSetter)
+		if perPair {
+			setter.SetKnownTrades(pairs, nil)
+		}
+		if rebuild {
+			// пары удаляемых сделок нужны и после очистки: монет, проданных полностью,
+			// на балансе нет, и по-другому биржа их не найдет
+			if perPair {
+				lastIDs, err := storage.GetLastTradeIDs(chatID, account.AccountID)
+				if err != nil {
+					log.Printf("[Cache] Ошибка чтения пар сделок: %v", err)
+				}
+				known := make([]string, 0, len(lastIDs))
+				for symbol := range lastIDs {
+					known = append(known, symbol)
+				}
+				setter.SetKnownTrades(known, nil)
+			}
+			if err := storage.ClearTradesCache(chatID, account.AccountID); err != nil {
+				bot.Request(tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, fmt.Sprintf("❌ Ошибка очистки кэша: %v", err)))
+				return nil, false
+			}
+		}
+		if err := storage.SyncTrades(syncCtx, clients[i], chatID, account.AccountID); err != nil {
+			bot.Request(tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, view.accountPrefix(account)+syncErrorText(err)))
+			return nil, false
+		}
+	}
+
+	trades, err := storage.GetAccountsExecutions(chatID, view.accountIDs(), "", 0, 0)
+	if err != nil {
+		bot.Request(tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, fmt.Sprintf("❌ Ошибка чтения сделок: %v", err)))
+		return nil, false
+	}
+
+	// убираем кнопку отмены — синхронизация завершена
+	bot.Request(tgbotapi.NewEditMessageText(chatID, sentMsg.MessageID, progressText+historyLimitNotice(chatID, view)))
+	return trades, true
+}
+
+// HandleResync загружает историю сделок заново — на случай, если кэш разошелся с биржей.
+// Пары после команды (/resync SOLUSDT ADAUSDT) добавляются к синхронизации на биржах,
+// где история запрашивается по парам: так находятся монеты, проданные до подключения.
+func HandleResync(ctx context.Context, bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+	chatID := getChatID(update)
+	var pairs []string
+	if update.Message != nil {
+		pairs = strings.Fields(strings.ToUpper(update.Message.CommandArguments()))
+	}
+
+	view, err := getPortfolioView(chatID)
+	if err != nil {
+		sendError(bot, chatID, err.Error())
+		return
+	}
+
+	runAsync(func() {
+		trades, ok := syncTradesWithProgress(ctx, bot, chatID, view, "Загружаю историю сделок заново... ⏳", true, pairs)
+		if ok {
+			bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("✅ История пересобрана, сделок: %d", len(trades))))
+		}
+	})
+}
+
 func HandleSettings(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	chatID := getChatID(update)
 	userSettings, _ := storage.GetUserSettings(chatID)
-	editMenuMessage(bot, update, "Здесь вы можете управлять настройками:", CreateSettingsMenuKeyboard(userSettings.NotificationsEnabled))
+	editMenuMessage(bot, update, "Здесь вы можете управлять настройками:", CreateSettingsMenuKeyboard(userSettings))
 }
 
 func HandleBackToMainMenu(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
@@ -535,6 +1109,7 @@ func HandleDeleteAlert(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 		bot.Send(msg)
 		return
 	}
+	notifyAlertsChanged()
 
 	// Показываем уведомление
 	answerCallback := tgbotapi.NewCallback(update.CallbackQuery.ID, "✅ Алерт удалён")
@@ -544,12 +1119,15 @@ func HandleDeleteAlert(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	ShowAlertsList(bot, update)
 }
 
-func CreateAlertFromText(bot *tgbotapi.BotAPI, update tgbotapi.Update, symbolPart, pricePart string) {
+func CreateAlertFromText(ctx context.Context, bot *tgbotapi.BotAPI, update tgbotapi.Update, symbolPart, pricePart string) {
 	chatID := update.Message.Chat.ID
 
-	symbol := strings.ToUpper(symbolPart)
-	if !strings.HasSuffix(symbol, "USDT") {
-		symbol += "USDT"
+	// «ETHBTC» — пара целиком, «BTC» — монета к USDT. «WBTC» похож на пару W/BTC,
+	// поэтому если такой пары нет, пробуем монету к USDT.
+	input := strings.ToUpper(symbolPart)
+	candidates := []string{input + "USDT"}
+	if _, _, ok := exchanges.SplitSymbol(input); ok {
+		candidates = []string{input, input + "USDT"}
 	}
 
 	targetPrice, err := strconv.ParseFloat(pricePart, 64)
@@ -557,9 +1135,17 @@ func CreateAlertFromText(bot *tgbotapi.BotAPI, update tgbotapi.Update, symbolPar
 		bot.Send(tgbotapi.NewMessage(chatID, "Ошибка: неверный формат цены."))
 		return
 	}
-	currentPrice, err := spotpnl.GetCurrentPrice(symbol)
-	if err != nil {
-		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Не удалось получить цену для %s.", symbol)))
+
+	var symbol string
+	var currentPrice float64
+	for _, candidate := range candidates {
+		if currentPrice, err = spotpnl.GetCurrentPrice(ctx, newPublicExchangeClient(), candidate); err == nil {
+			symbol = candidate
+			break
+		}
+	}
+	if symbol == "" {
+		bot.Send(tgbotapi.NewMessage(chatID, fmt.Sprintf("Не удалось получить цену для %s.", input)))
 		return
 	}
 
@@ -575,151 +1161,470 @@ func CreateAlertFromText(bot *tgbotapi.BotAPI, update tgbotapi.Update, symbolPar
 		bot.Send(tgbotapi.NewMessage(chatID, "Произошла внутренняя ошибка. Попробуйте позже."))
 		return
 	}
+	notifyAlertsChanged()
 
-	responseText := fmt.Sprintf("✅ Алерт создан!\n\nМонета: %s\nЦелевая цена: %.2f$", symbol, targetPrice)
+	responseText := fmt.Sprintf("✅ Алерт создан!\n\nМонета: %s\nЦелевая цена: %s", symbol, formatAlertPrice(symbol, targetPrice))
 	bot.Send(tgbotapi.NewMessage(chatID, responseText))
 }
 
-func StartAlertChecker(bot *tgbotapi.BotAPI) {
-	ticker := time.NewTicker(180 * time.Second)
+// usdQuotes — котировки, цена в которых показывается в долларах
+var usdQuotes = map[string]bool{"USDT": true, "USDC": true, "FDUSD": true, "DAI": true}
+
+// formatAlertPrice — цена в котировке пары: «71000.00$» для пар к стейблкоинам,
+// «0.05123 BTC» для ETHBTC. Знаков после точки столько, сколько есть у цены, но не меньше
+// двух: у пар с маленькой ценой округление до центов теряло бы всю цену.
+func formatAlertPrice(symbol string, price float64) string {
+	amount := strconv.FormatFloat(price, 'f', -1, 64)
+	if dot := strings.IndexByte(amount, '.'); dot < 0 {
+		amount += ".00"
+	} else if len(amount)-dot-1 < 2 {
+		amount += "0"
+	}
 
-	for range ticker.C {
-		CheckAndTriggerAlerts(bot)
+	_, quote, ok := exchanges.SplitSymbol(symbol)
+	if !ok || usdQuotes[quote] {
+		return amount + "$"
 	}
+	return amount + " " + quote
 }
 
-func StartPortfolioNotifier(bot *tgbotapi.BotAPI) {
-	ticker := time.NewTicker(23 * time.Hour)
+// активные алерты в памяти по символам: поток цен проверяет их на каждом тике
+var (
+	alertsMu     sync.Mutex
+	alertsCache  map[string][]storage.AlertInfo
+	alertsStream *exchanges.PriceStream
+	// сработавшие алерты, которые еще не отключены в базе: перечитывание их пропускает
+	alertsPending = make(map[int]bool)
+	// сигнал перечитать алерты из базы после создания или удаления
+	alertsChanged = make(chan struct{}, 1)
+	// сработавшие алерты ждут отключения в базе и отправки сообщения в отдельной горутине,
+	// чтобы запись в базу и Telegram не задерживали поток цен и меню алертов
+	alertsFired = make(chan []firedAlert, 64)
+)
 
-	log.Println("⏰ Запланирован запуск проверки портфеля каждые 23 часа")
+type firedAlert struct {
+	alert storage.AlertInfo
+	price float64
+}
 
-	for range ticker.C {
-		processAndSendNotifications(bot)
+func notifyAlertsChanged() {
+	select {
+	case alertsChanged <- struct{}{}:
+	default:
 	}
 }
 
-func CheckAndTriggerAlerts(bot *tgbotapi.BotAPI) {
-
-	activeAlerts, err := storage.GetAllActiveAlerts()
-	if err != nil || len(activeAlerts) == 0 {
-		return
+// StartAlertChecker подписывается на поток цен Bybit по символам с активными алертами
+// и проверяет их на каждом обновлении. Раз в 180 секунд алерты дополнительно сверяются
+// с ценами из REST — на случай, если поток недоступен.
+func StartAlertChecker(ctx context.Context, bot *tgbotapi.BotAPI) {
+	stream := exchanges.NewPriceStream(exchanges.BybitPublicWSURL())
+	stream.OnPrice = func(symbol string, price float64) {
+		evaluateAlerts(map[string]float64{symbol: price})
 	}
 
-	client := exchanges.NewBybitClient("", "")
+	alertsMu.Lock()
+	alertsStream = stream
+	alertsMu.Unlock()
+	reloadAlerts()
 
-	// Retry логика для получения цен
-	var currentPrices map[string]float64
-	maxRetries := 3
+	go deliverFiredAlerts(ctx, bot)
+	go stream.Run(ctx)
 
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		currentPrices, err = client.GetAllMarketPrices()
-		if err == nil {
-			break // Успешно получили цены
-		}
+	ticker := time.NewTicker(180 * time.Second)
+	defer ticker.Stop()
 
-		if attempt < maxRetries {
-			log.Printf("⚠️  Попытка %d/%d: Ошибка получения цен для алертов: %v. Повтор через 5 сек...", attempt, maxRetries, err)
-			time.Sleep(5 * time.Second)
-		} else {
-			log.Printf("❌ Не удалось получить цены после %d попыток: %v", maxRetries, err)
+	for {
+		select {
+		case <-ctx.Done():
 			return
+		case <-alertsChanged:
+			reloadAlerts()
+		case <-ticker.C:
+			checkCtx, cancel := context.WithTimeout(ctx, 60*time.Second)
+			CheckAndTriggerAlerts(checkCtx)
+			cancel()
 		}
 	}
+}
+
+// reloadAlerts перечитывает активные алерты из базы и обновляет подписки потока.
+// База читается под alertsMu: иначе прочитанный до срабатывания алерт вернулся бы в память.
+func reloadAlerts() {
+	alertsMu.Lock()
+	activeAlerts, err := storage.GetAllActiveAlerts()
+	if err != nil {
+		alertsMu.Unlock()
+		log.Printf("❌ Не удалось загрузить алерты: %v", err)
+		return
+	}
 
+	bySymbol := make(map[string][]storage.AlertInfo)
 	for _, alert := range activeAlerts {
+		if alertsPending[alert.ID] {
+			continue
+		}
+		bySymbol[alert.Symbol] = append(bySymbol[alert.Symbol], alert)
+	}
+	symbols := make([]string, 0, len(bySymbol))
+	for symbol := range bySymbol {
+		symbols = append(symbols, symbol)
+	}
+
+	alertsCache = bySymbol
+	stream := alertsStream
+	alertsMu.Unlock()
+
+	if stream != nil {
+		stream.SetSymbols(symbols)
+	}
+}
+
+// CheckAndTriggerAlerts сверяет все активные алерты с текущими ценами из REST
+func CheckAndTriggerAlerts(ctx context.Context) {
+	reloadAlerts()
 
-		currentPrice, ok := currentPrices[alert.Symbol]
+	alertsMu.Lock()
+	empty := len(alertsCache) == 0
+	alertsMu.Unlock()
+	if empty {
+		return
+	}
+
+	client := newPublicExchangeClient()
+
+	// повторы и лимиты учитывает сам клиент биржи
+	currentPrices, err := client.GetAllMarketPrices(ctx)
+	if err != nil {
+		log.Printf("❌ Не удалось получить цены для алертов: %v", err)
+		return
+	}
+
+	evaluateAlerts(currentPrices)
+}
+
+// evaluateAlerts проверяет алерты по переданным ценам. Сработавший алерт под alertsMu
+// убирается из памяти и помечается ожидающим отключения, поэтому ни поток, ни
+// REST-проверка, ни перечитывание алертов не отправят его дважды. Запись в базу и
+// сообщение делает deliverFiredAlerts.
+func evaluateAlerts(prices map[string]float64) {
+	var fired []firedAlert
+
+	alertsMu.Lock()
+	for symbol, currentPrice := range prices {
+		alerts, ok := alertsCache[symbol]
 		if !ok {
 			continue
 		}
 
-		triggered := false
-		if alert.Direction == "up" && currentPrice >= alert.TargetPrice {
-			triggered = true
-		} else if alert.Direction == "down" && currentPrice <= alert.TargetPrice {
-			triggered = true
+		remaining := alerts[:0]
+		for _, alert := range alerts {
+			triggered := false
+			if alert.Direction == "up" && currentPrice >= alert.TargetPrice {
+				triggered = true
+			} else if alert.Direction == "down" && currentPrice <= alert.TargetPrice {
+				triggered = true
+			}
+			if !triggered {
+				remaining = append(remaining, alert)
+				continue
+			}
+			alertsPending[alert.ID] = true
+			fired = append(fired, firedAlert{alert: alert, price: currentPrice})
+		}
+		if len(remaining) == 0 {
+			delete(alertsCache, symbol)
+		} else {
+			alertsCache[symbol] = remaining
+		}
+	}
+	alertsMu.Unlock()
+
+	if len(fired) > 0 {
+		alertsFired <- fired
+	}
+}
+
+// deliverFiredAlerts отключает сработавшие алерты в базе и сообщает о них пользователям.
+// Алерт, который не удалось отключить, вернется в память при следующем перечитывании
+// и сработает снова; сообщение о нем не отправляется.
+func deliverFiredAlerts(ctx context.Context, bot *tgbotapi.BotAPI) {
+	for {
+		var fired []firedAlert
+		select {
+		case <-ctx.Done():
+			return
+		case fired = <-alertsFired:
 		}
-		if triggered {
+
+		for _, f := range fired {
+			err := storage.DeactivateAlert(f.alert.ID)
+			alertsMu.Lock()
+			delete(alertsPending, f.alert.ID)
+			alertsMu.Unlock()
+			if err != nil {
+				log.Printf("❌ Не удалось отключить алерт %d: %v", f.alert.ID, err)
+				continue
+			}
+
 			text := fmt.Sprintf(
-				"🔔 Сработал алерт! 🔔\n\nМонета: *%s*\nЦена достигла: *%.2f$*",
-				alert.Symbol,
-				currentPrice,
+				"🔔 Сработал алерт! 🔔\n\nМонета: *%s*\nЦена достигла: *%s*",
+				f.alert.Symbol,
+				formatAlertPrice(f.alert.Symbol, f.price),
 			)
-			msg := tgbotapi.NewMessage(alert.UserID, text)
+			msg := tgbotapi.NewMessage(f.alert.UserID, text)
 			msg.ParseMode = "Markdown"
 			bot.Send(msg)
+		}
+		// отписываемся от символов, по которым алертов не осталось, и возвращаем
+		// в память алерты, которые не удалось отключить
+		notifyAlertsChanged()
+	}
+}
+
+// приватные потоки исполнений по аккаунтам Bybit, ключ — id аккаунта
+type userStream struct {
+	stream *exchanges.ExecutionStream
+	cancel context.CancelFunc
+}
+
+var (
+	userStreamsMu sync.Mutex
+	userStreams   = make(map[int64]*userStream)
+	// контекст работы бота, от него запускаются потоки при сохранении новых ключей
+	streamsCtx context.Context
+)
+
+// StartExecutionStreams подключает приватные потоки всех аккаунтов Bybit
+func StartExecutionStreams(ctx context.Context, bot *tgbotapi.BotAPI) {
+	userStreamsMu.Lock()
+	streamsCtx = ctx
+	userStreamsMu.Unlock()
+
+	users, err := storage.GetUsersWithKeys(exchanges.ExchangeBybit)
+	if err != nil {
+		log.Printf("❌ Не удалось загрузить пользователей для потоков: %v", err)
+		return
+	}
+	for _, user := range users {
+		startUserStream(bot, user)
+	}
+	log.Printf("Запущено приватных потоков Bybit: %d", len(users))
+}
+
+// startUserStream (пере)запускает поток аккаунта; для других бирж только останавливает старый
+func startUserStream(bot *tgbotapi.BotAPI, user storage.User) {
+	userStreamsMu.Lock()
+	defer userStreamsMu.Unlock()
+
+	if old, ok := userStreams[user.AccountID]; ok {
+		old.cancel()
+		delete(userStreams, user.AccountID)
+	}
+	if streamsCtx == nil || (user.Exchange != "" && user.Exchange != exchanges.ExchangeBybit) {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(streamsCtx)
+	us := &userStream{
+		stream: exchanges.NewExecutionStream(user.ApiKey, user.ApiSecret),
+		cancel: cancel,
+	}
+	us.stream.OnConnect = func() {
+		go syncAfterReconnect(ctx, user)
+	}
+	us.stream.OnExecutions = func(fills []exchanges.Execution) {
+		handleLiveFills(bot, user, fills)
+	}
+	userStreams[user.AccountID] = us
+
+	go func() {
+		if err := us.stream.Run(ctx); err != nil && ctx.Err() == nil {
+			log.Printf("[Stream] Поток аккаунта %d пользователя %d остановлен: %v", user.AccountID, user.UserID, err)
+		}
+	}()
+}
+
+// syncAfterReconnect догружает сделки, прошедшие, пока потока не было. Первую загрузку
+// истории не запускаем — она долгая и начнется, когда пользователь откроет портфель.
+func syncAfterReconnect(ctx context.Context, user storage.User) {
+	if lastUpdate, err := storage.GetTradesSyncTime(user.UserID, user.AccountID); err != nil || lastUpdate == 0 {
+		return
+	}
+	client, err := newExchangeClient(user)
+	if err != nil {
+		return
+	}
+
+	syncCtx, done, ok := startSync(ctx, user.UserID)
+	if !ok {
+		// синхронизацию уже запустил пользователь
+		return
+	}
+	defer done()
+
+	if err := storage.SyncTrades(syncCtx, client, user.UserID, user.AccountID); err != nil {
+		log.Printf("[Stream] Ошибка синхронизации после подключения для %d: %v", user.UserID, err)
+	}
+}
+
+func handleLiveFills(bot *tgbotapi.BotAPI, user storage.User, fills []exchanges.Execution) {
+	chatID := user.UserID
+	appended, err := storage.AppendTradesToCache(chatID, user.AccountID, fills)
+	if err != nil {
+		log.Printf("[Stream] Ошибка записи сделок в кэш для %d: %v", chatID, err)
+	} else if appended {
+		log.Printf("[Stream] Добавлено %d сделок в кэш пользователя %d", len(fills), chatID)
+	}
 
-			storage.DeactivateAlert(alert.ID)
+	settings, err := storage.GetUserSettings(chatID)
+	if err != nil || !settings.FillNotifications {
+		return
+	}
+	// при нескольких аккаунтах подписываем, на каком прошла сделка
+	suffix := ""
+	if accounts, err := storage.GetAccounts(chatID); err == nil && len(accounts) > 1 {
+		suffix = "\n👤 " + accountLabel(user)
+	}
+	for _, fill := range fills {
+		bot.Send(tgbotapi.NewMessage(chatID, formatFill(fill)+suffix))
+	}
+}
+
+// formatFill — «✅ Исполнено: BUY 0.1 BTC @ 61000 USDT»
+func formatFill(fill exchanges.Execution) string {
+	asset, quote := fill.Symbol, ""
+	if base, q, ok := exchanges.SplitSymbol(fill.Symbol); ok {
+		asset, quote = base, " "+q
+	}
+	return fmt.Sprintf("✅ Исполнено: %s %s %s @ %s%s", strings.ToUpper(fill.Side), fill.Quantity, asset, fill.Price, quote)
+}
+
+// liveBalances — баланс аккаунта из приватного потока, если он подключен и уже присылал кошелек
+func liveBalances(accountID int64) (map[string]string, bool) {
+	userStreamsMu.Lock()
+	us, ok := userStreams[accountID]
+	userStreamsMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return us.stream.Balances()
+}
+
+func StartPortfolioNotifier(ctx context.Context, bot *tgbotapi.BotAPI) {
+	ticker := time.NewTicker(23 * time.Hour)
+	defer ticker.Stop()
+
+	log.Println("⏰ Запланирован запуск проверки портфеля каждые 23 часа")
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			processAndSendNotifications(ctx, bot)
 		}
 	}
 }
 
-func HandleExportCSV(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+func HandleExportCSV(ctx context.Context, bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	chatID := update.CallbackQuery.Message.Chat.ID
-	bot.Send(tgbotapi.NewMessage(chatID, "Готовлю отчет для экспорта... ⏳"))
 
-	user, err := getUserAndValidateKeys(chatID)
+	view, err := getPortfolioView(chatID)
 	if err != nil {
 		sendError(bot, chatID, err.Error())
 		return
 	}
 
-	client := exchanges.NewBybitClient(user.BybitApiKey, user.BybitApiSecret)
+	cachedTrades, ok := syncTradesWithProgress(ctx, bot, chatID, view, "Готовлю отчет для экспорта... ⏳", false, nil)
+	if !ok {
+		return
+	}
 
-	cachedTrades, err := storage.GetAllTradesWithCache(client, chatID)
+	currency := userCurrency(chatID)
+	allTrades, err := normalizeTrades(ctx, currency, cachedTrades)
 	if err != nil {
-		sendError(bot, chatID, fmt.Sprintf("Ошибка расчета общего PNL: %v", err))
+		sendError(bot, chatID, fmt.Sprintf("Ошибка получения курсов: %v", err))
 		return
 	}
-
-	allTrades := convertToSpotAllPNLExecutions(cachedTrades)
 	allGroupes := spotAllPNL.GroupTradesBySymbol(allTrades)
-	totalPNL := spotAllPNL.AnalyzeTradeHistory(allGroupes)
+	costMethod := userCostMethod(chatID)
+	totalPNL := spotAllPNL.AnalyzeTradeHistory(allGroupes, costMethod)
 
-	csvData, err := spotAllPNL.ExportToCSV(totalPNL)
+	csvData, err := spotAllPNL.ExportToCSV(totalPNL, currency)
 	if err != nil {
 		sendError(bot, chatID, fmt.Sprintf("Ошибка при создании CSV: %v", err))
 		return
 	}
 
-	fileName := fmt.Sprintf("bybit_pnl_report_%s.csv", time.Now().Format("2006-01-02"))
+	reportName := view.accounts[0].Exchange
+	if view.accountID == storage.AllAccounts {
+		reportName = "all_accounts"
+	}
+	fileName := fmt.Sprintf("%s_pnl_report_%s.csv", reportName, time.Now().Format("2006-01-02"))
 	fileBytes := tgbotapi.FileBytes{
 		Name:  fileName,
 		Bytes: csvData,
 	}
 	document := tgbotapi.NewDocument(chatID, fileBytes)
-	document.Caption = "Ваш отчет по реализованному PnL готов."
+	document.Caption = fmt.Sprintf("Ваш отчет по реализованному PnL готов. Суммы в %s.", currency.Code)
 	bot.Send(document)
+
+	lotsData, err := spotAllPNL.ExportDisposalsCSV(totalPNL, currency)
+	if err != nil {
+		sendError(bot, chatID, fmt.Sprintf("Ошибка при создании CSV: %v", err))
+		return
+	}
+	lotsDocument := tgbotapi.NewDocument(chatID, tgbotapi.FileBytes{
+		Name:  fmt.Sprintf("%s_pnl_lots_%s.csv", reportName, time.Now().Format("2006-01-02")),
+		Bytes: lotsData,
+	})
+	lotsDocument.Caption = fmt.Sprintf("Продажи по лотам, метод %s: даты покупки и продажи, себестоимость, выручка и срок владения.", costMethod.Title())
+	bot.Send(lotsDocument)
 }
 
-func HandleBarChart(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+func HandleBarChart(ctx context.Context, bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	chatID := update.CallbackQuery.Message.Chat.ID
 	bot.Send(tgbotapi.NewMessage(chatID, "Рисую диаграмму... 🎨"))
 
-	user, err := getUserAndValidateKeys(chatID)
+	view, err := getPortfolioView(chatID)
 	if err != nil {
 		sendError(bot, chatID, err.Error())
 		return
 	}
 
-	client := exchanges.NewBybitClient(user.BybitApiKey, user.BybitApiSecret)
-
-	balances, err := client.GetSpotBalance()
+	clients, err := view.clients()
 	if err != nil {
-		sendError(bot, chatID, fmt.Sprintf("Ошибка получения баланса: %v", err))
+		sendError(bot, chatID, err.Error())
 		return
 	}
 
-	tickers, err := client.GetMarketTickers("spot")
+	if notice := queueNoticeAll(clients); notice != "" {
+		bot.Send(tgbotapi.NewMessage(chatID, notice))
+	}
+
+	balances := make(map[string]string)
+	for i, client := range clients {
+		accountBalances, err := client.GetSpotBalance(ctx)
+		if err != nil {
+			bot.Send(tgbotapi.NewMessage(chatID, view.accountPrefix(view.accounts[i])+exchangeErrorText("Ошибка получения баланса", err)))
+			return
+		}
+		mergeBalances(balances, accountBalances)
+	}
+
+	currency := userCurrency(chatID)
+	conv, err := newConverter(ctx, currency, nil)
 	if err != nil {
-		sendError(bot, chatID, fmt.Sprintf("Ошибка получения цен: %v", err))
+		bot.Send(tgbotapi.NewMessage(chatID, exchangeErrorText("Ошибка получения цен", err)))
 		return
 	}
 
 	assetValues := make(map[string]float64)
 
 	for coinName, quantityStr := range balances {
-		if coinName == "USDT" || coinName == "USDC" || coinName == "TOTAL" {
+		// стейблкоины и сама валюта отчета — деньги, а не позиция: на диаграмме только позиции
+		if conv.IsCash(coinName) || coinName == "TOTAL" {
 			continue
 		}
 
@@ -728,20 +1633,14 @@ func HandleBarChart(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 			continue
 		}
 
-		symbol := coinName + "USDT"
-		var currentPrice float64
-
-		if ticker, ok := tickers[symbol]; ok {
-			currentPrice, _ = strconv.ParseFloat(ticker.LastPrice, 64)
-		}
-
+		currentPrice, _ := conv.Rate(coinName)
 		if currentPrice > 0 {
 			currentValue := quantity * currentPrice
 			assetValues[coinName] = currentValue
 		}
 	}
 
-	chartImage, err := spotpnl.GeneratePortfolioBarChart(assetValues)
+	chartImage, err := spotpnl.GeneratePortfolioBarChart(assetValues, currency)
 	if err != nil {
 		sendError(bot, chatID, fmt.Sprintf("Ошибка создания диаграммы: %v", err))
 		return
@@ -757,7 +1656,7 @@ func HandleBarChart(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
 	bot.Send(photoMsg)
 }
 
-func processAndSendNotifications(bot *tgbotapi.BotAPI) {
+func processAndSendNotifications(ctx context.Context, bot *tgbotapi.BotAPI) {
 	log.Println("🔍 Запуск проверки для PnL-уведомлений...")
 
 	users, err := storage.GetUsersWithNotificationsEnabled()
@@ -771,74 +1670,129 @@ func processAndSendNotifications(bot *tgbotapi.BotAPI) {
 		return
 	}
 
-	log.Printf("✅ Найдено пользователей для уведомлений: %d", len(users))
+	log.Printf("✅ Найдено аккаунтов для уведомлений: %d", len(users))
 
-	client := exchanges.NewBybitClient("", "")
-
-	// Retry логика для получения цен
-	var allPrices map[string]float64
-	maxRetries := 3
-
-	for attempt := 1; attempt <= maxRetries; attempt++ {
-		allPrices, err = client.GetAllMarketPrices()
-		if err == nil {
-			break // Успешно получили цены
-		}
+	allPrices, err := currentRateSource().Prices(ctx)
+	if err != nil {
+		log.Printf("❌ Не удалось получить цены для уведомлений: %v", err)
+		return
+	}
 
-		if attempt < maxRetries {
-			log.Printf("⚠️  Попытка %d/%d: Ошибка получения цен для уведомлений: %v. Повтор через 5 сек...", attempt, maxRetries, err)
-			time.Sleep(5 * time.Second)
-		} else {
-			log.Printf("❌ Не удалось получить цены после %d попыток: %v", maxRetries, err)
-			return
+	// уведомление — по всему портфелю пользователя, суммируем все его аккаунты
+	accountsByUser := make(map[int64][]storage.User)
+	var userIDs []int64
+	for _, user := range users {
+		if _, ok := accountsByUser[user.UserID]; !ok {
+			userIDs = append(userIDs, user.UserID)
 		}
+		accountsByUser[user.UserID] = append(accountsByUser[user.UserID], user)
 	}
 
-	for _, user := range users {
-		log.Printf("📊 Обработка пользователя %d...", user.UserID)
+	for _, userID := range userIDs {
+		log.Printf("📊 Обработка пользователя %d...", userID)
 
-		client := exchanges.NewBybitClient(user.ApiKey, user.ApiSecret)
+		if ctx.Err() != nil {
+			log.Println("⏹ Проверка для PnL-уведомлений прервана.")
+			return
+		}
 
-		balances, err := client.GetSpotBalance()
-		if err != nil {
-			log.Printf("❌ Ошибка получения баланса для user %d: %v", user.UserID, err)
+		currency := userCurrency(userID)
+		conv := rates.NewConverter(currency.Coin, allPrices)
+		currentValue, ok := accountsValue(ctx, accountsByUser[userID], conv)
+		if !ok {
+			// без одного из аккаунтов сумма занижена, снимок не сохраняем
 			continue
 		}
-
-		currentValue := calculateTotalValue(balances, allPrices)
-		log.Printf("💰 Текущая стоимость портфеля user %d: %.2f$", user.UserID, currentValue)
-
-		storage.SavePortfolioSnapshot(user.UserID, currentValue)
-		log.Printf("💾 Снимок портфеля сохранен для user %d", user.UserID)
+		log.Printf("💰 Текущая стоимость портфеля user %d: %s", userID, currency.Format(currentValue))
 
 		twentyThreeHoursAgo := time.Now().Add(-23 * time.Hour).Unix()
-		previousValue, err := storage.GetLatestSnapshotBefore(user.UserID, twentyThreeHoursAgo)
+		previousValue, previousCurrency, err := storage.GetLatestSnapshotBefore(userID, twentyThreeHoursAgo)
+		if err == nil && previousCurrency != currency.Code {
+			// валюту сменили после снимка — пересчитываем его по текущему курсу;
+			// без курса сравнивать не с чем
+			rate, _ := conv.Rate(rates.ParseCurrency(previousCurrency).Coin)
+			previousValue *= rate
+		}
+
+		storage.SavePortfolioSnapshot(userID, currentValue, currency.Code)
+		log.Printf("💾 Снимок портфеля сохранен для user %d", userID)
 
 		if err == nil && previousValue > 0 {
 			diffValue := currentValue - previousValue
 			diffPercent := (diffValue / previousValue) * 100
-			log.Printf("📈 Изменение для user %d: %.2f$ (%.2f%%)", user.UserID, diffValue, diffPercent)
-			sendNotification(bot, user.UserID, currentValue, diffValue, diffPercent)
+			log.Printf("📈 Изменение для user %d: %s (%.2f%%)", userID, currency.Format(diffValue), diffPercent)
+			sendNotification(bot, userID, currency, currentValue, diffValue, diffPercent)
 		} else {
-			log.Printf("ℹ️  Для user %d нет предыдущего снимка или ошибка: %v", user.UserID, err)
+			log.Printf("ℹ️  Для user %d нет предыдущего снимка или ошибка: %v", userID, err)
 		}
 	}
 	log.Println("✅ Проверка для PnL-уведомлений завершена.")
 }
 
-func calculateTotalValue(balances map[string]string, prices map[string]float64) float64 {
+// accountsValue — суммарная стоимость аккаунтов пользователя вместе с субаккаунтами
+// без своих ключей; false, если баланс какого-то аккаунта получить не удалось
+func accountsValue(ctx context.Context, accounts []storage.User, conv *rates.Converter) (float64, bool) {
+	var total float64
+	perAccount := make(map[int64]map[string]string)
+	for _, account := range accounts {
+		client, err := newExchangeClient(account)
+		if err != nil {
+			log.Printf("❌ Ошибка создания клиента биржи для user %d: %v", account.UserID, err)
+			return 0, false
+		}
+
+		accountCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+		balances, err := client.GetSpotBalance(accountCtx)
+		cancel()
+		if err != nil {
+			log.Printf("❌ Ошибка получения баланса для user %d (аккаунт %d): %v", account.UserID, account.AccountID, err)
+			return 0, false
+		}
+		total += calculateTotalValue(balances, conv)
+		perAccount[account.AccountID] = balances
+	}
+
+	// субаккаунты с ключами уже посчитаны выше, остальные — по ключу мастер-аккаунта,
+	// как в сводном балансе
+	view := portfolioView{accounts: accounts, accountID: storage.AllAccounts, total: len(accounts)}
+	subCtx, cancel := context.WithTimeout(ctx, 2*time.Minute)
+	defer cancel()
+	subAccounts, err := masterSubAccounts(subCtx, view)
+	if err != nil {
+		log.Printf("❌ Ошибка получения субаккаунтов для user %d: %v", accounts[0].UserID, err)
+		return 0, false
+	}
+	subBalances, err := subAccountsBalances(subCtx, view, subAccounts, perAccount)
+	if err != nil {
+		log.Printf("❌ Ошибка получения балансов субаккаунтов для user %d: %v", accounts[0].UserID, err)
+		return 0, false
+	}
+	for _, entries := range subBalances {
+		for _, entry := range entries {
+			if !entry.hasKey {
+				total += calculateTotalValue(entry.balances, conv)
+			}
+		}
+	}
+	return total, true
+}
+
+// calculateTotalValue — стоимость монет в валюте отчета, включая стейблкоины
+func calculateTotalValue(balances map[string]string, conv *rates.Converter) float64 {
 	var totalValue float64
 	for coin, qtyStr := range balances {
+		if coin == "TOTAL" {
+			continue
+		}
 		qty, _ := strconv.ParseFloat(qtyStr, 64)
-		price, ok := prices[coin+"USDT"]
-		if ok {
-			totalValue += qty * price
+		if rate, ok := conv.Rate(coin); ok {
+			totalValue += qty * rate
 		}
 	}
 	return totalValue
 }
 
-func sendNotification(bot *tgbotapi.BotAPI, userID int64, currentValue, diffValue, diffPercent float64) {
+func sendNotification(bot *tgbotapi.BotAPI, userID int64, currency rates.Currency, currentValue, diffValue, diffPercent float64) {
 	sign := "+"
 	emoji := "📈"
 	if diffValue < 0 {
@@ -848,9 +1802,9 @@ func sendNotification(bot *tgbotapi.BotAPI, userID int64, currentValue, diffValu
 
 	text := fmt.Sprintf(
 		"%s *Ежедневная сводка по портфелю*\n\n"+
-			"За последние 24 часа ваш портфель изменился на *%s%.2f$ (%.2f%%)*.\n\n"+
-			"Текущая стоимость: *%.2f$*",
-		emoji, sign, diffValue, diffPercent, currentValue,
+			"За последние 24 часа ваш портфель изменился на *%s%s (%.2f%%)*.\n\n"+
+			"Текущая стоимость: *%s*",
+		emoji, sign, currency.Format(diffValue), diffPercent, currency.Format(currentValue),
 	)
 
 	msg := tgbotapi.NewMessage(userID, text)
@@ -0,0 +1,291 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"telegram-date-bot/exchanges"
+	"telegram-date-bot/rates"
+	"telegram-date-bot/storage"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// subAccountBalance — субаккаунт мастер-аккаунта в сводном балансе
+type subAccountBalance struct {
+	sub      exchanges.SubAccount
+	balances map[string]string
+	// hasKey — ключ субаккаунта сохранен отдельным аккаунтом и входит в отчет:
+	// баланс берется по нему, а сделки учитываются в средней цене
+	hasKey bool
+}
+
+// discoverSubAccounts получает субаккаунты мастер-аккаунтов представления, у которых
+// включен показ субаккаунтов, и привязывает к ним аккаунты пользователя с ключами
+// этих субаккаунтов. Если привязки изменились, представление перечитывается.
+func discoverSubAccounts(ctx context.Context, chatID int64, view portfolioView) (portfolioView, map[int64][]exchanges.SubAccount, error) {
+	found, err := masterSubAccounts(ctx, view)
+	if err != nil {
+		return view, nil, err
+	}
+
+	changed := 0
+	for accountID, subs := range found {
+		uids := make([]string, 0, len(subs))
+		for _, sub := range subs {
+			uids = append(uids, sub.UID)
+		}
+		n, err := storage.LinkSubAccounts(chatID, accountID, uids)
+		if err != nil {
+			return view, nil, err
+		}
+		changed += n
+	}
+
+	if changed > 0 {
+		refreshed, err := getPortfolioView(chatID)
+		if err != nil {
+			return view, nil, err
+		}
+		view = refreshed
+	}
+	return view, found, nil
+}
+
+// masterSubAccounts — субаккаунты мастер-аккаунтов представления с включенным
+// показом субаккаунтов, по id мастер-аккаунта
+func masterSubAccounts(ctx context.Context, view portfolioView) (map[int64][]exchanges.SubAccount, error) {
+	found := make(map[int64][]exchanges.SubAccount)
+	for _, account := range view.accounts {
+		if !account.IncludeSubs || !account.IsMaster {
+			continue
+		}
+		client, err := newExchangeClient(account)
+		if err != nil {
+			return nil, err
+		}
+		provider, ok := client.(exchanges.SubAccountProvider)
+		if !ok {
+			continue
+		}
+
+		subs, err := provider.GetSubAccounts(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("%sсписок субаккаунтов: %w", view.accountPrefix(account), err)
+		}
+		found[account.AccountID] = subs
+	}
+	return found, nil
+}
+
+// subAccountsBalances собирает балансы субаккаунтов. Субаккаунты, чьи ключи уже есть
+// в отчете, берутся из accountBalances, остальные запрашиваются ключом мастер-аккаунта.
+func subAccountsBalances(ctx context.Context, view portfolioView, subAccounts map[int64][]exchanges.SubAccount, accountBalances map[int64]map[string]string) (map[int64][]subAccountBalance, error) {
+	byUID := make(map[string]int64)
+	for _, account := range view.accounts {
+		if account.ExchangeUID != "" {
+			byUID[account.ExchangeUID] = account.AccountID
+		}
+	}
+
+	result := make(map[int64][]subAccountBalance)
+	for _, master := range view.accounts {
+		subs, ok := subAccounts[master.AccountID]
+		if !ok {
+			continue
+		}
+		client, err := newExchangeClient(master)
+		if err != nil {
+			return nil, err
+		}
+		provider := client.(exchanges.SubAccountProvider)
+
+		for _, sub := range subs {
+			entry := subAccountBalance{sub: sub}
+			if accountID, ok := byUID[sub.UID]; ok {
+				entry.balances = accountBalances[accountID]
+				entry.hasKey = true
+			} else {
+				balances, err := provider.GetSubAccountBalance(ctx, sub.UID)
+				if err != nil {
+					return nil, fmt.Errorf("%sбаланс субаккаунта %s: %w", view.accountPrefix(master), sub.Username, err)
+				}
+				entry.balances = balances
+			}
+			result[master.AccountID] = append(result[master.AccountID], entry)
+		}
+	}
+	return result, nil
+}
+
+// formatSubAccountsBreakdown — стоимость мастер-аккаунтов и каждого их субаккаунта
+func formatSubAccountsBreakdown(view portfolioView, subBalances map[int64][]subAccountBalance, accountBalances map[int64]map[string]string, conv *rates.Converter, currency rates.Currency) string {
+	var sb strings.Builder
+	for _, master := range view.accounts {
+		entries, ok := subBalances[master.AccountID]
+		if !ok {
+			continue
+		}
+		sort.Slice(entries, func(i, j int) bool {
+			return calculateTotalValue(entries[i].balances, conv) > calculateTotalValue(entries[j].balances, conv)
+		})
+
+		var missingKeys []string
+		sb.WriteString(fmt.Sprintf("\n\n🧩 *Субаккаунты %s:*\n", accountLabel(master)))
+		sb.WriteString(fmt.Sprintf("• Мастер-аккаунт: %s\n", currency.Format(calculateTotalValue(accountBalances[master.AccountID], conv))))
+		for _, entry := range entries {
+			name := storage.CleanAccountName(entry.sub.Username)
+			if name == "" {
+				name = entry.sub.UID
+			}
+			status := ""
+			if !entry.sub.Active {
+				status = " (заморожен)"
+			}
+			sb.WriteString(fmt.Sprintf("• %s%s: %s\n", name, status, currency.Format(calculateTotalValue(entry.balances, conv))))
+			if !entry.hasKey {
+				missingKeys = append(missingKeys, name)
+			}
+		}
+		if len(entries) == 0 {
+			sb.WriteString("Субаккаунтов нет\n")
+		}
+		if len(missingKeys) > 0 {
+			sb.WriteString(fmt.Sprintf("⚠️ Без ключей: %s — их сделки не входят в среднюю цену. "+
+				"Добавьте ключи этих субаккаунтов как отдельные аккаунты.\n", strings.Join(missingKeys, ", ")))
+		}
+	}
+	return strings.TrimRight(sb.String(), "\n")
+}
+
+// HandleToggleSubAccounts включает и выключает показ субаккаунтов вместе с мастер-аккаунтом
+func HandleToggleSubAccounts(ctx context.Context, bot *tgbotapi.BotAPI, update tgbotapi.Update, arg string) {
+	chatID := getChatID(update)
+
+	accountID, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		sendError(bot, chatID, "Неверный аккаунт")
+		return
+	}
+	accounts, err := storage.GetAccounts(chatID)
+	if err != nil {
+		sendError(bot, chatID, "Ошибка получения аккаунтов")
+		return
+	}
+	var account storage.User
+	for _, a := range accounts {
+		if a.AccountID == accountID {
+			account = a
+		}
+	}
+	if account.AccountID == 0 {
+		sendError(bot, chatID, "Аккаунт не найден")
+		return
+	}
+
+	if account.IncludeSubs {
+		if err := storage.SetIncludeSubAccounts(chatID, accountID, false); err != nil {
+			sendError(bot, chatID, fmt.Sprintf("Не удалось выключить субаккаунты: %v", err))
+			return
+		}
+		showAccounts(bot, update, "🧩 Субаккаунты больше не показываются вместе с мастер-аккаунтом.\n\n")
+		return
+	}
+
+	checkCtx, cancel := context.WithTimeout(ctx, time.Minute)
+	defer cancel()
+	showAccounts(bot, update, enableSubAccounts(checkCtx, chatID, account, accounts)+"\n\n")
+}
+
+// enableSubAccounts проверяет, что ключ от мастер-аккаунта, находит его субаккаунты
+// и включает их показ. Возвращает текст для пользователя.
+func enableSubAccounts(ctx context.Context, chatID int64, master storage.User, accounts []storage.User) string {
+	client, err := newExchangeClient(master)
+	if err != nil {
+		return "❌ " + err.Error()
+	}
+	provider, ok := client.(exchanges.SubAccountProvider)
+	if !ok {
+		return fmt.Sprintf("⚠️ Субаккаунты пока поддерживаются только для %s.", exchanges.DisplayName(exchanges.ExchangeBybit))
+	}
+
+	info, err := client.GetKeyInfo(ctx)
+	if err != nil {
+		return exchangeErrorText("Ключ не прошел проверку", err)
+	}
+	if err := storage.SetAccountIdentity(master.AccountID, info.UID, info.IsMaster); err != nil {
+		log.Printf("[Accounts] Ошибка сохранения UID аккаунта %d: %v", master.AccountID, err)
+	}
+	if !info.IsMaster {
+		return "⚠️ Это ключ субаккаунта. Список субаккаунтов доступен только по ключу мастер-аккаунта."
+	}
+
+	// аккаунтам, добавленным до появления субаккаунтов, UID еще не известен — без него
+	// их не привязать к мастер-аккаунту
+	for _, account := range accounts {
+		if account.ExchangeUID != "" || account.Exchange != master.Exchange || account.AccountID == master.AccountID {
+			continue
+		}
+		accountClient, err := newExchangeClient(account)
+		if err != nil {
+			continue
+		}
+		accountInfo, err := accountClient.GetKeyInfo(ctx)
+		if err != nil {
+			log.Printf("[Accounts] Не удалось получить UID аккаунта %d: %v", account.AccountID, err)
+			continue
+		}
+		if err := storage.SetAccountIdentity(account.AccountID, accountInfo.UID, accountInfo.IsMaster); err != nil {
+			log.Printf("[Accounts] Ошибка сохранения UID аккаунта %d: %v", account.AccountID, err)
+		}
+	}
+
+	subs, err := provider.GetSubAccounts(ctx)
+	if err != nil {
+		return exchangeErrorText("Ошибка получения субаккаунтов", err)
+	}
+	uids := make([]string, 0, len(subs))
+	for _, sub := range subs {
+		uids = append(uids, sub.UID)
+	}
+	if _, err := storage.LinkSubAccounts(chatID, master.AccountID, uids); err != nil {
+		log.Printf("[Accounts] Ошибка привязки субаккаунтов к аккаунту %d: %v", master.AccountID, err)
+		return "❌ Ошибка сохранения субаккаунтов"
+	}
+	if err := storage.SetIncludeSubAccounts(chatID, master.AccountID, true); err != nil {
+		return fmt.Sprintf("❌ Не удалось включить субаккаунты: %v", err)
+	}
+
+	linked := 0
+	if refreshed, err := storage.GetAccounts(chatID); err == nil {
+		for _, account := range refreshed {
+			if account.ParentID == master.AccountID {
+				linked++
+			}
+		}
+	}
+	text := fmt.Sprintf("✅ Субаккаунты включены. Найдено: %d, с сохраненными ключами: %d.", len(subs), linked)
+	if linked < len(subs) {
+		text += "\n\nБаланс остальных покажу по ключу мастер-аккаунта, но их сделки не войдут в среднюю цену — " +
+			"для этого добавьте ключи субаккаунтов как отдельные аккаунты."
+	}
+	return text
+}
+
+// subAccountsButton — кнопка показа субаккаунтов для активного аккаунта биржи,
+// где они поддерживаются
+func subAccountsButton(account storage.User) []tgbotapi.InlineKeyboardButton {
+	if account.Exchange != exchanges.ExchangeBybit || account.ParentID != 0 {
+		return nil
+	}
+	text := "🧩 Субаккаунты: выкл"
+	if account.IncludeSubs {
+		text = "🧩 Субаккаунты: вкл"
+	}
+	callbackData := fmt.Sprintf("toggle_subs_%d", account.AccountID)
+	return tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData(text, callbackData))
+}
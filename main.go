@@ -1,27 +1,57 @@
 package main
 
 import (
+	"context"
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"syscall"
+	"telegram-date-bot/exchanges"
 	"telegram-date-bot/handlers"
+	"telegram-date-bot/rates"
+	"telegram-date-bot/secrets"
 	"telegram-date-bot/storage"
+	"time"
 
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
 	"github.com/joho/godotenv"
 )
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	err := godotenv.Load()
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
 
+	// ключи пользователей хранятся зашифрованными, без ключа шифрования работать нельзя
+	if err := secrets.Load(); err != nil {
+		log.Fatal("Error loading secrets key:", err)
+	}
+
 	err = storage.InitDB("trades_cache.db")
 	if err != nil {
 		log.Fatal("Error initializing database:", err)
 	}
 
+	// ключи раньше хранились в users.json; переносим их в базу один раз
+	if err := storage.ImportUsersFile("users.json"); err != nil {
+		log.Fatal("Error importing users.json:", err)
+	}
+
+	// RATES_FIXTURE — файл с курсами вместо биржи и ЦБ, для тестов и локальной отладки
+	if path := os.Getenv("RATES_FIXTURE"); path != "" {
+		fixture, err := rates.LoadFixture(path)
+		if err != nil {
+			log.Fatal("Error loading rates fixture:", err)
+		}
+		handlers.SetRateSource(fixture)
+		log.Printf("Курсы берутся из файла %s", path)
+	}
+
 	bot, err := tgbotapi.NewBotAPI(os.Getenv("TELEGRAM_APITOKEN"))
 	if err != nil {
 		log.Panic(err)
@@ -32,19 +62,33 @@ func main() {
 	tgbotapi.SetLogger(log.New(io.Discard, "", 0))
 
 	log.Printf("Authorized on account %s", bot.Self.UserName)
+	log.Printf("Bybit API: %s", exchanges.BybitBaseURL())
 
-	go handlers.StartAlertChecker(bot)
+	go handlers.StartAlertChecker(ctx, bot)
 	log.Println("Запущен фоновый процесс проверки алертов.")
-	go handlers.StartPortfolioNotifier(bot)
+	go handlers.StartPortfolioNotifier(ctx, bot)
 	log.Println("Запущен фоновый процесс для PnL-уведомлений.")
+	go handlers.StartExecutionStreams(ctx, bot)
 
 	u := tgbotapi.NewUpdate(0)
 	u.Timeout = 60
 	updates := bot.GetUpdatesChan(u)
 
-	for update := range updates {
+	for {
+		var update tgbotapi.Update
+		select {
+		case <-ctx.Done():
+			log.Println("Остановка бота: ждем завершения обработчиков...")
+			bot.StopReceivingUpdates()
+			if !handlers.WaitForHandlers(30 * time.Second) {
+				log.Println("Не все обработчики завершились вовремя")
+			}
+			return
+		case update = <-updates:
+		}
+
 		if update.CallbackQuery != nil {
-			handlers.HandleCallback(bot, update)
+			handlers.HandleCallback(ctx, bot, update)
 			continue
 		}
 		if update.Message == nil {
@@ -55,12 +99,14 @@ func main() {
 			switch update.Message.Command() {
 			case "start":
 				handlers.HandleStart(bot, update)
+			case "resync":
+				handlers.HandleResync(ctx, bot, update)
 			}
 			continue
 		}
 
 		if update.Message.Text != "" {
-			handlers.HandleTextMessageAPI(bot, update)
+			handlers.HandleTextMessageAPI(ctx, bot, update)
 		}
 	}
 }
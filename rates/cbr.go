@@ -0,0 +1,171 @@
+package rates
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"telegram-date-bot/exchanges"
+	"time"
+)
+
+// курс рубля к доллару по ЦБ РФ; на бирже пар к рублю нет
+const (
+	cbrBaseURL = "https://www.cbr.ru/scripts"
+	cbrUSDCode = "R01235"
+	// cbrSymbol — под этой парой курс попадает в пересчет: доллар ЦБ считается равным USDT
+	cbrSymbol = "USDTRUB"
+	// ЦБ обновляет курс раз в день
+	cbrCacheTTL = time.Hour
+)
+
+var moscow = time.FixedZone("MSK", 3*60*60)
+
+// cbrSource — курс доллара ЦБ РФ
+type cbrSource struct {
+	baseURL string
+	client  *http.Client
+
+	mu        sync.Mutex
+	price     float64
+	fetchedAt time.Time
+}
+
+// NewCBRSource — курс рубля по ЦБ РФ, пара USDTRUB
+func NewCBRSource() Source {
+	return &cbrSource{baseURL: cbrBaseURL, client: &http.Client{Timeout: 15 * time.Second}}
+}
+
+type cbrDaily struct {
+	Valutes []struct {
+		CharCode string `xml:"CharCode"`
+		Nominal  string `xml:"Nominal"`
+		Value    string `xml:"Value"`
+	} `xml:"Valute"`
+}
+
+type cbrDynamic struct {
+	Records []struct {
+		Date    string `xml:"Date,attr"`
+		Nominal string `xml:"Nominal"`
+		Value   string `xml:"Value"`
+	} `xml:"Record"`
+}
+
+func (s *cbrSource) Prices(ctx context.Context) (map[string]float64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.price > 0 && time.Since(s.fetchedAt) < cbrCacheTTL {
+		return map[string]float64{cbrSymbol: s.price}, nil
+	}
+
+	var daily cbrDaily
+	if err := s.get(ctx, "/XML_daily.asp", nil, &daily); err != nil {
+		return nil, err
+	}
+	for _, v := range daily.Valutes {
+		if v.CharCode != "USD" {
+			continue
+		}
+		price, err := cbrRate(v.Value, v.Nominal)
+		if err != nil {
+			return nil, err
+		}
+		s.price, s.fetchedAt = price, time.Now()
+		return map[string]float64{cbrSymbol: price}, nil
+	}
+	return nil, fmt.Errorf("ЦБ РФ: в ответе нет курса доллара")
+}
+
+func (s *cbrSource) GetDailyPrices(ctx context.Context, symbol string, startTime, endTime int64) ([]exchanges.PricePoint, error) {
+	if symbol != cbrSymbol {
+		return nil, ErrUnknownSymbol
+	}
+	params := url.Values{}
+	params.Set("date_req1", time.UnixMilli(startTime).In(moscow).Format("02/01/2006"))
+	params.Set("date_req2", time.UnixMilli(endTime).In(moscow).Format("02/01/2006"))
+	params.Set("VAL_NM_RQ", cbrUSDCode)
+
+	var dynamic cbrDynamic
+	if err := s.get(ctx, "/XML_dynamic.asp", params, &dynamic); err != nil {
+		return nil, err
+	}
+	points := make([]exchanges.PricePoint, 0, len(dynamic.Records))
+	for _, r := range dynamic.Records {
+		date, err := time.ParseInLocation("02.01.2006", r.Date, moscow)
+		if err != nil {
+			return nil, fmt.Errorf("ЦБ РФ: дата %q: %w", r.Date, err)
+		}
+		price, err := cbrRate(r.Value, r.Nominal)
+		if err != nil {
+			return nil, err
+		}
+		points = append(points, exchanges.PricePoint{Time: date.UnixMilli(), Price: price})
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i].Time < points[j].Time })
+	return points, nil
+}
+
+func (s *cbrSource) get(ctx context.Context, path string, params url.Values, result interface{}) error {
+	endpoint := s.baseURL + path
+	if len(params) > 0 {
+		endpoint += "?" + params.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("ЦБ РФ: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("ЦБ РФ: HTTP %d", resp.StatusCode)
+	}
+
+	decoder := xml.NewDecoder(resp.Body)
+	// ответ в windows-1251; нужные поля — цифры и латиница, кириллица в названиях валют
+	// не нужна и заменяется на '?'
+	decoder.CharsetReader = func(charset string, input io.Reader) (io.Reader, error) {
+		return asciiReader{input}, nil
+	}
+	if err := decoder.Decode(result); err != nil {
+		return fmt.Errorf("ЦБ РФ: разбор ответа: %w", err)
+	}
+	return nil
+}
+
+// asciiReader заменяет байты вне ASCII на '?'
+type asciiReader struct {
+	r io.Reader
+}
+
+func (a asciiReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	for i := 0; i < n; i++ {
+		if p[i] >= 0x80 {
+			p[i] = '?'
+		}
+	}
+	return n, err
+}
+
+// cbrRate — курс за одну единицу валюты; ЦБ пишет числа с запятой: "92,5058"
+func cbrRate(value, nominal string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.Replace(value, ",", ".", 1), 64)
+	if err != nil {
+		return 0, fmt.Errorf("ЦБ РФ: курс %q: %w", value, err)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(nominal))
+	if err != nil || n <= 0 {
+		n = 1
+	}
+	return v / float64(n), nil
+}
@@ -0,0 +1,39 @@
+package rates
+
+import "fmt"
+
+// Currency — валюта отчета, которую выбирает пользователь
+type Currency struct {
+	Code     string // USD, EUR, RUB, BTC
+	Coin     string // монета, к которой ищутся курсы: доллар считается по USDT
+	Sign     string
+	Decimals int
+}
+
+// Currencies — валюты отчета в порядке показа в настройках; первая — по умолчанию
+var Currencies = []Currency{
+	{Code: "USD", Coin: "USDT", Sign: "$", Decimals: 2},
+	{Code: "EUR", Coin: "EUR", Sign: "€", Decimals: 2},
+	{Code: "RUB", Coin: "RUB", Sign: "₽", Decimals: 2},
+	{Code: "BTC", Coin: "BTC", Sign: "₿", Decimals: 8},
+}
+
+// ParseCurrency возвращает валюту по коду; неизвестный код — доллар
+func ParseCurrency(code string) Currency {
+	for _, c := range Currencies {
+		if c.Code == code {
+			return c
+		}
+	}
+	return Currencies[0]
+}
+
+// Format — сумма со знаком валюты: «12.50$», «0.00150000₿»
+func (c Currency) Format(v float64) string {
+	return fmt.Sprintf("%.*f%s", c.Decimals, v, c.Sign)
+}
+
+// Amount — сумма без знака валюты, с точностью валюты (для таблиц и CSV)
+func (c Currency) Amount(v float64) string {
+	return fmt.Sprintf("%.*f", c.Decimals, v)
+}
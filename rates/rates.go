@@ -0,0 +1,320 @@
+// Package rates пересчитывает суммы в валюту отчета по курсам спота: балансы — по текущим
+// ценам, сделки — по дневным курсам на дату сделки. Сделки во всех парах монеты
+// (ETHUSDT, ETHUSDC, ETHBTC) приводятся к одной паре монета/валюта отчета.
+package rates
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strconv"
+	"sync"
+	"telegram-date-bot/exchanges"
+	"time"
+)
+
+// bridges — монеты, через которые ищется курс, если прямой пары с валютой отчета нет
+var bridges = []string{"USDT", "USDC", "BTC", "ETH"}
+
+// cash — стейблкоины и фиат: обмен на них не открывает позицию, лоты для них не ведутся
+var cash = map[string]bool{"USDT": true, "USDC": true, "FDUSD": true, "DAI": true, "EUR": true, "TRY": true, "BRL": true}
+
+const day = 24 * time.Hour
+
+// Converter пересчитывает монеты в монету валюты отчета Currency (Currency.Coin)
+type Converter struct {
+	Currency string
+	prices   map[string]float64
+	daily    map[string][]exchanges.PricePoint
+}
+
+// NewConverter создает пересчет по текущим ценам пар, как их отдает GetAllMarketPrices
+func NewConverter(currency string, prices map[string]float64) *Converter {
+	return &Converter{Currency: currency, prices: prices, daily: make(map[string][]exchanges.PricePoint)}
+}
+
+// Rate — текущая цена монеты в валюте отчета
+func (c *Converter) Rate(coin string) (float64, bool) {
+	return c.rate(coin, 0)
+}
+
+// IsCash сообщает, что монета — деньги, а не позиция: стейблкоин, фиат или сама
+// монета валюты отчета (BTC при отчете в BTC)
+func (c *Converter) IsCash(coin string) bool {
+	return cash[coin] || coin == c.Currency
+}
+
+// RateAt — цена монеты на момент t (мс) по дневным курсам. Если их не загрузили,
+// используется текущая цена.
+func (c *Converter) RateAt(coin string, t int64) (float64, bool) {
+	return c.rate(coin, t)
+}
+
+func (c *Converter) rate(coin string, t int64) (float64, bool) {
+	if coin == c.Currency {
+		return 1, true
+	}
+	if r, ok := c.pair(coin, c.Currency, t); ok {
+		return r, true
+	}
+	for _, bridge := range bridges {
+		if bridge == coin || bridge == c.Currency {
+			continue
+		}
+		toBridge, ok := c.pair(coin, bridge, t)
+		if !ok {
+			continue
+		}
+		if fromBridge, ok := c.pair(bridge, c.Currency, t); ok {
+			return toBridge * fromBridge, true
+		}
+	}
+	return 0, false
+}
+
+// pair — цена base в quote по прямой паре или по обратной
+func (c *Converter) pair(base, quote string, t int64) (float64, bool) {
+	if p, ok := c.price(base+quote, t); ok {
+		return p, true
+	}
+	if p, ok := c.price(quote+base, t); ok {
+		return 1 / p, true
+	}
+	return 0, false
+}
+
+func (c *Converter) price(symbol string, t int64) (float64, bool) {
+	if points := c.daily[symbol]; t > 0 && len(points) > 0 {
+		return priceAt(points, t), true
+	}
+	p, ok := c.prices[symbol]
+	return p, ok && p > 0
+}
+
+// priceAt — цена последней свечи, открытой не позже t; до первой свечи — цена первой
+func priceAt(points []exchanges.PricePoint, t int64) float64 {
+	i := sort.Search(len(points), func(i int) bool { return points[i].Time > t })
+	if i == 0 {
+		return points[0].Price
+	}
+	return points[i-1].Price
+}
+
+// route — пары, через которые сейчас считается курс монеты
+func (c *Converter) route(coin string) []string {
+	if coin == c.Currency {
+		return nil
+	}
+	if symbol, ok := c.pairSymbol(coin, c.Currency); ok {
+		return []string{symbol}
+	}
+	for _, bridge := range bridges {
+		if bridge == coin || bridge == c.Currency {
+			continue
+		}
+		first, ok1 := c.pairSymbol(coin, bridge)
+		second, ok2 := c.pairSymbol(bridge, c.Currency)
+		if ok1 && ok2 {
+			return []string{first, second}
+		}
+	}
+	return nil
+}
+
+func (c *Converter) pairSymbol(base, quote string) (string, bool) {
+	for _, symbol := range []string{base + quote, quote + base} {
+		if p, ok := c.prices[symbol]; ok && p > 0 {
+			return symbol, true
+		}
+	}
+	return "", false
+}
+
+// LoadHistory загружает дневные курсы котировок и монет комиссий, нужные для пересчета
+// сделок. Пары, которые загрузить не удалось, считаются по текущему курсу.
+func (c *Converter) LoadHistory(ctx context.Context, source exchanges.DailyPriceProvider, trades []exchanges.Execution) error {
+	type period struct{ from, to int64 }
+	needed := make(map[string]period)
+	need := func(coin string, t int64) {
+		for _, symbol := range c.route(coin) {
+			p, ok := needed[symbol]
+			if !ok || t < p.from {
+				p.from = t
+			}
+			if t > p.to {
+				p.to = t
+			}
+			needed[symbol] = p
+		}
+	}
+	for _, trade := range trades {
+		t := trade.ExecTimeMs()
+		if t <= 0 {
+			continue
+		}
+		if _, quote, ok := exchanges.SplitSymbol(trade.Symbol); ok {
+			need(quote, t)
+		}
+		if trade.FeeCurrency != "" {
+			need(trade.FeeCurrency, t)
+		}
+	}
+
+	for symbol, p := range needed {
+		points, err := dailyPrices(ctx, source, symbol, p.from-day.Milliseconds(), p.to)
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			log.Printf("[Rates] Нет дневных курсов %s, считаю по текущему: %v", symbol, err)
+			continue
+		}
+		if len(points) > 0 {
+			c.daily[symbol] = points
+		}
+	}
+	return nil
+}
+
+// Normalize приводит сделки к парам монета/валюта отчета: цена, объем и комиссия
+// пересчитываются по курсу котировки на момент сделки. Сделка в паре к другой
+// монете (ETHBTC) — это еще и продажа или покупка котировки, поэтому добавляется
+// встречная сделка по BTC. Сделки, котировку которых пересчитать не удалось,
+// остаются в своей паре.
+func (c *Converter) Normalize(trades []exchanges.Execution) []exchanges.Execution {
+	result := make([]exchanges.Execution, 0, len(trades))
+	unpriced := make(map[string]bool)
+
+	for _, trade := range trades {
+		t := trade.ExecTimeMs()
+		base, quote, ok := exchanges.SplitSymbol(trade.Symbol)
+		if !ok {
+			result = append(result, c.convertFee(trade, t))
+			continue
+		}
+		if base == c.Currency && cash[quote] {
+			// покупка самой валюты отчета (BTCUSDT при отчете в BTC) — обмен денег на деньги,
+			// позицию она не открывает
+			continue
+		}
+		rate, ok := c.RateAt(quote, t)
+		if !ok {
+			unpriced[quote] = true
+			result = append(result, c.convertFee(trade, t))
+			continue
+		}
+
+		price, _ := strconv.ParseFloat(trade.Price, 64)
+		quantity, _ := strconv.ParseFloat(trade.Quantity, 64)
+		fee, _ := strconv.ParseFloat(trade.ExecFee, 64)
+		value := price * quantity
+		if v, err := strconv.ParseFloat(trade.ExecValue, 64); err == nil && v > 0 {
+			value = v
+		}
+
+		converted := trade
+		converted.Symbol = base + c.Currency
+		converted.Price = formatFloat(price * rate)
+		converted.ExecValue = formatFloat(value * rate)
+		if trade.FeeCurrency == quote || trade.FeeCurrency == "" {
+			converted.ExecFee = formatFloat(fee * rate)
+			converted.FeeCurrency = c.Currency
+		} else {
+			converted = c.convertFee(converted, t)
+		}
+		result = append(result, converted)
+
+		if quote == c.Currency || cash[quote] {
+			continue
+		}
+		// встречная сделка по котировке: за ETH отдали BTC вместе с комиссией в BTC,
+		// при продаже ETH получили BTC за ее вычетом
+		quoteQuantity := value
+		side := "Sell"
+		if trade.Side == "Sell" {
+			side = "Buy"
+		}
+		if trade.FeeCurrency == quote {
+			if trade.Side == "Buy" {
+				quoteQuantity += fee
+			} else {
+				quoteQuantity -= fee
+			}
+		}
+		result = append(result, exchanges.Execution{
+			Symbol:    quote + c.Currency,
+			Price:     formatFloat(rate),
+			Quantity:  formatFloat(quoteQuantity),
+			Side:      side,
+			ExecID:    trade.ExecID + ":" + quote,
+			OrderID:   trade.OrderID,
+			ExecTime:  trade.ExecTime,
+			ExecValue: formatFloat(quoteQuantity * rate),
+			IsMaker:   trade.IsMaker,
+		})
+	}
+
+	for quote := range unpriced {
+		log.Printf("[Rates] Нет курса %s к %s, сделки в парах к %s оставлены как есть", quote, c.Currency, quote)
+	}
+	return result
+}
+
+// convertFee пересчитывает комиссию в сторонней монете (не в монете и не в котировке пары)
+func (c *Converter) convertFee(trade exchanges.Execution, t int64) exchanges.Execution {
+	if trade.FeeCurrency == "" || trade.FeeCurrency == c.Currency {
+		return trade
+	}
+	if base, quote, ok := exchanges.SplitSymbol(trade.Symbol); ok && (trade.FeeCurrency == base || trade.FeeCurrency == quote) {
+		return trade
+	}
+	rate, ok := c.RateAt(trade.FeeCurrency, t)
+	if !ok {
+		return trade
+	}
+	fee, _ := strconv.ParseFloat(trade.ExecFee, 64)
+	trade.ExecFee = formatFloat(fee * rate)
+	trade.FeeCurrency = c.Currency
+	return trade
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// дневные курсы прошлых дней не меняются, поэтому держим их в памяти; последний день
+// перечитывается не чаще раза в dailyCacheTTL
+const dailyCacheTTL = 6 * time.Hour
+
+type dailyCacheEntry struct {
+	points    []exchanges.PricePoint
+	from, to  int64
+	fetchedAt time.Time
+}
+
+var (
+	dailyCacheMu sync.Mutex
+	dailyCache   = make(map[string]dailyCacheEntry)
+)
+
+func dailyPrices(ctx context.Context, source exchanges.DailyPriceProvider, symbol string, from, to int64) ([]exchanges.PricePoint, error) {
+	dailyCacheMu.Lock()
+	entry, ok := dailyCache[symbol]
+	dailyCacheMu.Unlock()
+	if ok && entry.from <= from && (entry.to >= to || time.Since(entry.fetchedAt) < dailyCacheTTL) {
+		return entry.points, nil
+	}
+
+	if ok && entry.from < from {
+		from = entry.from
+	}
+	points, err := source.GetDailyPrices(ctx, symbol, from, time.Now().UnixMilli())
+	if err != nil {
+		return nil, err
+	}
+
+	dailyCacheMu.Lock()
+	dailyCache[symbol] = dailyCacheEntry{points: points, from: from, to: time.Now().UnixMilli(), fetchedAt: time.Now()}
+	dailyCacheMu.Unlock()
+	return points, nil
+}
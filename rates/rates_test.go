@@ -0,0 +1,213 @@
+package rates
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"telegram-date-bot/exchanges"
+	"testing"
+)
+
+// курсы из файла в формате RATES_FIXTURE; дневные свечи — 14 и 15 ноября 2023
+const (
+	fixturePath = "testdata/rates.json"
+	day1        = int64(1700000000000)
+	day2        = int64(1700086400000)
+	hour        = int64(60 * 60 * 1000)
+)
+
+func loadTestFixture(t *testing.T) *Fixture {
+	t.Helper()
+	fixture, err := LoadFixture(fixturePath)
+	if err != nil {
+		t.Fatalf("LoadFixture: %v", err)
+	}
+	return fixture
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) <= 1e-9*math.Max(1, math.Abs(b))
+}
+
+func TestConverterRate(t *testing.T) {
+	fixture := loadTestFixture(t)
+	tests := []struct {
+		currency string
+		coin     string
+		want     float64
+		ok       bool
+	}{
+		{"USD", "BTC", 60000, true},
+		{"USD", "USDT", 1, true},
+		// обратная пара: EURUSDT
+		{"EUR", "USDT", 1 / 1.2, true},
+		// через USDT: BTCUSDT и EURUSDT
+		{"EUR", "BTC", 50000, true},
+		{"RUB", "BTC", 60000 * 90, true},
+		{"BTC", "ETH", 0.05, true},
+		{"BTC", "USDT", 1.0 / 60000, true},
+		{"USD", "DOGE", 0, false},
+	}
+	for _, tt := range tests {
+		conv := NewConverter(ParseCurrency(tt.currency).Coin, fixture.Current)
+		got, ok := conv.Rate(tt.coin)
+		if ok != tt.ok || !almostEqual(got, tt.want) {
+			t.Errorf("%s в %s: %v, %v; ожидалось %v, %v", tt.coin, tt.currency, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestConverterNormalizeByDailyRates(t *testing.T) {
+	fixture := loadTestFixture(t)
+	trades := []exchanges.Execution{
+		// ETH за BTC в первый день: BTC стоил 30000$
+		{Symbol: "ETHBTC", Side: "Buy", Price: "0.05", Quantity: "1", ExecFee: "0.0001", FeeCurrency: "BTC",
+			ExecID: "1", ExecTime: "1700003600000"},
+		// BTC за USDT во второй день
+		{Symbol: "BTCUSDT", Side: "Buy", Price: "35000", Quantity: "1", ExecFee: "35", FeeCurrency: "USDT",
+			ExecID: "2", ExecTime: "1700090000000"},
+	}
+
+	conv := NewConverter(ParseCurrency("USD").Coin, fixture.Current)
+	if err := conv.LoadHistory(context.Background(), fixture, trades); err != nil {
+		t.Fatalf("LoadHistory: %v", err)
+	}
+	if rate, _ := conv.RateAt("BTC", day1+hour); rate != 30000 {
+		t.Errorf("BTC на первый день = %v, ожидалось 30000", rate)
+	}
+	if rate, _ := conv.RateAt("BTC", day2+hour); rate != 40000 {
+		t.Errorf("BTC на второй день = %v, ожидалось 40000", rate)
+	}
+
+	normalized := conv.Normalize(trades)
+	if len(normalized) != 3 {
+		t.Fatalf("сделок после пересчета %d, ожидалось 3: %+v", len(normalized), normalized)
+	}
+	want := []struct {
+		symbol, side         string
+		price, quantity, fee float64
+		feeCurrency          string
+	}{
+		{"ETHUSDT", "Buy", 1500, 1, 3, "USDT"},
+		// встречная продажа BTC вместе с комиссией в BTC
+		{"BTCUSDT", "Sell", 30000, 0.0501, 0, ""},
+		{"BTCUSDT", "Buy", 35000, 1, 35, "USDT"},
+	}
+	for i, w := range want {
+		got := normalized[i]
+		price, _ := strconv.ParseFloat(got.Price, 64)
+		quantity, _ := strconv.ParseFloat(got.Quantity, 64)
+		fee, _ := strconv.ParseFloat(got.ExecFee, 64)
+		if got.Symbol != w.symbol || got.Side != w.side || got.FeeCurrency != w.feeCurrency ||
+			!almostEqual(price, w.price) || !almostEqual(quantity, w.quantity) || !almostEqual(fee, w.fee) {
+			t.Errorf("сделка %d = %+v, ожидалось %+v", i, got, w)
+		}
+	}
+}
+
+func TestConverterNormalizeToRUB(t *testing.T) {
+	fixture := loadTestFixture(t)
+	trades := []exchanges.Execution{
+		{Symbol: "BTCUSDT", Side: "Buy", Price: "35000", Quantity: "0.1", ExecFee: "3.5", FeeCurrency: "USDT",
+			ExecID: "1", ExecTime: "1700090000000"},
+	}
+
+	conv := NewConverter(ParseCurrency("RUB").Coin, fixture.Current)
+	if err := conv.LoadHistory(context.Background(), fixture, trades); err != nil {
+		t.Fatalf("LoadHistory: %v", err)
+	}
+	normalized := conv.Normalize(trades)
+	if len(normalized) != 1 {
+		t.Fatalf("сделок после пересчета %d, ожидалось 1", len(normalized))
+	}
+	// курс ЦБ на день сделки — 85, а не текущий 90
+	got := normalized[0]
+	if got.Symbol != "BTCRUB" || got.Price != "2975000" || got.ExecFee != "297.5" || got.FeeCurrency != "RUB" {
+		t.Errorf("сделка = %+v", got)
+	}
+}
+
+func TestConverterNormalizeSkipsReportCoinPurchases(t *testing.T) {
+	fixture := loadTestFixture(t)
+	trades := []exchanges.Execution{
+		// покупка BTC за USDT при отчете в BTC — обмен денег на деньги
+		{Symbol: "BTCUSDT", Side: "Buy", Price: "30000", Quantity: "1", ExecID: "1", ExecTime: "1700003600000"},
+		{Symbol: "ETHBTC", Side: "Buy", Price: "0.05", Quantity: "2", ExecID: "2", ExecTime: "1700003600000"},
+	}
+
+	conv := NewConverter(ParseCurrency("BTC").Coin, fixture.Current)
+	normalized := conv.Normalize(trades)
+	if len(normalized) != 1 || normalized[0].Symbol != "ETHBTC" || normalized[0].Price != "0.05" {
+		t.Errorf("сделки = %+v", normalized)
+	}
+}
+
+func TestCombineAddsExtraPairs(t *testing.T) {
+	primary := &Fixture{Current: map[string]float64{"BTCUSDT": 60000}}
+	extra := &Fixture{
+		Current: map[string]float64{"USDTRUB": 90, "BTCUSDT": 1},
+		Daily:   map[string][]exchanges.PricePoint{"USDTRUB": {{Time: day1, Price: 80}}},
+	}
+	source := Combine(primary, extra)
+
+	prices, err := source.Prices(context.Background())
+	if err != nil {
+		t.Fatalf("Prices: %v", err)
+	}
+	// пары основного источника не перезаписываются дополнительным
+	if prices["BTCUSDT"] != 60000 || prices["USDTRUB"] != 90 {
+		t.Errorf("цены = %v", prices)
+	}
+
+	points, err := source.GetDailyPrices(context.Background(), "USDTRUB", day1, day2)
+	if err != nil || len(points) != 1 || points[0].Price != 80 {
+		t.Errorf("дневные USDTRUB = %v, %v", points, err)
+	}
+	// пару, которой нет ни у кого, Fixture основного источника тоже не знает
+	if _, err := source.GetDailyPrices(context.Background(), "ETHUSDT", day1, day2); err != ErrUnknownSymbol {
+		t.Errorf("ошибка для неизвестной пары = %v", err)
+	}
+}
+
+func TestCurrencyFormat(t *testing.T) {
+	tests := []struct {
+		code string
+		want string
+	}{
+		{"USD", "12.50$"},
+		{"EUR", "12.50€"},
+		{"RUB", "12.50₽"},
+		{"BTC", "12.50000000₿"},
+		{"XYZ", "12.50$"},
+	}
+	for _, tt := range tests {
+		if got := ParseCurrency(tt.code).Format(12.5); got != tt.want {
+			t.Errorf("%s: %q, ожидалось %q", tt.code, got, tt.want)
+		}
+	}
+}
+
+func TestConverterIsCash(t *testing.T) {
+	tests := []struct {
+		currency string
+		coin     string
+		want     bool
+	}{
+		{"USD", "USDT", true},
+		{"USD", "FDUSD", true},
+		{"USD", "DAI", true},
+		{"RUB", "EUR", true},
+		{"RUB", "TRY", true},
+		// монета валюты отчета — тоже деньги
+		{"RUB", "RUB", true},
+		{"BTC", "BTC", true},
+		{"USD", "BTC", false},
+		{"BTC", "ETH", false},
+	}
+	for _, tt := range tests {
+		conv := NewConverter(ParseCurrency(tt.currency).Coin, nil)
+		if got := conv.IsCash(tt.coin); got != tt.want {
+			t.Errorf("%s при отчете в %s: IsCash = %v, ожидалось %v", tt.coin, tt.currency, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package rates
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"telegram-date-bot/exchanges"
+)
+
+// Source — откуда берутся курсы: текущие цены пар в формате GetAllMarketPrices
+// ("BTCUSDT" → цена) и дневные цены пары за период. Бот работает с биржей и ЦБ РФ,
+// в тестах их заменяет Fixture.
+type Source interface {
+	Prices(ctx context.Context) (map[string]float64, error)
+	exchanges.DailyPriceProvider
+}
+
+// ErrUnknownSymbol — источник не знает такой пары
+var ErrUnknownSymbol = errors.New("пара не поддерживается источником курсов")
+
+// exchangeSource — курсы спота биржи
+type exchangeSource struct {
+	exchange exchanges.Exchange
+}
+
+// NewExchangeSource берет текущие цены с биржи, а дневные — если биржа их отдает
+func NewExchangeSource(exchange exchanges.Exchange) Source {
+	return exchangeSource{exchange: exchange}
+}
+
+func (s exchangeSource) Prices(ctx context.Context) (map[string]float64, error) {
+	return s.exchange.GetAllMarketPrices(ctx)
+}
+
+func (s exchangeSource) GetDailyPrices(ctx context.Context, symbol string, startTime, endTime int64) ([]exchanges.PricePoint, error) {
+	provider, ok := s.exchange.(exchanges.DailyPriceProvider)
+	if !ok {
+		return nil, fmt.Errorf("%s не отдает дневные курсы", exchanges.DisplayName(s.exchange.Name()))
+	}
+	return provider.GetDailyPrices(ctx, symbol, startTime, endTime)
+}
+
+// combinedSource — основной источник и дополнительные с отдельными парами
+type combinedSource struct {
+	primary Source
+	extra   []Source
+}
+
+// Combine добавляет к основному источнику пары дополнительных (например, курс рубля).
+// Без цен основного источника пересчет невозможен, а ошибка дополнительного только
+// пишется в лог: без его пар обойдутся пользователи других валют.
+func Combine(primary Source, extra ...Source) Source {
+	return combinedSource{primary: primary, extra: extra}
+}
+
+func (s combinedSource) Prices(ctx context.Context) (map[string]float64, error) {
+	prices, err := s.primary.Prices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	merged := make(map[string]float64, len(prices))
+	for symbol, price := range prices {
+		merged[symbol] = price
+	}
+	for _, source := range s.extra {
+		extraPrices, err := source.Prices(ctx)
+		if err != nil {
+			log.Printf("[Rates] Дополнительный источник курсов недоступен: %v", err)
+			continue
+		}
+		for symbol, price := range extraPrices {
+			if _, ok := merged[symbol]; !ok {
+				merged[symbol] = price
+			}
+		}
+	}
+	return merged, nil
+}
+
+// GetDailyPrices сначала спрашивает дополнительные источники: они знают свои пары
+// и сразу отказываются от чужих, не делая запросов
+func (s combinedSource) GetDailyPrices(ctx context.Context, symbol string, startTime, endTime int64) ([]exchanges.PricePoint, error) {
+	for _, source := range s.extra {
+		points, err := source.GetDailyPrices(ctx, symbol, startTime, endTime)
+		if errors.Is(err, ErrUnknownSymbol) {
+			continue
+		}
+		return points, err
+	}
+	return s.primary.GetDailyPrices(ctx, symbol, startTime, endTime)
+}
+
+// Fixture — курсы из памяти или файла вместо биржи: для тестов и локальной отладки
+type Fixture struct {
+	Current map[string]float64                `json:"prices"`
+	Daily   map[string][]exchanges.PricePoint `json:"daily"`
+}
+
+// LoadFixture читает курсы из JSON-файла:
+// {"prices": {"BTCUSDT": 60000}, "daily": {"BTCUSDT": [{"Time": 1700000000000, "Price": 35000}]}}
+func LoadFixture(path string) (*Fixture, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fixture Fixture
+	if err := json.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("файл курсов %s: %w", path, err)
+	}
+	return &fixture, nil
+}
+
+func (f *Fixture) Prices(ctx context.Context) (map[string]float64, error) {
+	return f.Current, nil
+}
+
+func (f *Fixture) GetDailyPrices(ctx context.Context, symbol string, startTime, endTime int64) ([]exchanges.PricePoint, error) {
+	points, ok := f.Daily[symbol]
+	if !ok {
+		return nil, ErrUnknownSymbol
+	}
+	var result []exchanges.PricePoint
+	for _, p := range points {
+		if p.Time >= startTime && p.Time <= endTime {
+			result = append(result, p)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Time < result[j].Time })
+	return result, nil
+}
@@ -0,0 +1,210 @@
+// Package secrets шифрует API-ключи пользователей перед записью на диск (AES-256-GCM).
+//
+// Ключи шифрования берутся из SECRETS_KEY (base64, через запятую) или из файла
+// SECRETS_KEY_FILE (по умолчанию secrets.key, по ключу на строку). Первый ключ — текущий,
+// остальные нужны только для чтения старых записей: для ротации новый ключ ставится
+// первым, после перезапуска записи перешифровываются и старый ключ можно убрать.
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	prefix         = "enc:v1:"
+	keySize        = 32
+	defaultKeyFile = "secrets.key"
+)
+
+var ErrNotLoaded = errors.New("ключ шифрования не загружен")
+
+type key struct {
+	id   string
+	aead cipher.AEAD
+}
+
+var (
+	mu   sync.RWMutex
+	keys []key
+)
+
+// Load загружает ключи шифрования. Если ключей нет ни в окружении, ни в файле,
+// создает файл с новым ключом.
+func Load() error {
+	encoded, err := readKeys()
+	if err != nil {
+		return err
+	}
+
+	loaded := make([]key, 0, len(encoded))
+	for i, s := range encoded {
+		k, err := parseKey(s)
+		if err != nil {
+			return fmt.Errorf("ключ шифрования #%d: %w", i+1, err)
+		}
+		loaded = append(loaded, k)
+	}
+
+	mu.Lock()
+	keys = loaded
+	mu.Unlock()
+	return nil
+}
+
+func readKeys() ([]string, error) {
+	if env := os.Getenv("SECRETS_KEY"); env != "" {
+		return splitKeys(env, ","), nil
+	}
+
+	path := os.Getenv("SECRETS_KEY_FILE")
+	if path == "" {
+		path = defaultKeyFile
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return generateKeyFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := splitKeys(string(data), "\n")
+	if len(encoded) == 0 {
+		return nil, fmt.Errorf("файл ключей %s пуст", path)
+	}
+	return encoded, nil
+}
+
+func splitKeys(s, sep string) []string {
+	var encoded []string
+	for _, part := range strings.Split(s, sep) {
+		if part = strings.TrimSpace(part); part != "" {
+			encoded = append(encoded, part)
+		}
+	}
+	return encoded
+}
+
+func generateKeyFile(path string) ([]string, error) {
+	raw := make([]byte, keySize)
+	if _, err := rand.Read(raw); err != nil {
+		return nil, err
+	}
+	encoded := base64.StdEncoding.EncodeToString(raw)
+	if err := os.WriteFile(path, []byte(encoded+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("не удалось создать файл ключей %s: %w", path, err)
+	}
+	log.Printf("[Secrets] Создан новый ключ шифрования %s — сохраните его, без него ключи пользователей не расшифровать", path)
+	return []string{encoded}, nil
+}
+
+func parseKey(encoded string) (key, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return key{}, fmt.Errorf("ожидается base64: %w", err)
+	}
+	if len(raw) != keySize {
+		return key{}, fmt.Errorf("ожидается %d байта, получено %d", keySize, len(raw))
+	}
+	block, err := aes.NewCipher(raw)
+	if err != nil {
+		return key{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return key{}, err
+	}
+	// идентификатор ключа — начало его хэша, сам ключ в записи не хранится
+	sum := sha256.Sum256(raw)
+	return key{id: hex.EncodeToString(sum[:4]), aead: aead}, nil
+}
+
+// Encrypt шифрует значение текущим ключом: enc:v1:<id ключа>:<base64(nonce|шифротекст)>.
+// Пустое значение остается пустым.
+func Encrypt(plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if len(keys) == 0 {
+		return "", ErrNotLoaded
+	}
+	k := keys[0]
+
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	// id ключа входит в подпись: запись нельзя незаметно приписать другому ключу
+	sealed := k.aead.Seal(nonce, nonce, []byte(plain), []byte(k.id))
+	return prefix + k.id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt расшифровывает значение. Значения без префикса — записи, сохраненные
+// до появления шифрования, — возвращаются как есть.
+func Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, prefix) {
+		return value, nil
+	}
+	id, payload, ok := strings.Cut(strings.TrimPrefix(value, prefix), ":")
+	if !ok {
+		return "", errors.New("поврежденная зашифрованная запись")
+	}
+
+	mu.RLock()
+	defer mu.RUnlock()
+	if len(keys) == 0 {
+		return "", ErrNotLoaded
+	}
+	for _, k := range keys {
+		if k.id != id {
+			continue
+		}
+		sealed, err := base64.StdEncoding.DecodeString(payload)
+		if err != nil || len(sealed) < k.aead.NonceSize() {
+			return "", errors.New("поврежденная зашифрованная запись")
+		}
+		nonce, ciphertext := sealed[:k.aead.NonceSize()], sealed[k.aead.NonceSize():]
+		plain, err := k.aead.Open(nil, nonce, ciphertext, []byte(k.id))
+		if err != nil {
+			return "", fmt.Errorf("не удалось расшифровать запись ключом %s: %w", id, err)
+		}
+		return string(plain), nil
+	}
+	return "", fmt.Errorf("нет ключа шифрования %s", id)
+}
+
+// NeedsRotation сообщает, что значение хранится открытым текстом или зашифровано
+// не текущим ключом
+func NeedsRotation(value string) bool {
+	if value == "" {
+		return false
+	}
+	mu.RLock()
+	defer mu.RUnlock()
+	if len(keys) == 0 {
+		return false
+	}
+	return !strings.HasPrefix(value, prefix+keys[0].id+":")
+}
+
+// Reencrypt расшифровывает значение любым из известных ключей и шифрует текущим
+func Reencrypt(value string) (string, error) {
+	plain, err := Decrypt(value)
+	if err != nil {
+		return "", err
+	}
+	return Encrypt(plain)
+}
@@ -0,0 +1,134 @@
+package secrets
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+func newTestKey(t *testing.T) string {
+	t.Helper()
+	raw := make([]byte, keySize)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatalf("ключ: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(raw)
+}
+
+// loadKeys загружает ключи из SECRETS_KEY; первый — текущий
+func loadKeys(t *testing.T, encoded ...string) {
+	t.Helper()
+	t.Setenv("SECRETS_KEY", strings.Join(encoded, ","))
+	if err := Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+}
+
+func TestEncryptDecryptRoundTrip(t *testing.T) {
+	loadKeys(t, newTestKey(t))
+
+	encrypted, err := Encrypt("api-secret")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	if !strings.HasPrefix(encrypted, prefix) || strings.Contains(encrypted, "api-secret") {
+		t.Errorf("зашифрованное значение %q", encrypted)
+	}
+	if again, _ := Encrypt("api-secret"); again == encrypted {
+		t.Errorf("одинаковые шифротексты: nonce не случайный")
+	}
+
+	plain, err := Decrypt(encrypted)
+	if err != nil || plain != "api-secret" {
+		t.Errorf("Decrypt = %q, %v", plain, err)
+	}
+	if NeedsRotation(encrypted) {
+		t.Errorf("значение, зашифрованное текущим ключом, требует ротации")
+	}
+
+	if empty, err := Encrypt(""); err != nil || empty != "" {
+		t.Errorf("пустое значение зашифровано в %q, %v", empty, err)
+	}
+}
+
+func TestDecryptTamperedValue(t *testing.T) {
+	loadKeys(t, newTestKey(t))
+	encrypted, err := Encrypt("api-secret")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+
+	// меняем последний байт подписанного шифротекста
+	id, payload, _ := strings.Cut(strings.TrimPrefix(encrypted, prefix), ":")
+	sealed, _ := base64.StdEncoding.DecodeString(payload)
+	sealed[len(sealed)-1] ^= 1
+	tampered := prefix + id + ":" + base64.StdEncoding.EncodeToString(sealed)
+
+	tests := map[string]string{
+		"измененный шифротекст": tampered,
+		"обрезанная запись":     prefix + id + ":" + base64.StdEncoding.EncodeToString(sealed[:4]),
+		"без id ключа":          prefix + payload,
+		"неизвестный ключ":      prefix + "00000000:" + payload,
+	}
+	for name, value := range tests {
+		if plain, err := Decrypt(value); err == nil {
+			t.Errorf("%s: расшифровано %q без ошибки", name, plain)
+		}
+	}
+}
+
+func TestDecryptWithOldKeyAfterRotation(t *testing.T) {
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	loadKeys(t, oldKey)
+	encrypted, err := Encrypt("api-secret")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+
+	// новый ключ — первым, старый остается для чтения
+	loadKeys(t, newKey, oldKey)
+	if plain, err := Decrypt(encrypted); err != nil || plain != "api-secret" {
+		t.Errorf("Decrypt старым ключом = %q, %v", plain, err)
+	}
+	if !NeedsRotation(encrypted) {
+		t.Errorf("значение под старым ключом не требует ротации")
+	}
+
+	rotated, err := Reencrypt(encrypted)
+	if err != nil {
+		t.Fatalf("Reencrypt: %v", err)
+	}
+	if NeedsRotation(rotated) {
+		t.Errorf("после Reencrypt значение все еще под старым ключом")
+	}
+
+	// старый ключ убран: перешифрованное читается, старая запись — нет
+	loadKeys(t, newKey)
+	if plain, err := Decrypt(rotated); err != nil || plain != "api-secret" {
+		t.Errorf("Decrypt после ротации = %q, %v", plain, err)
+	}
+	if _, err := Decrypt(encrypted); err == nil {
+		t.Errorf("запись под удаленным ключом расшифрована")
+	}
+}
+
+func TestPlaintextPassThrough(t *testing.T) {
+	loadKeys(t, newTestKey(t))
+
+	// записи, сохраненные до появления шифрования
+	if plain, err := Decrypt("legacy-secret"); err != nil || plain != "legacy-secret" {
+		t.Errorf("Decrypt открытого текста = %q, %v", plain, err)
+	}
+	if !NeedsRotation("legacy-secret") {
+		t.Errorf("открытый текст не требует шифрования")
+	}
+	if NeedsRotation("") {
+		t.Errorf("пустое значение требует шифрования")
+	}
+
+	encrypted, err := Reencrypt("legacy-secret")
+	if err != nil || !strings.HasPrefix(encrypted, prefix) {
+		t.Errorf("Reencrypt открытого текста = %q, %v", encrypted, err)
+	}
+}
@@ -0,0 +1,214 @@
+package spotAllPNL
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"sort"
+	"telegram-date-bot/rates"
+	"time"
+)
+
+// CostMethod — способ сопоставления продаж с покупками при расчете реализованного PnL
+type CostMethod string
+
+const (
+	MethodFIFO    CostMethod = "fifo" // первыми продаются самые ранние покупки
+	MethodLIFO    CostMethod = "lifo" // первыми продаются самые поздние покупки
+	MethodHIFO    CostMethod = "hifo" // первыми продаются самые дорогие покупки
+	MethodAverage CostMethod = "avg"  // все покупки сливаются в один лот по скользящей средней
+)
+
+// CostMethods — методы в порядке показа в настройках
+var CostMethods = []CostMethod{MethodFIFO, MethodLIFO, MethodHIFO, MethodAverage}
+
+// ParseCostMethod возвращает метод по названию; неизвестное значение — FIFO
+func ParseCostMethod(s string) CostMethod {
+	for _, m := range CostMethods {
+		if string(m) == s {
+			return m
+		}
+	}
+	return MethodFIFO
+}
+
+// Title — название метода для пользователя
+func (m CostMethod) Title() string {
+	switch m {
+	case MethodLIFO:
+		return "LIFO"
+	case MethodHIFO:
+		return "HIFO"
+	case MethodAverage:
+		return "Средняя"
+	default:
+		return "FIFO"
+	}
+}
+
+// Lot — купленные монеты, еще не сопоставленные с продажами
+type Lot struct {
+	OpenTime int64   // мс
+	Quantity float64 // за вычетом комиссии в базовой монете
+	UnitCost float64 // цена с учетом комиссии
+}
+
+// Disposal — продажа монет одного лота
+type Disposal struct {
+	Symbol    string
+	OpenTime  int64 // мс, время покупки лота
+	CloseTime int64 // мс, время продажи
+	Quantity  float64
+	Cost      float64 // себестоимость проданных монет
+	Proceeds  float64 // выручка за вычетом комиссии
+}
+
+func (d Disposal) PNL() float64 {
+	return d.Proceeds - d.Cost
+}
+
+// HoldingPeriod — сколько монеты пролежали от покупки до продажи
+func (d Disposal) HoldingPeriod() time.Duration {
+	return time.Duration(d.CloseTime-d.OpenTime) * time.Millisecond
+}
+
+// OpenAvgPrice — средняя цена монет, которые еще не проданы; 0, если открытых лотов нет.
+// С методом MethodAverage это скользящая средняя текущей позиции: когда позиция
+// закрывается полностью, следующая покупка начинает ее заново.
+func (a TradeAnalysis) OpenAvgPrice() float64 {
+	var cost, quantity float64
+	for _, lot := range a.OpenLots {
+		cost += lot.UnitCost * lot.Quantity
+		quantity += lot.Quantity
+	}
+	if quantity <= lotEpsilon {
+		return 0
+	}
+	return cost / quantity
+}
+
+// остатки меньше этого считаем ошибкой округления
+const lotEpsilon = 1e-12
+
+// lotBook хранит открытые лоты символа и списывает их при продажах выбранным методом
+type lotBook struct {
+	symbol string
+	method CostMethod
+	lots   []Lot
+}
+
+func newLotBook(symbol string, method CostMethod) *lotBook {
+	return &lotBook{symbol: symbol, method: method}
+}
+
+func (b *lotBook) buy(lot Lot) {
+	if lot.Quantity <= lotEpsilon {
+		return
+	}
+	if b.method == MethodAverage && len(b.lots) > 0 {
+		// у сводного лота остается время первой покупки
+		pooled := &b.lots[0]
+		totalCost := pooled.UnitCost*pooled.Quantity + lot.UnitCost*lot.Quantity
+		pooled.Quantity += lot.Quantity
+		pooled.UnitCost = totalCost / pooled.Quantity
+		return
+	}
+	b.lots = append(b.lots, lot)
+}
+
+// sell списывает quantity монет по цене unitProceeds. Возвращает продажи по лотам
+// и количество, для которого лотов не нашлось (монеты пришли депозитом или куплены
+// раньше начала истории).
+func (b *lotBook) sell(closeTime int64, quantity, unitProceeds float64) ([]Disposal, float64) {
+	var disposals []Disposal
+	for quantity > lotEpsilon && len(b.lots) > 0 {
+		i := b.next()
+		lot := &b.lots[i]
+
+		matched := lot.Quantity
+		if quantity < matched {
+			matched = quantity
+		}
+		disposals = append(disposals, Disposal{
+			Symbol:    b.symbol,
+			OpenTime:  lot.OpenTime,
+			CloseTime: closeTime,
+			Quantity:  matched,
+			Cost:      matched * lot.UnitCost,
+			Proceeds:  matched * unitProceeds,
+		})
+
+		quantity -= matched
+		lot.Quantity -= matched
+		if lot.Quantity <= lotEpsilon {
+			b.lots = append(b.lots[:i], b.lots[i+1:]...)
+		}
+	}
+	if quantity <= lotEpsilon {
+		quantity = 0
+	}
+	return disposals, quantity
+}
+
+// next — индекс лота, который списывается следующим
+func (b *lotBook) next() int {
+	switch b.method {
+	case MethodLIFO:
+		return len(b.lots) - 1
+	case MethodHIFO:
+		best := 0
+		for i, lot := range b.lots {
+			if lot.UnitCost > b.lots[best].UnitCost {
+				best = i
+			}
+		}
+		return best
+	default:
+		return 0
+	}
+}
+
+// ExportDisposalsCSV — продажи по лотам, по времени продажи; суммы в валюте отчета currency
+func ExportDisposalsCSV(analysis map[string]TradeAnalysis, currency rates.Currency) ([]byte, error) {
+	var disposals []Disposal
+	for _, asset := range analysis {
+		disposals = append(disposals, asset.Disposals...)
+	}
+	sort.SliceStable(disposals, func(i, j int) bool { return disposals[i].CloseTime < disposals[j].CloseTime })
+
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+
+	unit := " (" + currency.Code + ")"
+	header := []string{"Символ", "Куплено", "Продано", "Количество", "Себестоимость" + unit, "Выручка" + unit, "PNL" + unit, "Дней в позиции"}
+	if err := writer.Write(header); err != nil {
+		return nil, err
+	}
+	for _, d := range disposals {
+		record := []string{
+			d.Symbol,
+			formatMs(d.OpenTime),
+			formatMs(d.CloseTime),
+			fmt.Sprintf("%.8f", d.Quantity),
+			currency.Amount(d.Cost),
+			currency.Amount(d.Proceeds),
+			currency.Amount(d.PNL()),
+			fmt.Sprintf("%.1f", d.HoldingPeriod().Hours()/24),
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func formatMs(ms int64) string {
+	if ms <= 0 {
+		return ""
+	}
+	return time.UnixMilli(ms).UTC().Format("2006-01-02 15:04:05")
+}
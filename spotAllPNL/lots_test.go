@@ -0,0 +1,82 @@
+package spotAllPNL
+
+import (
+	"testing"
+)
+
+func TestAnalyzeTradeHistoryCostMethods(t *testing.T) {
+	// три покупки по 1 BTC: 100 (+1 USDT комиссии), 300 и 200; продажа 1.5 BTC по 250
+	// с комиссией 5 USDT — выручка 370
+	trades := []Execution{
+		newTrade("BTCUSDT", "Buy", 1, 100, 1, 1, "USDT"),
+		newTrade("BTCUSDT", "Buy", 2, 300, 1, 0, "USDT"),
+		newTrade("BTCUSDT", "Buy", 3, 200, 1, 0, "USDT"),
+		newTrade("BTCUSDT", "Sell", 4, 250, 1.5, 5, "USDT"),
+	}
+
+	tests := []struct {
+		method       CostMethod
+		costOfSold   float64
+		openAvgPrice float64
+		disposals    int
+	}{
+		// первыми — лот 101 целиком и половина лота 300
+		{MethodFIFO, 101 + 150, (150 + 200) / 1.5, 2},
+		// первыми — лот 200 целиком и половина лота 300
+		{MethodLIFO, 200 + 150, (101 + 150) / 1.5, 2},
+		// первыми — лот 300 целиком и половина лота 200
+		{MethodHIFO, 300 + 100, (101 + 100) / 1.5, 2},
+		// один сводный лот по 601/3
+		{MethodAverage, 601.0 / 2, 601.0 / 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.method), func(t *testing.T) {
+			analysis := AnalyzeTradeHistory(GroupTradesBySymbol(trades), tt.method)["BTCUSDT"]
+
+			if !almostEqual(analysis.CostOfSold, tt.costOfSold) {
+				t.Errorf("CostOfSold = %v, ожидалось %v", analysis.CostOfSold, tt.costOfSold)
+			}
+			if !almostEqual(analysis.RealizedPNL, 370-tt.costOfSold) {
+				t.Errorf("RealizedPNL = %v, ожидалось %v", analysis.RealizedPNL, 370-tt.costOfSold)
+			}
+			if !almostEqual(analysis.OpenAvgPrice(), tt.openAvgPrice) {
+				t.Errorf("OpenAvgPrice = %v, ожидалось %v", analysis.OpenAvgPrice(), tt.openAvgPrice)
+			}
+			if len(analysis.Disposals) != tt.disposals {
+				t.Errorf("продаж по лотам = %d, ожидалось %d", len(analysis.Disposals), tt.disposals)
+			}
+			// от метода зависит только сопоставление, итоги покупок и продаж общие
+			if !almostEqual(analysis.TotalCost, 601) || !almostEqual(analysis.TotalRevenue, 370) ||
+				!almostEqual(analysis.TotalFees, 6) || !almostEqual(analysis.AvgBuyPrice, 601.0/3) {
+				t.Errorf("итоги = %+v", analysis)
+			}
+			if analysis.UnmatchedQuantity != 0 {
+				t.Errorf("UnmatchedQuantity = %v", analysis.UnmatchedQuantity)
+			}
+		})
+	}
+}
+
+func TestAnalyzeTradeHistoryUnmatchedAndReset(t *testing.T) {
+	trades := []Execution{
+		newTrade("ETHUSDT", "Buy", 1, 1000, 1, 0, "USDT"),
+		// продано больше купленного: 0.5 ETH пришли депозитом
+		newTrade("ETHUSDT", "Sell", 2, 1500, 1.5, 0, "USDT"),
+		// после закрытия позиции средняя начинается заново
+		newTrade("ETHUSDT", "Buy", 3, 2000, 2, 0, "USDT"),
+		newTrade("ETHUSDT", "Buy", 4, 3000, 2, 0, "USDT"),
+	}
+	for _, method := range CostMethods {
+		analysis := AnalyzeTradeHistory(GroupTradesBySymbol(trades), method)["ETHUSDT"]
+		if !almostEqual(analysis.UnmatchedQuantity, 0.5) {
+			t.Errorf("%s: UnmatchedQuantity = %v, ожидалось 0.5", method, analysis.UnmatchedQuantity)
+		}
+		// реализованный PnL считается только по сопоставленному 1 ETH
+		if !almostEqual(analysis.RealizedPNL, 500) {
+			t.Errorf("%s: RealizedPNL = %v, ожидалось 500", method, analysis.RealizedPNL)
+		}
+		if !almostEqual(analysis.OpenAvgPrice(), 2500) {
+			t.Errorf("%s: OpenAvgPrice = %v, ожидалось 2500", method, analysis.OpenAvgPrice())
+		}
+	}
+}
@@ -2,140 +2,68 @@ package spotAllPNL
 
 import (
 	"bytes"
+	"context"
 	"encoding/csv"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"math"
-	"net/http"
-	"net/url"
 	"sort"
 	"strconv"
 	"strings"
 	"telegram-date-bot/exchanges"
+	"telegram-date-bot/rates"
 	"time"
 )
 
-type Execution struct {
-	Symbol   string `json:"symbol"`
-	Price    string `json:"execPrice"`
-	Quantity string `json:"execQty"`
-	Side     string `json:"side"`
-}
-
-type ExecutionResponse struct {
-	RetCode int    `json:"retCode"`
-	RetMsg  string `json:"retMsg"`
-	Result  struct {
-		List           []Execution `json:"list"`
-		NextPageCursor string      `json:"nextPageCursor"`
-	} `json:"result"`
-}
+// Execution — исполнение из кэша сделок, та же структура, что и у бирж
+type Execution = exchanges.Execution
 
 type TradeAnalysis struct {
 	Symbol              string
-	TotalCost           float64 // Сколько всего потрачено USDT на покупки
-	TotalRevenue        float64 // Сколько всего получено USDT от продаж
+	TotalCost           float64 // Сколько всего потрачено на покупки, в котировке пары
+	TotalRevenue        float64 // Сколько всего получено от продаж, в котировке пары
 	TotalQuantityBought float64 // Сколько всего монет куплено
 	TotalQuantitySold   float64 // Сколько всего монет продано
 	AvgBuyPrice         float64
 	RealizedPNL         float64
+	TotalFees           float64            // Комиссии, пересчитанные в котировку пары по цене на момент сделки
+	UnpricedFees        map[string]float64 // Комиссии в монетах, для которых не нашлось цены
+	CostOfSold          float64            // Себестоимость проданных монет по выбранному методу
+	UnmatchedQuantity   float64            // Продано монет, для которых не нашлось покупок
+	Disposals           []Disposal         // Продажи по лотам
+	OpenLots            []Lot              // Лоты, которые еще не проданы
 }
 
 type DisplayAsset struct {
-	Name           string  // "BTC"
-	Symbol         string  // "BTCUSDT"
-	Quantity       float64 // Количество на балансе
-	CurrentPrice   float64 // Текущая цена
-	CurrentValue   float64 // Текущая стоимость (Quantity * CurrentPrice)
-	AvgBuyPrice    float64 // Средняя цена покупки
-	UnrealizedPNL  float64 // Нереализованный PnL в $
-	PNLPercentage  float64 // PnL в %
+	Name          string  // "BTC"
+	Symbol        string  // "BTCUSDT"
+	Quantity      float64 // Количество на балансе
+	CurrentPrice  float64 // Текущая цена
+	CurrentValue  float64 // Текущая стоимость (Quantity * CurrentPrice)
+	AvgBuyPrice   float64 // Средняя цена покупки
+	UnrealizedPNL float64 // Нереализованный PnL в $
+	PNLPercentage float64 // PnL в %
 }
 
-func GetAllTradesHistory(client *exchanges.BybitClient) ([]Execution, error) {
-	baseURL := "https://api.bybit.com/v5/execution/list"
-	httpClient := &http.Client{Timeout: 10 * time.Second}
-	var allTrades []Execution
-
-	now := time.Now()
+func GetAllTradesHistory(ctx context.Context, client exchanges.Exchange) ([]Execution, error) {
 	maxDaysBack := 728
-	chunkDays := 7
+	startTime := time.Now().AddDate(0, 0, -maxDaysBack).UnixMilli()
 
 	log.Printf("[GetAllTradesHistory] Начинаем сбор истории за %d дней", maxDaysBack)
 
-	for daysBack := 0; daysBack < maxDaysBack; daysBack += chunkDays {
-		endTime := now.AddDate(0, 0, -daysBack).UnixMilli()
-		startTime := now.AddDate(0, 0, -(daysBack + chunkDays)).UnixMilli()
-
-		log.Printf("[GetAllTradesHistory] Период: %d-%d дней назад", daysBack, daysBack+chunkDays)
-
-		cursor := ""
-		for {
-			params := url.Values{}
-			params.Add("category", "spot")
-			params.Add("limit", "100")
-			params.Add("startTime", fmt.Sprintf("%d", startTime))
-			params.Add("endTime", fmt.Sprintf("%d", endTime))
-			if cursor != "" {
-				params.Add("cursor", cursor)
-			}
-
-			timestamp := fmt.Sprintf("%d", time.Now().UnixMilli())
-			recvWindow := "20000"
-			queryString := params.Encode()
-			signature := client.GenerateSignature(timestamp, recvWindow, queryString)
-
-			fullURL := fmt.Sprintf("%s?%s", baseURL, queryString)
-			req, err := http.NewRequest("GET", fullURL, nil)
-			if err != nil {
-				return nil, fmt.Errorf("ошибка создания запроса всей истории: %v", err)
-			}
-
-			req.Header.Set("X-BAPI-API-KEY", client.ApiKey)
-			req.Header.Set("X-BAPI-TIMESTAMP", timestamp)
-			req.Header.Set("X-BAPI-RECV-WINDOW", recvWindow)
-			req.Header.Set("X-BAPI-SIGN", signature)
-
-			res, err := httpClient.Do(req)
-			if err != nil {
-				return nil, fmt.Errorf("ошибка выполнения запроса всей истории: %v", err)
-			}
-			defer res.Body.Close()
-
-			body, err := io.ReadAll(res.Body)
-			if err != nil {
-				return nil, fmt.Errorf("ошибка чтения ответа всей истории: %v", err)
-			}
-
-			var responseData ExecutionResponse
-			if err := json.Unmarshal(body, &responseData); err != nil {
-				return nil, fmt.Errorf("ошибка парсинга JSON всей истории: %s", string(body))
-			}
-
-			if responseData.RetCode != 0 {
-				return nil, fmt.Errorf("API ошибка: %s (код %d)", responseData.RetMsg, responseData.RetCode)
-			}
-
-			if len(responseData.Result.List) > 0 {
-				allTrades = append(allTrades, responseData.Result.List...)
-				log.Printf("[GetAllTradesHistory] +%d сделок", len(responseData.Result.List))
-			}
-
-			if responseData.Result.NextPageCursor == "" {
-				break
-			}
-
-			cursor = responseData.Result.NextPageCursor
-			time.Sleep(100 * time.Millisecond)
-		}
-
-		time.Sleep(100 * time.Millisecond)
+	executions, err := client.GetExecutionsSince(ctx, startTime)
+	var limited *exchanges.HistoryLimitError
+	if errors.As(err, &limited) {
+		log.Printf("[GetAllTradesHistory] %v", limited)
+		err = nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("ошибка получения всей истории: %w", err)
 	}
 
-	log.Printf("[GetAllTradesHistory] Всего: %d сделок", len(allTrades))
-	return allTrades, nil
+	log.Printf("[GetAllTradesHistory] Всего: %d сделок", len(executions))
+	return executions, nil
 }
 
 func GroupTradesBySymbol(allTrades []Execution) map[string][]Execution {
@@ -147,36 +75,87 @@ func GroupTradesBySymbol(allTrades []Execution) map[string][]Execution {
 	return groupedTrades
 }
 
-func AnalyzeTradeHistory(groupedTrades map[string][]Execution) map[string]TradeAnalysis {
+// AnalyzeTradeHistory считает реализованный PnL, сопоставляя продажи с покупками методом
+// method, с учетом комиссий: комиссия покупки входит в себестоимость, комиссия продажи
+// уменьшает выручку. Комиссия в базовой монете (так Bybit берет ее на спотовых покупках)
+// уменьшает купленное количество. AvgBuyPrice — средняя цена всех покупок.
+func AnalyzeTradeHistory(groupedTrades map[string][]Execution, method CostMethod) map[string]TradeAnalysis {
 	analysisResult := make(map[string]TradeAnalysis)
+	prices := newFeePrices(groupedTrades)
 
 	for symbol, trades := range groupedTrades {
-		var totalCost, totalRevenue, totalQuantityBought, totalQuantitySold float64
+		var totalCost, totalRevenue, totalQuantityBought, totalQuantitySold, totalFees float64
+		var costOfSold, realizedPNL, unmatched float64
+		var disposals []Disposal
+		unpricedFees := make(map[string]float64)
+		book := newLotBook(symbol, method)
+
+		// лоты сопоставляются по времени; кэш отдает сделки по порядку, но это не гарантия API
+		trades = append([]Execution(nil), trades...)
+		sort.SliceStable(trades, func(i, j int) bool { return trades[i].ExecTimeMs() < trades[j].ExecTimeMs() })
 
 		for _, trade := range trades {
 			price, _ := strconv.ParseFloat(trade.Price, 64)
 			quantity, _ := strconv.ParseFloat(trade.Quantity, 64)
+			fee, _ := strconv.ParseFloat(trade.ExecFee, 64)
+
+			var feeValue, feeQuantity float64
+			switch feeKind(trade) {
+			case feeInQuote:
+				feeValue = fee
+			case feeInBase:
+				feeValue = fee * price
+				feeQuantity = fee
+			default:
+				rate, ok := prices.at(trade.FeeCurrency, symbol, trade.ExecTimeMs())
+				if !ok {
+					unpricedFees[trade.FeeCurrency] += fee
+					break
+				}
+				feeValue = fee * rate
+			}
+			totalFees += feeValue
 
 			switch trade.Side {
 			case "Buy":
-				totalCost += price * quantity
-				totalQuantityBought += quantity
+				cost := price * quantity
+				received := quantity
+				if feeQuantity > 0 {
+					// комиссия удержана из купленных монет: заплачено столько же, получено меньше
+					received -= feeQuantity
+				} else {
+					cost += feeValue
+				}
+				totalCost += cost
+				totalQuantityBought += received
+				if received > 0 {
+					book.buy(Lot{OpenTime: trade.ExecTimeMs(), Quantity: received, UnitCost: cost / received})
+				}
 			case "Sell":
-				totalRevenue += price * quantity
+				proceeds := price*quantity - feeValue
+				totalRevenue += proceeds
 				totalQuantitySold += quantity
+				if quantity <= 0 {
+					continue
+				}
+				sold, rest := book.sell(trade.ExecTimeMs(), quantity, proceeds/quantity)
+				for _, d := range sold {
+					costOfSold += d.Cost
+					realizedPNL += d.PNL()
+				}
+				disposals = append(disposals, sold...)
+				unmatched += rest
 			}
 		}
 
-		var avgBuyPrice, realizedPNL float64
+		var avgBuyPrice float64
 		if totalQuantityBought > 0 {
 			avgBuyPrice = totalCost / totalQuantityBought
 		}
 
-		if totalQuantitySold > 0 {
-			costOfGoodsSold := totalQuantitySold * avgBuyPrice
-			realizedPNL = totalRevenue - costOfGoodsSold
+		if len(unpricedFees) == 0 {
+			unpricedFees = nil
 		}
-
 		analysisResult[symbol] = TradeAnalysis{
 			Symbol:              symbol,
 			TotalCost:           totalCost,
@@ -185,69 +164,182 @@ func AnalyzeTradeHistory(groupedTrades map[string][]Execution) map[string]TradeA
 			TotalQuantitySold:   totalQuantitySold,
 			AvgBuyPrice:         avgBuyPrice,
 			RealizedPNL:         realizedPNL,
+			TotalFees:           totalFees,
+			UnpricedFees:        unpricedFees,
+			CostOfSold:          costOfSold,
+			UnmatchedQuantity:   unmatched,
+			Disposals:           disposals,
+			OpenLots:            book.lots,
 		}
 	}
 	return analysisResult
 }
 
-func FormatTotalPNLMessage(analysis map[string]TradeAnalysis) string {
+const (
+	feeInQuote = iota
+	feeInBase
+	feeInOther
+)
+
+// feeKind определяет, в какой валюте пары списана комиссия. Без валюты считаем,
+// что в котируемой — так записаны сделки, сохраненные до появления feeCurrency.
+func feeKind(trade Execution) int {
+	switch {
+	case trade.FeeCurrency == "" || strings.HasSuffix(trade.Symbol, trade.FeeCurrency):
+		return feeInQuote
+	case strings.HasPrefix(trade.Symbol, trade.FeeCurrency):
+		return feeInBase
+	default:
+		return feeInOther
+	}
+}
+
+type pricePoint struct {
+	time  int64
+	price float64
+}
+
+// feePrices — цены пар по сделкам истории; по ним пересчитываются комиссии
+// в сторонних монетах (например, BNB на Binance)
+type feePrices map[string][]pricePoint
+
+func newFeePrices(groupedTrades map[string][]Execution) feePrices {
+	prices := make(feePrices)
+	for symbol, trades := range groupedTrades {
+		for _, trade := range trades {
+			price, _ := strconv.ParseFloat(trade.Price, 64)
+			if price > 0 {
+				prices[symbol] = append(prices[symbol], pricePoint{time: trade.ExecTimeMs(), price: price})
+			}
+		}
+	}
+	for symbol := range prices {
+		points := prices[symbol]
+		sort.Slice(points, func(i, j int) bool { return points[i].time < points[j].time })
+	}
+	return prices
+}
+
+// at — цена монеты coin в котировке пары symbol на момент execTime: последняя сделка
+// до него, а если таких нет — первая после
+func (p feePrices) at(coin, symbol string, execTime int64) (float64, bool) {
+	usd := strings.HasSuffix(symbol, "USDT") || strings.HasSuffix(symbol, "USDC")
+	if usd && (coin == "USDT" || coin == "USDC") {
+		return 1, true
+	}
+	var points []pricePoint
+	for pair, pairPoints := range p {
+		quote := strings.TrimPrefix(pair, coin)
+		if quote != pair && quote != "" && strings.HasSuffix(symbol, quote) {
+			points = pairPoints
+			break
+		}
+	}
+	if len(points) == 0 {
+		return 0, false
+	}
+	i := sort.Search(len(points), func(i int) bool { return points[i].time > execTime })
+	if i == 0 {
+		return points[0].price, true
+	}
+	return points[i-1].price, true
+}
+
+// formatUnpricedFees — «0.5 BNB, 2 MNT» для комиссий, которые не удалось пересчитать
+func formatUnpricedFees(fees map[string]float64) string {
+	coins := make([]string, 0, len(fees))
+	for coin := range fees {
+		coins = append(coins, coin)
+	}
+	sort.Strings(coins)
+
+	parts := make([]string, 0, len(coins))
+	for _, coin := range coins {
+		parts = append(parts, strconv.FormatFloat(fees[coin], 'f', -1, 64)+" "+coin)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// FormatTotalPNLMessage — реализованный PnL по символам; сделки уже пересчитаны в валюту
+// отчета currency
+func FormatTotalPNLMessage(analysis map[string]TradeAnalysis, method CostMethod, currency rates.Currency) string {
 	if len(analysis) == 0 {
 		return "История сделок не найдена."
 	}
 
-var relevantAssets []TradeAnalysis
+	var relevantAssets []TradeAnalysis
 
-for _, relevantAsset := range analysis {relevantAssets = append(relevantAssets, relevantAsset)}
+	for _, relevantAsset := range analysis {
+		relevantAssets = append(relevantAssets, relevantAsset)
+	}
 
-sort.Slice(relevantAssets, func(i, j int) bool {	
+	sort.Slice(relevantAssets, func(i, j int) bool {
 		return math.Abs(relevantAssets[i].RealizedPNL) > math.Abs(relevantAssets[j].RealizedPNL)
 	})
 
-if len(relevantAssets) == 0 {return "История сделок не найдена."}
-
-var messageBuilder strings.Builder
-	var totalRealizedPNL float64
+	var messageBuilder strings.Builder
+	var totalRealizedPNL, totalFees float64
+	unpricedFees := make(map[string]float64)
+	var unmatched []string
 
-	messageBuilder.WriteString("📊 *Отчет по реализованному PnL:*\n\n")
-	messageBuilder.WriteString("`") 
-	messageBuilder.WriteString(fmt.Sprintf("%-12s | %-10s | %-7s\n", "Актив", "PnL ($)", "ROI (%)"))
-	messageBuilder.WriteString("-------------------------------------\n")
+	messageBuilder.WriteString(fmt.Sprintf("📊 *Отчет по реализованному PnL (%s):*\n\n", method.Title()))
+	messageBuilder.WriteString("`")
+	messageBuilder.WriteString(fmt.Sprintf("%-12s | %-10s | %-7s | %s\n", "Актив", "PnL ("+currency.Sign+")", "ROI (%)", "Комиссии ("+currency.Sign+")"))
+	messageBuilder.WriteString("----------------------------------------------------\n")
 
 	for _, asset := range relevantAssets {
 		totalRealizedPNL += asset.RealizedPNL
+		totalFees += asset.TotalFees
+		for coin, fee := range asset.UnpricedFees {
+			unpricedFees[coin] += fee
+		}
 
 		// Считаем ROI
-		costOfSold := asset.TotalQuantitySold * asset.AvgBuyPrice
 		roi := 0.0
-		if costOfSold > 0 {
-			roi = (asset.RealizedPNL / costOfSold) * 100
+		if asset.CostOfSold > 0 {
+			roi = (asset.RealizedPNL / asset.CostOfSold) * 100
+		}
+		if asset.UnmatchedQuantity > 0 {
+			unmatched = append(unmatched, fmt.Sprintf("%s %s", asset.Symbol, strconv.FormatFloat(asset.UnmatchedQuantity, 'f', -1, 64)))
 		}
-		
-		messageBuilder.WriteString(fmt.Sprintf("%-12s | %-10.2f | %-7.2f\n", asset.Symbol, asset.RealizedPNL, roi))
+
+		messageBuilder.WriteString(fmt.Sprintf("%-12s | %-10s | %-7.2f | %s\n", asset.Symbol, currency.Amount(asset.RealizedPNL), roi, currency.Amount(asset.TotalFees)))
+	}
+	messageBuilder.WriteString("`\n")
+	messageBuilder.WriteString(fmt.Sprintf("\n*Общий итог: %s*", currency.Format(totalRealizedPNL)))
+	messageBuilder.WriteString(fmt.Sprintf("\n*Комиссии: %s*", currency.Format(totalFees)))
+	if len(unpricedFees) > 0 {
+		messageBuilder.WriteString("\n⚠️ Без курса, в итог не вошли: " + formatUnpricedFees(unpricedFees))
+	}
+	if len(unmatched) > 0 {
+		messageBuilder.WriteString("\n⚠️ Проданы монеты без покупок в истории (депозит или покупка до начала истории), в PnL не вошли: " +
+			strings.Join(unmatched, ", "))
 	}
-		messageBuilder.WriteString("`\n") 
-	messageBuilder.WriteString(fmt.Sprintf("\n*Общий итог: %.2f$*", totalRealizedPNL))
 
 	return messageBuilder.String()
 }
 
-func ExportToCSV(analysis map[string]TradeAnalysis) ([]byte, error) {
-	var buffer bytes.Buffer 
+// ExportToCSV — реализованный PnL по символам, суммы в валюте отчета currency
+func ExportToCSV(analysis map[string]TradeAnalysis, currency rates.Currency) ([]byte, error) {
+	var buffer bytes.Buffer
 	writer := csv.NewWriter(&buffer)
 
-	header := []string{"Символ", "Реализованный PNL", "Всего потрачено", "Всего получено", "Средняя цена покупки", "Куплено", "Продано"}
+	unit := " (" + currency.Code + ")"
+	header := []string{"Символ", "Реализованный PNL" + unit, "Всего потрачено" + unit, "Всего получено" + unit, "Средняя цена покупки" + unit, "Куплено", "Продано", "Комиссии" + unit, "Комиссии без курса"}
 	if err := writer.Write(header); err != nil {
 		return nil, err
 	}
 	for _, asset := range analysis {
 		record := []string{
 			asset.Symbol,
-			fmt.Sprintf("%.2f", asset.RealizedPNL),
-			fmt.Sprintf("%.2f", asset.TotalCost),
-			fmt.Sprintf("%.2f", asset.TotalRevenue),
-			fmt.Sprintf("%.2f", asset.AvgBuyPrice),
+			currency.Amount(asset.RealizedPNL),
+			currency.Amount(asset.TotalCost),
+			currency.Amount(asset.TotalRevenue),
+			currency.Amount(asset.AvgBuyPrice),
 			fmt.Sprintf("%.4f", asset.TotalQuantityBought),
 			fmt.Sprintf("%.4f", asset.TotalQuantitySold),
+			fmt.Sprintf("%.*f", currency.Decimals+2, asset.TotalFees),
+			formatUnpricedFees(asset.UnpricedFees),
 		}
 
 		if err := writer.Write(record); err != nil {
@@ -255,9 +347,8 @@ func ExportToCSV(analysis map[string]TradeAnalysis) ([]byte, error) {
 		}
 	}
 	writer.Flush()
-if err := writer.Error(); err != nil {
+	if err := writer.Error(); err != nil {
 		return nil, err
 	}
 	return buffer.Bytes(), nil
 }
-
@@ -0,0 +1,90 @@
+package spotAllPNL
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func newTrade(symbol, side string, execTime int64, price, quantity, fee float64, feeCurrency string) Execution {
+	return Execution{
+		Symbol:      symbol,
+		Side:        side,
+		ExecID:      strconv.FormatInt(execTime, 10),
+		ExecTime:    strconv.FormatInt(execTime, 10),
+		Price:       strconv.FormatFloat(price, 'f', -1, 64),
+		Quantity:    strconv.FormatFloat(quantity, 'f', -1, 64),
+		ExecFee:     strconv.FormatFloat(fee, 'f', -1, 64),
+		FeeCurrency: feeCurrency,
+	}
+}
+
+func almostEqual(a, b float64) bool {
+	return math.Abs(a-b) < 1e-9
+}
+
+func TestAnalyzeTradeHistoryFees(t *testing.T) {
+	tests := []struct {
+		name         string
+		trades       []Execution
+		realizedPNL  float64
+		totalFees    float64
+		unpricedFees map[string]float64
+	}{
+		{
+			// комиссия удержана из купленных монет: получено 0.99 BTC за 100 USDT
+			name: "в базовой монете",
+			trades: []Execution{
+				newTrade("BTCUSDT", "Buy", 1, 100, 1, 0.01, "BTC"),
+				newTrade("BTCUSDT", "Sell", 2, 110, 0.99, 0, "USDT"),
+			},
+			realizedPNL: 0.99*110 - 100,
+			totalFees:   1,
+		},
+		{
+			// комиссия в BNB пересчитывается по цене BNBUSDT из сделок истории
+			name: "в сторонней монете",
+			trades: []Execution{
+				newTrade("BNBUSDT", "Buy", 1, 500, 1, 0, "USDT"),
+				newTrade("BTCUSDT", "Buy", 2, 100, 1, 0.002, "BNB"),
+				newTrade("BTCUSDT", "Sell", 3, 120, 1, 0.002, "BNB"),
+			},
+			realizedPNL: (120 - 1) - (100 + 1),
+			totalFees:   2,
+		},
+		{
+			// цены монеты комиссии нет — комиссия не учитывается, но показывается отдельно
+			name: "без цены",
+			trades: []Execution{
+				newTrade("BTCUSDT", "Buy", 1, 100, 1, 3, "MNT"),
+				newTrade("BTCUSDT", "Sell", 2, 120, 1, 0, "USDT"),
+			},
+			realizedPNL:  20,
+			unpricedFees: map[string]float64{"MNT": 3},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, method := range CostMethods {
+				analysis := AnalyzeTradeHistory(GroupTradesBySymbol(tt.trades), method)["BTCUSDT"]
+				if !almostEqual(analysis.RealizedPNL, tt.realizedPNL) {
+					t.Errorf("%s: RealizedPNL = %v, ожидалось %v", method, analysis.RealizedPNL, tt.realizedPNL)
+				}
+				if !almostEqual(analysis.TotalFees, tt.totalFees) {
+					t.Errorf("%s: TotalFees = %v, ожидалось %v", method, analysis.TotalFees, tt.totalFees)
+				}
+				if len(analysis.UnpricedFees) != len(tt.unpricedFees) {
+					t.Errorf("%s: UnpricedFees = %v, ожидалось %v", method, analysis.UnpricedFees, tt.unpricedFees)
+				}
+				for coin, fee := range tt.unpricedFees {
+					if !almostEqual(analysis.UnpricedFees[coin], fee) {
+						t.Errorf("%s: UnpricedFees[%s] = %v, ожидалось %v", method, coin, analysis.UnpricedFees[coin], fee)
+					}
+				}
+				if len(analysis.OpenLots) != 0 {
+					t.Errorf("%s: открытые лоты после полной продажи: %+v", method, analysis.OpenLots)
+				}
+			}
+		})
+	}
+}
@@ -1,45 +1,19 @@
 package spotpnl
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"net/url"
 	"strconv"
 	"strings"
 	"time"
 
 	"telegram-date-bot/exchanges"
+	"telegram-date-bot/rates"
 )
 
-type Execution struct {
-	Symbol   string `json:"symbol"`
-	Price    string `json:"execPrice"`
-	Quantity string `json:"execQty"`
-	Side     string `json:"side"`
-}
-
-type ExecutionResponse struct {
-	RetCode int    `json:"retCode"`
-	RetMsg  string `json:"retMsg"`
-	Result  struct {
-		List           []Execution `json:"list"`
-		NextPageCursor string      `json:"nextPageCursor"`
-	} `json:"result"`
-}
-
-type TickerInfo struct {
-	Symbol    string `json:"symbol"`
-	LastPrice string `json:"lastPrice"`
-}
-
-type TickerResponse struct {
-	Result struct {
-		List []TickerInfo `json:"list"`
-	} `json:"result"`
-}
+// Execution — сделка в общем формате бирж, см. exchanges.Execution
+type Execution = exchanges.Execution
 
 type PortfolioAsset struct {
 	Coin          string
@@ -66,9 +40,7 @@ type TradeAnalysis struct {
 	AvgBuyPrice float64
 }
 
-func GetTradeHistory(client *exchanges.BybitClient, symbol string) ([]Execution, error) {
-	baseURL := "https://api.bybit.com/v5/execution/list"
-	httpClient := &http.Client{Timeout: 10 * time.Second}
+func GetTradeHistory(ctx context.Context, client exchanges.Exchange, symbol string) ([]Execution, error) {
 	var allTrades []Execution
 
 	now := time.Now()
@@ -79,64 +51,11 @@ func GetTradeHistory(client *exchanges.BybitClient, symbol string) ([]Execution,
 		endTime := now.AddDate(0, 0, -daysBack).UnixMilli()
 		startTime := now.AddDate(0, 0, -(daysBack + chunkDays)).UnixMilli()
 
-		cursor := ""
-
-		for {
-			params := url.Values{}
-			params.Add("category", "spot")
-			params.Add("symbol", symbol)
-			params.Add("limit", "100")
-			params.Add("startTime", fmt.Sprintf("%d", startTime))
-			params.Add("endTime", fmt.Sprintf("%d", endTime))
-			if cursor != "" {
-				params.Add("cursor", cursor)
-			}
-
-			timestamp := fmt.Sprintf("%d", time.Now().UnixMilli())
-			recvWindow := "5000"
-			queryString := params.Encode()
-
-			signature := client.GenerateSignature(timestamp, recvWindow, queryString)
-
-			fullURL := fmt.Sprintf("%s?%s", baseURL, queryString)
-			req, err := http.NewRequest("GET", fullURL, nil)
-			if err != nil {
-				return nil, fmt.Errorf("ошибка создания запроса истории: %v", err)
-			}
-
-			req.Header.Set("X-BAPI-API-KEY", client.ApiKey)
-			req.Header.Set("X-BAPI-TIMESTAMP", timestamp)
-			req.Header.Set("X-BAPI-RECV-WINDOW", recvWindow)
-			req.Header.Set("X-BAPI-SIGN", signature)
-
-			res, err := httpClient.Do(req)
-			if err != nil {
-				return nil, fmt.Errorf("ошибка выполнения запроса истории: %v", err)
-			}
-			defer res.Body.Close()
-
-			body, err := io.ReadAll(res.Body)
-			if err != nil {
-				return nil, fmt.Errorf("ошибка чтения ответа истории: %v", err)
-			}
-
-			var responseData ExecutionResponse
-			if err := json.Unmarshal(body, &responseData); err != nil {
-				return nil, fmt.Errorf("ошибка парсинга JSON истории: %s", string(body))
-			}
-
-			if responseData.RetCode != 0 {
-				return nil, fmt.Errorf("API ошибка для %s: %s (код %d)", symbol, responseData.RetMsg, responseData.RetCode)
-			}
-
-			allTrades = append(allTrades, responseData.Result.List...)
-
-			if responseData.Result.NextPageCursor == "" {
-				break
-			}
-			cursor = responseData.Result.NextPageCursor
-			time.Sleep(100 * time.Millisecond)
+		trades, err := client.GetExecutions(ctx, symbol, startTime, endTime)
+		if err != nil {
+			return nil, fmt.Errorf("ошибка истории для %s: %w", symbol, err)
 		}
+		allTrades = append(allTrades, trades...)
 
 		if len(allTrades) > 0 {
 			log.Printf("[GetTradeHistory] %s: найдено %d сделок за период %d-%d дней назад",
@@ -144,7 +63,11 @@ func GetTradeHistory(client *exchanges.BybitClient, symbol string) ([]Execution,
 			break
 		}
 
-		time.Sleep(100 * time.Millisecond)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
 
 	log.Printf("[GetTradeHistory] %s: всего сделок %d", symbol, len(allTrades))
@@ -169,35 +92,19 @@ func CalculateAverageBuyPrice(trades []Execution) float64 {
 	return totalCost / totalQuantity
 }
 
-func GetCurrentPrice(symbol string) (float64, error) {
-	url := fmt.Sprintf("https://api.bybit.com/v5/market/tickers?category=spot&symbol=%s", symbol)
-	resp, err := http.Get(url)
-	if err != nil {
-		return 0, err
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
+func GetCurrentPrice(ctx context.Context, client exchanges.Exchange, symbol string) (float64, error) {
+	ticker, err := client.GetTicker(ctx, symbol)
 	if err != nil {
 		return 0, err
 	}
 
-	var tickerData TickerResponse
-	if err := json.Unmarshal(body, &tickerData); err != nil {
-		return 0, err
-	}
-
-	if len(tickerData.Result.List) == 0 {
-		return 0, fmt.Errorf("цена для %s не найдена", symbol)
-	}
-
-	return strconv.ParseFloat(tickerData.Result.List[0].LastPrice, 64)
+	return strconv.ParseFloat(ticker.LastPrice, 64)
 }
 
-func CalculatePortfolioPNL(client *exchanges.BybitClient) ([]PortfolioAsset, error) {
-	balances, err := client.GetSpotBalance()
+func CalculatePortfolioPNL(ctx context.Context, client exchanges.Exchange) ([]PortfolioAsset, error) {
+	balances, err := client.GetSpotBalance(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("ошибка получения баланса: %v", err)
+		return nil, fmt.Errorf("ошибка получения баланса: %w", err)
 	}
 
 	log.Printf("[PNL] Получен баланс: %+v", balances)
@@ -223,7 +130,7 @@ func CalculatePortfolioPNL(client *exchanges.BybitClient) ([]PortfolioAsset, err
 		symbol := coin + "USDT"
 		log.Printf("[PNL] Обрабатываем %s, количество: %f", symbol, quantity)
 
-		tradeHistory, err := GetTradeHistory(client, symbol)
+		tradeHistory, err := GetTradeHistory(ctx, client, symbol)
 		if err != nil {
 			log.Printf("[PNL] Не удалось получить историю для %s: %v", symbol, err)
 			continue
@@ -238,7 +145,7 @@ func CalculatePortfolioPNL(client *exchanges.BybitClient) ([]PortfolioAsset, err
 			continue
 		}
 
-		currentPrice, err := GetCurrentPrice(symbol)
+		currentPrice, err := GetCurrentPrice(ctx, client, symbol)
 		if err != nil {
 			log.Printf("[PNL] Не удалось получить цену для %s: %v", symbol, err)
 			currentPrice = 0
@@ -331,16 +238,20 @@ func AnalyzeTradeHistory(groupedTrades map[string][]Execution) map[string]TradeA
 	return result
 }
 
-func FormatBalancePNLMessage(assets []DisplayAsset) string {
-	if len(assets) == 0 {
+// FormatBalancePNLMessage — баланс с нереализованным PnL; суммы в активах уже
+// пересчитаны в валюту отчета currency. cash — стоимость стейблкоинов и монеты валюты
+// отчета: строк PnL для них нет, но в общую стоимость они входят.
+func FormatBalancePNLMessage(assets []DisplayAsset, cash float64, currency rates.Currency) string {
+	if len(assets) == 0 && cash == 0 {
 		return "💼 Портфель пуст"
 	}
 
 	var messageBuilder strings.Builder
-	var totalPortfolioValue, totalUnrealizedPNL float64
+	totalPortfolioValue := cash
+	var totalUnrealizedPNL float64
 
 	messageBuilder.WriteString("📈 *Ваш спотовый портфель:*\n\n```\n")
-	messageBuilder.WriteString(fmt.Sprintf("%-8s | %-10s | %s\n", "Актив", "Кол-во", "PNL $ (%)"))
+	messageBuilder.WriteString(fmt.Sprintf("%-8s | %-10s | %s\n", "Актив", "Кол-во", "PNL "+currency.Sign+" (%)"))
 	messageBuilder.WriteString("---------------------------------------\n")
 
 	for _, asset := range assets {
@@ -359,19 +270,22 @@ func FormatBalancePNLMessage(assets []DisplayAsset) string {
 			pnlEmoji = "🔴"
 		}
 
-		line := fmt.Sprintf("%-8s | %-10.4f | %s%.2f (%.1f%%)\n",
+		line := fmt.Sprintf("%-8s | %-10.4f | %s%s (%.1f%%)\n",
 			asset.Name,
 			asset.Quantity,
 			pnlEmoji,
-			asset.UnrealizedPNL,
+			currency.Amount(asset.UnrealizedPNL),
 			asset.PNLPercentage,
 		)
 		messageBuilder.WriteString(line)
 	}
 
 	messageBuilder.WriteString("```\n")
-	messageBuilder.WriteString(fmt.Sprintf("*Общая стоимость: %.2f$*\n", totalPortfolioValue))
-	messageBuilder.WriteString(fmt.Sprintf("*Общий PNL: %.2f$*", totalUnrealizedPNL))
+	if cash > 0 {
+		messageBuilder.WriteString(fmt.Sprintf("Стейблкоины и %s: %s\n", currency.Code, currency.Format(cash)))
+	}
+	messageBuilder.WriteString(fmt.Sprintf("*Общая стоимость: %s*\n", currency.Format(totalPortfolioValue)))
+	messageBuilder.WriteString(fmt.Sprintf("*Общий PNL: %s*", currency.Format(totalUnrealizedPNL)))
 
 	return messageBuilder.String()
 }
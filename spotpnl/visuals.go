@@ -4,11 +4,14 @@ import (
 	"bytes"
 	"fmt"
 	"sort" 
+	"telegram-date-bot/rates"
+
 	"github.com/wcharczuk/go-chart/v2"
 )
 
 
-func GeneratePortfolioBarChart(assetValues map[string]float64) ([]byte, error) {
+// GeneratePortfolioBarChart — стоимость активов в валюте отчета currency
+func GeneratePortfolioBarChart(assetValues map[string]float64, currency rates.Currency) ([]byte, error) {
 	type assetPair struct {
 		Name  string
 		Value float64
@@ -31,7 +34,7 @@ if chartWidth > 2048 {
 
 var chartValues []chart.Value
 	for _, p := range pairs {
-		label := fmt.Sprintf("%s\n$%.1f", p.Name, p.Value) // шаг деления 0.1 для значений
+		label := fmt.Sprintf("%s\n%s", p.Name, currency.Format(p.Value))
 		chartValues = append(chartValues, chart.Value{
 			Label: label,
 			Value: p.Value,
@@ -0,0 +1,533 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"telegram-date-bot/exchanges"
+	"telegram-date-bot/spotpnl"
+	"time"
+)
+
+// tradesOverlap — насколько раньше отметки синхронизации начинается следующая: биржа может
+// отдать исполнение с опозданием, а повторно загруженные сделки отсекает UNIQUE по паре и exec_id
+const tradesOverlap = time.Hour
+
+// migrateExecutionsTables создает таблицу исполнений (по строке на сделку) и отметки
+// синхронизации. account_id — id аккаунта из accounts (0 — сделки, загруженные до появления аккаунтов).
+func migrateExecutionsTables(tx *sql.Tx) error {
+	createExecutionsSQL := `CREATE TABLE IF NOT EXISTS executions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		account_id INTEGER NOT NULL DEFAULT 0,
+		exec_id TEXT NOT NULL,
+		order_id TEXT NOT NULL DEFAULT '',
+		symbol TEXT NOT NULL,
+		side TEXT NOT NULL,
+		price TEXT NOT NULL,
+		qty TEXT NOT NULL,
+		exec_value TEXT NOT NULL DEFAULT '',
+		fee TEXT NOT NULL DEFAULT '',
+		fee_currency TEXT NOT NULL DEFAULT '',
+		is_maker INTEGER NOT NULL DEFAULT 0,
+		exec_time INTEGER NOT NULL DEFAULT 0,
+		UNIQUE(user_id, account_id, exec_id)
+	);
+	CREATE INDEX IF NOT EXISTS idx_executions_user_time ON executions(user_id, account_id, exec_time);
+	CREATE INDEX IF NOT EXISTS idx_executions_user_symbol ON executions(user_id, account_id, symbol, exec_time);`
+	if _, err := tx.Exec(createExecutionsSQL); err != nil {
+		return err
+	}
+
+	createSyncSQL := `CREATE TABLE IF NOT EXISTS executions_sync (
+		user_id INTEGER NOT NULL,
+		account_id INTEGER NOT NULL DEFAULT 0,
+		last_update INTEGER NOT NULL,
+		PRIMARY KEY (user_id, account_id)
+	);`
+	_, err := tx.Exec(createSyncSQL)
+	return err
+}
+
+// migrateExecutionsSymbolKey пересоздает executions с UNIQUE по паре и exec_id:
+// прежний UNIQUE(user_id, account_id, exec_id) молча отбрасывал сделку другой пары
+// с тем же id (на Binance и OKX id уникальны только внутри пары)
+func migrateExecutionsSymbolKey(tx *sql.Tx) error {
+	rebuildSQL := `CREATE TABLE executions_new (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		account_id INTEGER NOT NULL DEFAULT 0,
+		exec_id TEXT NOT NULL,
+		order_id TEXT NOT NULL DEFAULT '',
+		symbol TEXT NOT NULL,
+		side TEXT NOT NULL,
+		price TEXT NOT NULL,
+		qty TEXT NOT NULL,
+		exec_value TEXT NOT NULL DEFAULT '',
+		fee TEXT NOT NULL DEFAULT '',
+		fee_currency TEXT NOT NULL DEFAULT '',
+		is_maker INTEGER NOT NULL DEFAULT 0,
+		exec_time INTEGER NOT NULL DEFAULT 0,
+		UNIQUE(user_id, account_id, symbol, exec_id)
+	);
+	INSERT INTO executions_new
+		(id, user_id, account_id, exec_id, order_id, symbol, side, price, qty, exec_value, fee, fee_currency, is_maker, exec_time)
+		SELECT id, user_id, account_id, exec_id, order_id, symbol, side, price, qty, exec_value, fee, fee_currency, is_maker, exec_time
+		FROM executions;
+	DROP TABLE executions;
+	ALTER TABLE executions_new RENAME TO executions;
+	CREATE INDEX IF NOT EXISTS idx_executions_user_time ON executions(user_id, account_id, exec_time);
+	CREATE INDEX IF NOT EXISTS idx_executions_user_symbol ON executions(user_id, account_id, symbol, exec_time);`
+	if _, err := tx.Exec(rebuildSQL); err != nil {
+		return err
+	}
+
+	// сделки, пропущенные из-за совпадения id, есть только на бирже. Сохраненные сделки
+	// не трогаем (OKX отдает лишь последние 3 месяца, Binance ищет пары по ним), а сбрасываем
+	// отметки синхронизации аккаунтов Binance и OKX: следующая синхронизация пройдет историю
+	// заново и добавит недостающие сделки, повторы отсечет UNIQUE
+	_, err := tx.Exec(`DELETE FROM executions_sync WHERE account_id IN
+		(SELECT id FROM accounts WHERE exchange IN ('binance', 'okx'))`)
+	return err
+}
+
+// migrateTradeHistoryBlobs переносит JSON-кэши из trade_history в executions.
+// Перенесенные записи удаляются.
+func migrateTradeHistoryBlobs(tx *sql.Tx) error {
+	rows, err := tx.Query("SELECT user_id, trades, last_update FROM trade_history")
+	if err != nil {
+		return err
+	}
+
+	type blob struct {
+		userID     int64
+		trades     string
+		lastUpdate int64
+	}
+	var blobs []blob
+	for rows.Next() {
+		var b blob
+		var trades sql.NullString
+		if err := rows.Scan(&b.userID, &trades, &b.lastUpdate); err != nil {
+			rows.Close()
+			return err
+		}
+		b.trades = trades.String
+		blobs = append(blobs, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, b := range blobs {
+		var trades []spotpnl.Execution
+		if b.trades != "" {
+			if err := json.Unmarshal([]byte(b.trades), &trades); err != nil {
+				log.Printf("[Storage] Кэш сделок пользователя %d не читается, будет загружен заново: %v", b.userID, err)
+				trades = nil
+				b.lastUpdate = 0
+			}
+		}
+
+		added, err := insertLegacyExecutions(tx, b.userID, trades)
+		if err != nil {
+			return err
+		}
+		if b.lastUpdate > 0 {
+			_, err := tx.Exec(`INSERT INTO executions_sync (user_id, account_id, last_update) VALUES (?, 0, ?)
+				ON CONFLICT(user_id, account_id) DO UPDATE SET last_update = excluded.last_update`, b.userID, b.lastUpdate)
+			if err != nil {
+				return err
+			}
+		}
+		if _, err := tx.Exec("DELETE FROM trade_history WHERE user_id = ?", b.userID); err != nil {
+			return err
+		}
+		log.Printf("[Storage] Перенесено %d сделок пользователя %d в таблицу executions", added, b.userID)
+	}
+	return nil
+}
+
+// insertLegacyExecutions записывает сделки из JSON-кэша в executions в схеме версии 6:
+// account_id = 0, exec_id без символа пары. Шаг миграции не пользуется insertExecutions —
+// та меняется вместе со схемой, а выпущенный шаг должен работать одинаково в любой версии.
+func insertLegacyExecutions(tx *sql.Tx, userID int64, trades []spotpnl.Execution) (int, error) {
+	query := `INSERT OR IGNORE INTO executions
+		(user_id, account_id, exec_id, order_id, symbol, side, price, qty, exec_value, fee, fee_currency, is_maker, exec_time)
+		VALUES (?, 0, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	added := 0
+	for _, t := range trades {
+		isMaker := 0
+		if t.IsMaker {
+			isMaker = 1
+		}
+		execID := t.ExecID
+		if execID == "" {
+			execID = strings.Join([]string{t.Symbol, t.Side, t.Price, t.Quantity, t.ExecTime}, "|")
+		}
+		res, err := tx.Exec(query, userID, execID, t.OrderID, t.Symbol, t.Side, t.Price, t.Quantity,
+			t.ExecValue, t.ExecFee, t.FeeCurrency, isMaker, t.ExecTimeMs())
+		if err != nil {
+			return added, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			added++
+		}
+	}
+	return added, nil
+}
+
+// блокировки синхронизации по аккаунтам: одновременная загрузка истории
+// по кнопке и после переподключения потока сделала бы одну и ту же работу дважды
+var (
+	tradesLocksMu sync.Mutex
+	tradesLocks   = make(map[int64]*sync.Mutex)
+)
+
+func tradesLock(accountID int64) *sync.Mutex {
+	tradesLocksMu.Lock()
+	defer tradesLocksMu.Unlock()
+
+	lock, ok := tradesLocks[accountID]
+	if !ok {
+		lock = &sync.Mutex{}
+		tradesLocks[accountID] = lock
+	}
+	return lock
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// tradeKey — ключ исполнения: пара и exec_id. id сделок Binance и OKX уникальны только
+// внутри пары, поэтому без символа сделки разных пар с одним id склеились бы.
+// Без execId (сделки из старых версий) exec_id собирается из всех полей сделки.
+func tradeKey(t spotpnl.Execution) (symbol, execID string) {
+	if t.ExecID != "" {
+		return t.Symbol, t.ExecID
+	}
+	return t.Symbol, strings.Join([]string{t.Symbol, t.Side, t.Price, t.Quantity, t.ExecTime}, "|")
+}
+
+// insertExecutions добавляет сделки, пропуская уже сохраненные. Возвращает число новых.
+func insertExecutions(db execer, userID, accountID int64, trades []spotpnl.Execution) (int, error) {
+	query := `INSERT OR IGNORE INTO executions
+		(user_id, account_id, exec_id, order_id, symbol, side, price, qty, exec_value, fee, fee_currency, is_maker, exec_time)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	added := 0
+	for _, t := range trades {
+		isMaker := 0
+		if t.IsMaker {
+			isMaker = 1
+		}
+		symbol, execID := tradeKey(t)
+		res, err := db.Exec(query, userID, accountID, execID, t.OrderID, symbol, t.Side, t.Price, t.Quantity,
+			t.ExecValue, t.ExecFee, t.FeeCurrency, isMaker, t.ExecTimeMs())
+		if err != nil {
+			return added, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			added++
+		}
+	}
+	return added, nil
+}
+
+func setTradesSyncTime(db execer, userID, accountID, lastUpdate int64) error {
+	query := `INSERT INTO executions_sync (user_id, account_id, last_update) VALUES (?, ?, ?)
+	          ON CONFLICT(user_id, account_id) DO UPDATE SET last_update = excluded.last_update`
+	_, err := db.Exec(query, userID, accountID, lastUpdate)
+	return err
+}
+
+// saveTrades сохраняет новые сделки и отметку синхронизации одной транзакцией
+func saveTrades(userID, accountID int64, trades []spotpnl.Execution, lastUpdate int64) (int, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	added, err := insertExecutions(tx, userID, accountID, trades)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if err := setTradesSyncTime(tx, userID, accountID, lastUpdate); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return added, tx.Commit()
+}
+
+// GetTradesSyncTime — до какого момента (мс) история аккаунта загружена, 0 если еще не загружалась
+func GetTradesSyncTime(userID, accountID int64) (int64, error) {
+	lastUpdate, _, err := tradesSyncState(userID, accountID)
+	return lastUpdate, err
+}
+
+// tradesSyncState возвращает отметку синхронизации и есть ли запись о ней. Записи нет
+// до первой загрузки и после сброса истории; прерванная первая загрузка оставляет
+// запись с отметкой 0.
+func tradesSyncState(userID, accountID int64) (lastUpdate int64, synced bool, err error) {
+	err = DB.QueryRow("SELECT last_update FROM executions_sync WHERE user_id = ? AND account_id = ?", userID, accountID).Scan(&lastUpdate)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	return lastUpdate, err == nil, err
+}
+
+// GetTradesHistoryLimit — с какого момента (мс) биржа отдала историю аккаунта;
+// 0 — история загружена за весь запрошенный период
+func GetTradesHistoryLimit(userID, accountID int64) (int64, error) {
+	var since int64
+	err := DB.QueryRow("SELECT history_since FROM executions_sync WHERE user_id = ? AND account_id = ?", userID, accountID).Scan(&since)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return since, err
+}
+
+func setTradesHistoryLimit(userID, accountID, since int64) error {
+	_, err := DB.Exec("UPDATE executions_sync SET history_since = ? WHERE user_id = ? AND account_id = ?", since, userID, accountID)
+	return err
+}
+
+// ClearTradesCache удаляет сохраненные сделки аккаунта, например при смене биржи или ключей
+func ClearTradesCache(userID, accountID int64) error {
+	lock := tradesLock(accountID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM executions WHERE user_id = ? AND account_id = ?", userID, accountID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("DELETE FROM executions_sync WHERE user_id = ? AND account_id = ?", userID, accountID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetLastTradeIDs — последний числовой id сохраненной сделки по каждой паре аккаунта
+func GetLastTradeIDs(userID, accountID int64) (map[string]int64, error) {
+	rows, err := DB.Query(`SELECT symbol, MAX(CAST(exec_id AS INTEGER)) FROM executions
+		WHERE user_id = ? AND account_id = ? GROUP BY symbol`, userID, accountID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	lastIDs := make(map[string]int64)
+	for rows.Next() {
+		var symbol string
+		var lastID int64
+		if err := rows.Scan(&symbol, &lastID); err != nil {
+			return nil, err
+		}
+		lastIDs[symbol] = lastID
+	}
+	return lastIDs, rows.Err()
+}
+
+// GetExecutions возвращает сделки аккаунта по времени исполнения, AllAccounts — всех
+// аккаунтов пользователя вместе. Пустой symbol — все пары, from/to (мс) ограничивают
+// период, 0 — без ограничения.
+func GetExecutions(userID, accountID int64, symbol string, from, to int64) ([]spotpnl.Execution, error) {
+	if accountID == AllAccounts {
+		return GetAccountsExecutions(userID, nil, symbol, from, to)
+	}
+	return GetAccountsExecutions(userID, []int64{accountID}, symbol, from, to)
+}
+
+// GetAccountsExecutions — как GetExecutions, но по нескольким аккаунтам сразу; пустой
+// список — все аккаунты пользователя
+func GetAccountsExecutions(userID int64, accountIDs []int64, symbol string, from, to int64) ([]spotpnl.Execution, error) {
+	query := `SELECT exec_id, order_id, symbol, side, price, qty, exec_value, fee, fee_currency, is_maker, exec_time
+	          FROM executions WHERE user_id = ?`
+	args := []interface{}{userID}
+	if len(accountIDs) > 0 {
+		query += " AND account_id IN (" + strings.TrimSuffix(strings.Repeat("?,", len(accountIDs)), ",") + ")"
+		for _, accountID := range accountIDs {
+			args = append(args, accountID)
+		}
+	}
+	if symbol != "" {
+		query += " AND symbol = ?"
+		args = append(args, symbol)
+	}
+	if from > 0 {
+		query += " AND exec_time >= ?"
+		args = append(args, from)
+	}
+	if to > 0 {
+		query += " AND exec_time <= ?"
+		args = append(args, to)
+	}
+	query += " ORDER BY exec_time, id"
+
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var trades []spotpnl.Execution
+	for rows.Next() {
+		var t spotpnl.Execution
+		var isMaker int
+		var execTime int64
+		if err := rows.Scan(&t.ExecID, &t.OrderID, &t.Symbol, &t.Side, &t.Price, &t.Quantity,
+			&t.ExecValue, &t.ExecFee, &t.FeeCurrency, &isMaker, &execTime); err != nil {
+			return nil, err
+		}
+		t.IsMaker = isMaker == 1
+		if execTime > 0 {
+			t.ExecTime = strconv.FormatInt(execTime, 10)
+		}
+		trades = append(trades, t)
+	}
+	return trades, rows.Err()
+}
+
+// GetTradesFromCache возвращает все сохраненные сделки аккаунта и отметку синхронизации
+func GetTradesFromCache(userID, accountID int64) ([]spotpnl.Execution, int64, error) {
+	lastUpdate, err := GetTradesSyncTime(userID, accountID)
+	if err != nil {
+		return nil, 0, err
+	}
+	trades, err := GetExecutions(userID, accountID, "", 0, 0)
+	if err != nil {
+		return nil, 0, err
+	}
+	return trades, lastUpdate, nil
+}
+
+// AppendTradesToCache сохраняет сделки из приватного потока. Отметку синхронизации
+// не трогает: следующая синхронизация перечитает этот период, а повторы отсекутся по паре и exec_id.
+func AppendTradesToCache(userID, accountID int64, trades []spotpnl.Execution) (bool, error) {
+	added, err := insertExecutions(DB, userID, accountID, trades)
+	return added > 0, err
+}
+
+func GetTradesHistorySince(ctx context.Context, client exchanges.Exchange, startTime int64) ([]spotpnl.Execution, error) {
+	allTrades, err := client.GetExecutionsSince(ctx, startTime)
+	if err != nil {
+		// при *exchanges.PartialSyncError отдаем и загруженную часть
+		return allTrades, err
+	}
+
+	if len(allTrades) > 0 {
+		log.Printf("[Storage] Загружено %d новых сделок (%s)", len(allTrades), client.Name())
+	}
+	return allTrades, nil
+}
+
+// SyncTrades догружает с биржи сделки после последней синхронизации. Если синхронизацию
+// прервали (кнопка отмены, остановка бота), полностью загруженная часть сохраняется
+// и следующий запуск продолжит с того же места. Ошибку возвращает при отмене и когда
+// истории еще нет совсем; иначе только логирует — сохраненных сделок достаточно.
+func SyncTrades(ctx context.Context, client exchanges.Exchange, userID, accountID int64) error {
+	lock := tradesLock(accountID)
+	lock.Lock()
+	defer lock.Unlock()
+
+	lastUpdate, synced, err := tradesSyncState(userID, accountID)
+	if err != nil {
+		log.Printf("[Cache] Ошибка чтения: %v", err)
+	}
+
+	// биржам, где история запрашивается по парам, нужны пары уже сохраненных сделок:
+	// монет, проданных полностью, на балансе нет
+	if setter, ok := client.(exchanges.KnownTradesSetter); ok {
+		lastIDs, err := GetLastTradeIDs(userID, accountID)
+		if err != nil {
+			log.Printf("[Cache] Ошибка чтения пар сделок: %v", err)
+		}
+		symbols := make([]string, 0, len(lastIDs))
+		for symbol := range lastIDs {
+			symbols = append(symbols, symbol)
+		}
+		sort.Strings(symbols)
+		// без записи о синхронизации (первая загрузка или сброс) пары листаются с первой
+		// сделки: так заполняются пропуски в сохраненной истории. Прерванная первая
+		// загрузка запись оставляет, и следующая продолжит каждую пару с последней сделки.
+		if !synced {
+			lastIDs = nil
+		}
+		setter.SetKnownTrades(symbols, lastIDs)
+	}
+
+	startTime := lastUpdate - tradesOverlap.Milliseconds()
+	if lastUpdate == 0 {
+		log.Printf("[Cache] Первая загрузка за 725 дней...")
+		startTime = time.Now().AddDate(0, 0, -725).UnixMilli()
+	}
+
+	newTrades, err := GetTradesHistorySince(ctx, client, startTime)
+	// биржа хранит историю короче запрошенной: сохраняем что есть и запоминаем
+	// границу, чтобы предупредить пользователя в отчетах
+	var limited *exchanges.HistoryLimitError
+	if errors.As(err, &limited) {
+		log.Printf("[Cache] %v, более ранние сделки не загружены", limited)
+		err = nil
+	}
+	if err != nil {
+		var partial *exchanges.PartialSyncError
+		if errors.As(err, &partial) && len(newTrades) > 0 {
+			// отметка двигается, только если история загружена дальше нее; иначе сделки
+			// сохраняются с прежней, и следующая синхронизация перечитает период —
+			// повторы отсечет UNIQUE
+			syncedUntil := lastUpdate
+			if partial.SyncedUntil > startTime && partial.SyncedUntil > lastUpdate {
+				syncedUntil = partial.SyncedUntil
+			}
+			log.Printf("[Cache] Синхронизация прервана, сохраняем %d загруженных сделок", len(newTrades))
+			if _, saveErr := saveTrades(userID, accountID, newTrades, syncedUntil); saveErr != nil {
+				log.Printf("[Cache] Ошибка сохранения: %v", saveErr)
+			}
+		}
+
+		// отмену и первую загрузку без истории отдаем наверх, остальное — из сохраненного
+		if lastUpdate == 0 || ctx.Err() != nil {
+			return err
+		}
+		log.Printf("[Cache] Ошибка обновления: %v", err)
+		return nil
+	}
+
+	added, err := saveTrades(userID, accountID, newTrades, time.Now().UnixMilli())
+	if err != nil {
+		log.Printf("[Cache] Ошибка сохранения: %v", err)
+	}
+	if duplicates := len(newTrades) - added; err == nil && duplicates > 0 {
+		log.Printf("[Cache] Пропущено повторно загруженных сделок: %d", duplicates)
+	}
+	if err == nil && limited != nil {
+		if err := setTradesHistoryLimit(userID, accountID, limited.Since); err != nil {
+			log.Printf("[Cache] Ошибка сохранения границы истории: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetAllTradesWithCache синхронизирует историю и возвращает все сделки аккаунта
+func GetAllTradesWithCache(ctx context.Context, client exchanges.Exchange, userID, accountID int64) ([]spotpnl.Execution, error) {
+	if err := SyncTrades(ctx, client, userID, accountID); err != nil {
+		return nil, err
+	}
+	return GetExecutions(userID, accountID, "", 0, 0)
+}
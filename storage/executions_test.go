@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"telegram-date-bot/exchanges"
+	"telegram-date-bot/spotpnl"
+	"testing"
+	"time"
+)
+
+// fakeExchange отдает на GetExecutionsSince заданные сделки и ошибку и запоминает startTime
+type fakeExchange struct {
+	exchanges.Exchange
+	trades []spotpnl.Execution
+	err    error
+	starts []int64
+}
+
+func (f *fakeExchange) Name() string { return "fake" }
+
+func (f *fakeExchange) GetExecutionsSince(ctx context.Context, startTime int64) ([]spotpnl.Execution, error) {
+	f.starts = append(f.starts, startTime)
+	return f.trades, f.err
+}
+
+func openMigratedDB(t *testing.T) {
+	t.Helper()
+	openTestDB(t)
+	if err := migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+}
+
+func TestSyncTradesSavesPartialHistory(t *testing.T) {
+	openMigratedDB(t)
+	if err := setTradesSyncTime(DB, 1, 1, 5000); err != nil {
+		t.Fatalf("отметка: %v", err)
+	}
+
+	// Binance: одна пара загружена, на следующей ошибка; по времени история дальше
+	// startTime не продвинулась
+	client := &fakeExchange{
+		trades: []spotpnl.Execution{{ExecID: "1", Symbol: "SOLUSDT", Side: "Buy", Price: "100", Quantity: "1", ExecTime: "6000"}},
+		err: &exchanges.PartialSyncError{
+			SyncedUntil: 5000 - tradesOverlap.Milliseconds(),
+			Err:         errors.New("ошибка истории для ETHBTC"),
+		},
+	}
+
+	if err := SyncTrades(context.Background(), client, 1, 1); err != nil {
+		t.Fatalf("SyncTrades: %v", err)
+	}
+
+	trades, lastUpdate, err := GetTradesFromCache(1, 1)
+	if err != nil {
+		t.Fatalf("кэш: %v", err)
+	}
+	if len(trades) != 1 {
+		t.Errorf("сохранено сделок %d, ожидалась 1", len(trades))
+	}
+	if lastUpdate != 5000 {
+		t.Errorf("отметка синхронизации %d, ожидалась прежняя 5000", lastUpdate)
+	}
+}
+
+func countExecutions(t *testing.T, userID, accountID int64) int {
+	t.Helper()
+	trades, err := GetExecutions(userID, accountID, "", 0, 0)
+	if err != nil {
+		t.Fatalf("сделки: %v", err)
+	}
+	return len(trades)
+}
+
+func TestAppendTradesSkipsSameExecID(t *testing.T) {
+	openMigratedDB(t)
+	trade := spotpnl.Execution{ExecID: "e1", Symbol: "BTCUSDT", Side: "Buy", Price: "100", Quantity: "1", ExecTime: "1000"}
+
+	added, err := AppendTradesToCache(1, 1, []spotpnl.Execution{trade})
+	if err != nil || !added {
+		t.Fatalf("первая запись: %v, %v", added, err)
+	}
+	// то же исполнение из потока и из REST: цена в другом формате, но exec_id тот же
+	trade.Price = "100.0"
+	added, err = AppendTradesToCache(1, 1, []spotpnl.Execution{trade, trade})
+	if err != nil || added {
+		t.Errorf("повтор записан: %v, %v", added, err)
+	}
+	if n := countExecutions(t, 1, 1); n != 1 {
+		t.Errorf("сделок %d, ожидалась 1", n)
+	}
+	// тот же exec_id у другого аккаунта — другая сделка
+	if added, _ := AppendTradesToCache(1, 2, []spotpnl.Execution{trade}); !added {
+		t.Errorf("сделка другого аккаунта не записана")
+	}
+}
+
+func TestSyncTradesOverlapDoesNotDuplicate(t *testing.T) {
+	openMigratedDB(t)
+	now := time.Now().UnixMilli()
+	first := []spotpnl.Execution{
+		{ExecID: "e1", Symbol: "BTCUSDT", Side: "Buy", Price: "100", Quantity: "1", ExecTime: strconv.FormatInt(now-3*time.Hour.Milliseconds(), 10)},
+		{ExecID: "e2", Symbol: "BTCUSDT", Side: "Buy", Price: "110", Quantity: "1", ExecTime: strconv.FormatInt(now-30*time.Minute.Milliseconds(), 10)},
+	}
+	client := &fakeExchange{trades: first}
+	if err := SyncTrades(context.Background(), client, 1, 1); err != nil {
+		t.Fatalf("первая синхронизация: %v", err)
+	}
+	lastUpdate, err := GetTradesSyncTime(1, 1)
+	if err != nil || lastUpdate == 0 {
+		t.Fatalf("отметка синхронизации %d, %v", lastUpdate, err)
+	}
+
+	// следующая синхронизация начинается на час раньше отметки: e2 придет повторно
+	// вместе с исполнением e3, которое биржа отдала с опозданием
+	late := spotpnl.Execution{ExecID: "e3", Symbol: "BTCUSDT", Side: "Sell", Price: "120", Quantity: "1",
+		ExecTime: strconv.FormatInt(now-20*time.Minute.Milliseconds(), 10)}
+	client.trades = []spotpnl.Execution{first[1], late}
+	if err := SyncTrades(context.Background(), client, 1, 1); err != nil {
+		t.Fatalf("вторая синхронизация: %v", err)
+	}
+
+	if got, want := client.starts[1], lastUpdate-tradesOverlap.Milliseconds(); got != want {
+		t.Errorf("startTime второй синхронизации %d, ожидалось %d", got, want)
+	}
+	if n := countExecutions(t, 1, 1); n != 3 {
+		t.Errorf("сделок %d, ожидалось 3 без повторов", n)
+	}
+
+	// повторная синхронизация того же периода ничего не добавляет
+	if err := SyncTrades(context.Background(), client, 1, 1); err != nil {
+		t.Fatalf("третья синхронизация: %v", err)
+	}
+	if n := countExecutions(t, 1, 1); n != 3 {
+		t.Errorf("после повтора сделок %d, ожидалось 3", n)
+	}
+}
+
+// binanceHistoryServer — локальный Binance с балансом ETH и парами ETHUSDT и ETHBTC.
+// trades — число сделок пары (id с 0), failSymbol — пара, по которой myTrades
+// отвечает ошибкой. Запрошенные fromId записываются в fromIDs.
+type binanceHistoryServer struct {
+	trades     map[string]int64
+	failSymbol string
+	fromIDs    map[string][]string
+	tradeTime  int64
+}
+
+func (s *binanceHistoryServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	switch r.URL.Path {
+	case "/api/v3/account":
+		fmt.Fprint(w, `{"balances":[{"asset":"ETH","free":"1","locked":"0"}]}`)
+	case "/api/v3/ticker/price":
+		fmt.Fprint(w, `[{"symbol":"ETHUSDT","price":"3000"}]`)
+	case "/api/v3/exchangeInfo":
+		fmt.Fprint(w, `{"symbols":[
+			{"symbol":"ETHUSDT","status":"TRADING","baseAsset":"ETH","quoteAsset":"USDT"},
+			{"symbol":"ETHBTC","status":"TRADING","baseAsset":"ETH","quoteAsset":"BTC"}]}`)
+	case "/api/v3/myTrades":
+		symbol := query.Get("symbol")
+		if symbol == s.failSymbol {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprint(w, `{"code":-1100,"msg":"Illegal characters found in parameter"}`)
+			return
+		}
+		s.fromIDs[symbol] = append(s.fromIDs[symbol], query.Get("fromId"))
+		fromID, _ := strconv.ParseInt(query.Get("fromId"), 10, 64)
+		trades := []map[string]interface{}{}
+		for id := fromID; id < s.trades[symbol]; id++ {
+			trades = append(trades, map[string]interface{}{
+				"symbol": symbol, "id": id, "orderId": id, "price": "100", "qty": "1", "quoteQty": "100",
+				"commission": "0", "commissionAsset": "USDT", "time": s.tradeTime + id, "isBuyer": true,
+			})
+		}
+		json.NewEncoder(w).Encode(trades)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestSyncTradesBinanceContinuesAfterPartialFirstSync(t *testing.T) {
+	openMigratedDB(t)
+	stub := &binanceHistoryServer{
+		trades:     map[string]int64{"ETHUSDT": 5},
+		failSymbol: "ETHBTC",
+		fromIDs:    make(map[string][]string),
+		tradeTime:  time.Now().Add(-24 * time.Hour).UnixMilli(),
+	}
+	server := httptest.NewServer(stub)
+	defer server.Close()
+	newClient := func() *exchanges.BinanceClient {
+		return &exchanges.BinanceClient{ApiKey: t.Name(), ApiSecret: "secret", BaseURL: server.URL}
+	}
+
+	// первая загрузка: ETHUSDT загружена, на ETHBTC ошибка
+	if err := SyncTrades(context.Background(), newClient(), 1, 1); err == nil {
+		t.Fatal("ошибка прерванной первой загрузки не возвращена")
+	}
+	if n := countExecutions(t, 1, 1); n != 5 {
+		t.Fatalf("после первой загрузки сделок %d, ожидалось 5", n)
+	}
+
+	// ко второй синхронизации по ETHUSDT прошли новые сделки, ETHBTC отвечает
+	stub.trades = map[string]int64{"ETHUSDT": 7, "ETHBTC": 2}
+	stub.failSymbol = ""
+	stub.fromIDs = make(map[string][]string)
+	if err := SyncTrades(context.Background(), newClient(), 1, 1); err != nil {
+		t.Fatalf("вторая синхронизация: %v", err)
+	}
+
+	// ETHUSDT продолжается с последней сохраненной сделки, а не листается заново
+	if got := strings.Join(stub.fromIDs["ETHUSDT"], ","); got != "5" {
+		t.Errorf("fromId для ETHUSDT = %s, ожидалось 5", got)
+	}
+	if got := strings.Join(stub.fromIDs["ETHBTC"], ","); got != "0" {
+		t.Errorf("fromId для ETHBTC = %s, ожидалось 0", got)
+	}
+	if n := countExecutions(t, 1, 1); n != 9 {
+		t.Errorf("сделок %d, ожидалось 9", n)
+	}
+	if lastUpdate, _ := GetTradesSyncTime(1, 1); lastUpdate == 0 {
+		t.Error("отметка синхронизации не сохранена после полной загрузки")
+	}
+}
@@ -0,0 +1,204 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// migration — один шаг схемы базы. Шаги применяются по порядку, каждый в своей
+// транзакции, номер примененного шага записывается в schema_version.
+// Новые изменения схемы добавляются только в конец списка; уже выпущенные шаги не меняются
+// и не вызывают функций, которые меняются вместе со схемой (insertExecutions и т.п.).
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+}
+
+var migrations = []migration{
+	{1, "базовые таблицы", migrateBaseTables},
+	{2, "users.notifications_enabled", func(tx *sql.Tx) error {
+		return addColumn(tx, "users", "notifications_enabled", "INTEGER DEFAULT 0")
+	}},
+	{3, "users.exchange и users.api_passphrase", func(tx *sql.Tx) error {
+		// Биржа пользователя; у старых записей — Bybit
+		if err := addColumn(tx, "users", "exchange", "TEXT DEFAULT 'bybit'"); err != nil {
+			return err
+		}
+		// Passphrase для бирж, которые его требуют (OKX)
+		return addColumn(tx, "users", "api_passphrase", "TEXT DEFAULT ''")
+	}},
+	{4, "users.fill_notifications", func(tx *sql.Tx) error {
+		// Сообщения об исполненных ордерах из приватного потока
+		return addColumn(tx, "users", "fill_notifications", "INTEGER DEFAULT 0")
+	}},
+	{5, "сброс кэшей сделок без execId", migrateResetLegacyTrades},
+	{6, "таблица executions", migrateExecutionsTables},
+	{7, "перенос кэшей сделок в executions", migrateTradeHistoryBlobs},
+	{8, "аккаунты пользователей", migrateAccountsTable},
+	{9, "субаккаунты", migrateSubAccounts},
+	{10, "users.cost_method", func(tx *sql.Tx) error {
+		// Метод сопоставления продаж с покупками для реализованного PnL
+		return addColumn(tx, "users", "cost_method", "TEXT DEFAULT 'fifo'")
+	}},
+	{11, "валюта отчета", func(tx *sql.Tx) error {
+		if err := addColumn(tx, "users", "report_currency", "TEXT DEFAULT 'USD'"); err != nil {
+			return err
+		}
+		// снимки до этой версии считались в долларах
+		return addColumn(tx, "portfolio_snapshots", "currency", "TEXT DEFAULT 'USD'")
+	}},
+	{12, "executions: UNIQUE по паре и exec_id", migrateExecutionsSymbolKey},
+	{13, "executions_sync.history_since", func(tx *sql.Tx) error {
+		// С какого момента биржа отдала историю, если хранит ее меньше запрошенного
+		return addColumn(tx, "executions_sync", "history_since", "INTEGER NOT NULL DEFAULT 0")
+	}},
+}
+
+const createVersionSQL = `CREATE TABLE IF NOT EXISTS schema_version (
+	version INTEGER PRIMARY KEY,
+	name TEXT NOT NULL,
+	applied_at INTEGER NOT NULL
+);`
+
+// migrate приводит схему к последней версии. База, обновленная более новой версией бота,
+// не трогается: старый код мог бы испортить данные в незнакомой ему схеме.
+func migrate() error {
+	if _, err := DB.Exec(createVersionSQL); err != nil {
+		return err
+	}
+
+	current, err := schemaVersion()
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].version
+	if current > latest {
+		return fmt.Errorf("схема базы данных версии %d новее поддерживаемой (%d), обновите бота", current, latest)
+	}
+
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(m); err != nil {
+			return fmt.Errorf("миграция %d (%s): %w", m.version, m.name, err)
+		}
+		log.Printf("[Storage] Применена миграция %d: %s", m.version, m.name)
+	}
+	return nil
+}
+
+func schemaVersion() (int, error) {
+	var version sql.NullInt64
+	if err := DB.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+func applyMigration(m migration) error {
+	tx, err := DB.Begin()
+	if err != nil {
+		return err
+	}
+	if err := m.up(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)",
+		m.version, m.name, time.Now().Unix()); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// addColumn добавляет колонку, если ее еще нет. До появления миграций колонки
+// добавлялись при каждом запуске, поэтому в старых базах они уже могут быть.
+func addColumn(tx *sql.Tx, table, column, definition string) error {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid           int
+			name, colType string
+			notNull, pk   int
+			defaultValue  sql.NullString
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+func migrateBaseTables(tx *sql.Tx) error {
+	createTradeHistorySQL := `CREATE TABLE IF NOT EXISTS trade_history (
+		user_id INTEGER PRIMARY KEY,
+		trades TEXT,
+		last_update INTEGER
+	);`
+	if _, err := tx.Exec(createTradeHistorySQL); err != nil {
+		return err
+	}
+
+	createAlertsTableSQL := `CREATE TABLE IF NOT EXISTS alerts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER,
+		symbol TEXT,
+		target_price REAL,
+		direction TEXT,
+		is_active INTEGER DEFAULT 1
+	);`
+	if _, err := tx.Exec(createAlertsTableSQL); err != nil {
+		return err
+	}
+
+	createUsersTableSQL := `CREATE TABLE IF NOT EXISTS users (
+		user_id INTEGER PRIMARY KEY,
+		bybit_api_key TEXT,
+		bybit_api_secret TEXT
+	);`
+	if _, err := tx.Exec(createUsersTableSQL); err != nil {
+		return err
+	}
+
+	createSnapshotsTableSQL := `CREATE TABLE IF NOT EXISTS portfolio_snapshots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER,
+		portfolio_value REAL,
+		timestamp INTEGER
+	);`
+	_, err := tx.Exec(createSnapshotsTableSQL)
+	return err
+}
+
+// Кэши, сохраненные до появления execId и времени сделок, не годятся для дедупликации
+// и сортировки — сбрасываем их, история загрузится заново при следующем запросе
+func migrateResetLegacyTrades(tx *sql.Tx) error {
+	res, err := tx.Exec(`DELETE FROM trade_history
+		WHERE trades NOT IN ('', 'null', '[]') AND trades NOT LIKE '%"execId"%';`)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[Storage] Сброшено устаревших кэшей сделок: %d", n)
+	}
+	return nil
+}
@@ -0,0 +1,198 @@
+package storage
+
+import (
+	"database/sql"
+	"telegram-date-bot/secrets"
+	"telegram-date-bot/spotpnl"
+	"testing"
+)
+
+// openTestDB открывает пустую базу в памяти. Соединение одно: у каждого соединения
+// SQLite своя база в памяти.
+func openTestDB(t *testing.T) {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatalf("база: %v", err)
+	}
+	db.SetMaxOpenConns(1)
+	DB = db
+	t.Cleanup(func() { db.Close() })
+}
+
+// migrateTo применяет миграции до версии version включительно
+func migrateTo(t *testing.T, version int) {
+	t.Helper()
+	if _, err := DB.Exec(createVersionSQL); err != nil {
+		t.Fatalf("schema_version: %v", err)
+	}
+	for _, m := range migrations {
+		if m.version > version {
+			break
+		}
+		if err := applyMigration(m); err != nil {
+			t.Fatalf("миграция %d: %v", m.version, err)
+		}
+	}
+}
+
+func mustExec(t *testing.T, query string, args ...interface{}) {
+	t.Helper()
+	if _, err := DB.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
+
+func countRows(t *testing.T, query string, args ...interface{}) int {
+	t.Helper()
+	var n int
+	if err := DB.QueryRow(query, args...).Scan(&n); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+	return n
+}
+
+func TestMigrateExecutionsSymbolKeyKeepsTrades(t *testing.T) {
+	openTestDB(t)
+	migrateTo(t, 11)
+
+	for _, exchange := range []string{"bybit", "binance", "okx"} {
+		mustExec(t, `INSERT INTO accounts (user_id, name, exchange, api_key, api_secret, created_at)
+			VALUES (1, ?, ?, 'key', 'secret', 0)`, exchange, exchange)
+	}
+	for accountID := 1; accountID <= 3; accountID++ {
+		mustExec(t, `INSERT INTO executions (user_id, account_id, exec_id, symbol, side, price, qty, exec_time)
+			VALUES (1, ?, '7', 'ETHUSDT', 'Buy', '100', '1', 1000)`, accountID)
+		mustExec(t, "INSERT INTO executions_sync (user_id, account_id, last_update) VALUES (1, ?, 5000)", accountID)
+	}
+
+	if err := migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	if n := countRows(t, "SELECT COUNT(*) FROM executions"); n != 3 {
+		t.Errorf("сделок после пересоздания таблицы %d, ожидалось 3", n)
+	}
+	// отметки Binance и OKX сброшены: следующая синхронизация пройдет историю заново
+	if n := countRows(t, "SELECT COUNT(*) FROM executions_sync WHERE account_id IN (2, 3)"); n != 0 {
+		t.Errorf("отметок синхронизации Binance и OKX: %d, ожидалось 0", n)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM executions_sync WHERE account_id = 1"); n != 1 {
+		t.Errorf("отметка синхронизации Bybit потеряна")
+	}
+
+	// сделка другой пары с тем же id больше не отбрасывается
+	added, err := insertExecutions(DB, 1, 2, []spotpnl.Execution{
+		{ExecID: "7", Symbol: "ETHBTC", Side: "Buy", Price: "0.05", Quantity: "1", ExecTime: "2000"},
+	})
+	if err != nil || added != 1 {
+		t.Errorf("сделка ETHBTC с тем же id: добавлено %d, %v", added, err)
+	}
+}
+
+func TestMigrateEmptyDatabase(t *testing.T) {
+	openTestDB(t)
+	if err := migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	latest := migrations[len(migrations)-1].version
+	if version, err := schemaVersion(); err != nil || version != latest {
+		t.Fatalf("версия схемы %d, %v; ожидалась %d", version, err, latest)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM schema_version"); n != len(migrations) {
+		t.Errorf("записей в schema_version %d, ожидалось %d", n, len(migrations))
+	}
+	for _, table := range []string{"users", "accounts", "alerts", "executions", "executions_sync", "portfolio_snapshots"} {
+		if n := countRows(t, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", table); n != 1 {
+			t.Errorf("нет таблицы %s", table)
+		}
+	}
+
+	// повторный запуск ничего не применяет
+	if err := migrate(); err != nil {
+		t.Fatalf("повторный migrate: %v", err)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM schema_version"); n != len(migrations) {
+		t.Errorf("после повторного запуска записей в schema_version %d", n)
+	}
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	openTestDB(t)
+	if err := migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+	mustExec(t, "INSERT INTO schema_version (version, name, applied_at) VALUES (?, 'из будущего', 0)",
+		migrations[len(migrations)-1].version+1)
+
+	if err := migrate(); err == nil {
+		t.Errorf("схема новее поддерживаемой принята без ошибки")
+	}
+}
+
+// TestMigrateBaselineDatabase обновляет базу, созданную до появления миграций: схема
+// и данные такие, какими их оставлял InitDB тех версий
+func TestMigrateBaselineDatabase(t *testing.T) {
+	openTestDB(t)
+	mustExec(t, `CREATE TABLE trade_history (user_id INTEGER PRIMARY KEY, trades TEXT, last_update INTEGER);
+		CREATE TABLE alerts (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER, symbol TEXT,
+			target_price REAL, direction TEXT, is_active INTEGER DEFAULT 1);
+		CREATE TABLE users (user_id INTEGER PRIMARY KEY, bybit_api_key TEXT, bybit_api_secret TEXT);
+		ALTER TABLE users ADD COLUMN notifications_enabled INTEGER DEFAULT 0;
+		CREATE TABLE portfolio_snapshots (id INTEGER PRIMARY KEY AUTOINCREMENT, user_id INTEGER,
+			portfolio_value REAL, timestamp INTEGER);`)
+
+	mustExec(t, "INSERT INTO users (user_id, bybit_api_key, bybit_api_secret, notifications_enabled) VALUES (1, 'key', 'secret', 1)")
+	mustExec(t, `INSERT INTO trade_history (user_id, trades, last_update) VALUES (1, ?, 5000)`,
+		`[{"symbol":"BTCUSDT","execPrice":"100","execQty":"1","side":"Buy","execId":"a1","execTime":"1000"},
+		  {"symbol":"BTCUSDT","execPrice":"120","execQty":"1","side":"Sell","execId":"a2","execTime":"2000"}]`)
+	mustExec(t, "INSERT INTO alerts (user_id, symbol, target_price, direction) VALUES (1, 'BTCUSDT', 70000, 'up')")
+	mustExec(t, "INSERT INTO portfolio_snapshots (user_id, portfolio_value, timestamp) VALUES (1, 1000, 0)")
+
+	if err := migrate(); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	var accountID int64
+	var exchange, apiKey string
+	if err := DB.QueryRow("SELECT id, exchange, api_key FROM accounts WHERE user_id = 1").Scan(&accountID, &exchange, &apiKey); err != nil {
+		t.Fatalf("аккаунт из users: %v", err)
+	}
+	if exchange != "bybit" || apiKey != "key" {
+		t.Errorf("аккаунт: биржа %s, ключ %s", exchange, apiKey)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM users WHERE user_id = 1 AND active_account_id = ? AND notifications_enabled = 1", accountID); n != 1 {
+		t.Errorf("настройки пользователя не сохранились")
+	}
+
+	// JSON-кэш перенесен в executions аккаунта вместе с отметкой синхронизации
+	if n := countRows(t, "SELECT COUNT(*) FROM executions WHERE user_id = 1 AND account_id = ?", accountID); n != 2 {
+		t.Errorf("перенесено сделок %d, ожидалось 2", n)
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM executions_sync WHERE account_id = ? AND last_update = 5000", accountID); n != 1 {
+		t.Errorf("отметка синхронизации не перенесена")
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM trade_history"); n != 0 {
+		t.Errorf("в trade_history осталось записей: %d", n)
+	}
+
+	if n := countRows(t, "SELECT COUNT(*) FROM alerts WHERE is_active = 1"); n != 1 {
+		t.Errorf("алерт потерян")
+	}
+	if n := countRows(t, "SELECT COUNT(*) FROM portfolio_snapshots WHERE currency = 'USD'"); n != 1 {
+		t.Errorf("снимок портфеля без валюты")
+	}
+
+	// ключи перенесены открытым текстом и шифруются следующим шагом InitDB
+	loadTestKey(t)
+	if rotated, err := RotateSecrets(); err != nil || rotated != 1 {
+		t.Fatalf("RotateSecrets = %d, %v", rotated, err)
+	}
+	if err := DB.QueryRow("SELECT api_key FROM accounts WHERE id = ?", accountID).Scan(&apiKey); err != nil {
+		t.Fatalf("api_key: %v", err)
+	}
+	if apiKey == "key" || secrets.NeedsRotation(apiKey) {
+		t.Errorf("ключ после ротации не зашифрован: %q", apiKey)
+	}
+}
@@ -2,14 +2,8 @@ package storage
 
 import (
 	"database/sql"
-	"encoding/json"
-	"fmt"
-	"io"
 	"log"
-	"net/http"
-	"net/url"
-	"telegram-date-bot/exchanges"
-	"telegram-date-bot/spotpnl"
+	"telegram-date-bot/secrets"
 	"time"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -28,13 +22,28 @@ type AlertInfo struct {
 type UserSettings struct {
 	UserID               int64
 	NotificationsEnabled bool
+	FillNotifications    bool
+	CostMethod           string // fifo, lifo, hifo или avg
+	ReportCurrency       string // USD, EUR, RUB или BTC
 	// Можно добавить другие настройки в будущем
 }
 
+// User — аккаунт биржи пользователя с ключами
 type User struct {
-	UserID    int64
-	ApiKey    string
-	ApiSecret string
+	UserID      int64
+	AccountID   int64
+	AccountName string
+	Exchange    string
+	ApiKey      string
+	ApiSecret   string
+	Passphrase  string
+	// ExchangeUID — id аккаунта на бирже, IsMaster — ключ мастер-аккаунта
+	ExchangeUID string
+	IsMaster    bool
+	// IncludeSubs — показывать вместе с мастер-аккаунтом его субаккаунты
+	IncludeSubs bool
+	// ParentID — мастер-аккаунт, субаккаунтом которого является этот аккаунт; 0 — нет
+	ParentID int64
 }
 
 func InitDB(filepath string) error {
@@ -44,250 +53,22 @@ func InitDB(filepath string) error {
 		return err
 	}
 
-	createTradeHistorySQL := `CREATE TABLE IF NOT EXISTS trade_history (
-		user_id INTEGER PRIMARY KEY,
-		trades TEXT,
-		last_update INTEGER
-	);`
-	if _, err := DB.Exec(createTradeHistorySQL); err != nil {
-		return err
-	}
-
-	createAlertsTableSQL := `CREATE TABLE IF NOT EXISTS alerts (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER,
-		symbol TEXT,
-		target_price REAL,
-		direction TEXT,
-		is_active INTEGER DEFAULT 1
-	);`
-	if _, err := DB.Exec(createAlertsTableSQL); err != nil {
+	if err := migrate(); err != nil {
 		return err
 	}
 
-	createUsersTableSQL := `CREATE TABLE IF NOT EXISTS users (
-		user_id INTEGER PRIMARY KEY,
-		bybit_api_key TEXT,
-		bybit_api_secret TEXT
-	);`
-	if _, err := DB.Exec(createUsersTableSQL); err != nil {
+	rotated, err := RotateSecrets()
+	if err != nil {
 		return err
 	}
-
-	alterUsersTableSQL := `
-		PRAGMA foreign_keys=off;
-		ALTER TABLE users ADD COLUMN notifications_enabled INTEGER DEFAULT 0;
-		PRAGMA foreign_keys=on;
-	`
-	DB.Exec(alterUsersTableSQL)
-
-	createSnapshotsTableSQL := `CREATE TABLE IF NOT EXISTS portfolio_snapshots (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		user_id INTEGER,
-		portfolio_value REAL,
-		timestamp INTEGER
-	);`
-	if _, err := DB.Exec(createSnapshotsTableSQL); err != nil {
-		return err
+	if rotated > 0 {
+		log.Printf("[Storage] Перешифрованы ключи аккаунтов: %d", rotated)
 	}
 
 	log.Println("База данных успешно инициализирована/обновлена.")
 	return nil
 }
 
-func SaveTradesToCache(userID int64, trades []spotpnl.Execution, lastUpdate int64) error {
-	tradesJSON, err := json.Marshal(trades)
-	if err != nil {
-		return err
-	}
-
-	query := `INSERT OR REPLACE INTO trade_history (user_id, trades, last_update) VALUES (?, ?, ?);`
-	_, err = DB.Exec(query, userID, string(tradesJSON), lastUpdate)
-	return err
-}
-
-func GetTradesFromCache(userID int64) ([]spotpnl.Execution, int64, error) {
-	query := "SELECT trades, last_update FROM trade_history WHERE user_id = ?"
-
-	row := DB.QueryRow(query, userID)
-
-	var tradesJSON string
-	var lastUpdate int64
-
-	err := row.Scan(&tradesJSON, &lastUpdate)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, 0, nil
-		}
-		return nil, 0, err
-	}
-
-	var trades []spotpnl.Execution
-	err = json.Unmarshal([]byte(tradesJSON), &trades)
-	if err != nil {
-		return nil, 0, err
-	}
-
-	return trades, lastUpdate, nil
-}
-
-func GetTradesHistorySince(client *exchanges.BybitClient, startTime int64) ([]spotpnl.Execution, error) {
-	baseURL := "https://api.bybit.com/v5/execution/list"
-	httpClient := &http.Client{Timeout: 10 * time.Second}
-	var allTrades []spotpnl.Execution
-
-	now := time.Now().UnixMilli()
-	currentStart := startTime
-	sevenDaysMs := int64(7 * 24 * 60 * 60 * 1000)
-
-	for currentStart < now {
-		currentEnd := currentStart + sevenDaysMs
-		if currentEnd > now {
-			currentEnd = now
-		}
-
-		cursor := ""
-		for {
-			params := url.Values{}
-			params.Add("category", "spot")
-			params.Add("limit", "100")
-			params.Add("startTime", fmt.Sprintf("%d", currentStart))
-			params.Add("endTime", fmt.Sprintf("%d", currentEnd))
-			if cursor != "" {
-				params.Add("cursor", cursor)
-			}
-
-			timestamp := fmt.Sprintf("%d", time.Now().UnixMilli())
-			recvWindow := "20000"
-			queryString := params.Encode()
-			signature := client.GenerateSignature(timestamp, recvWindow, queryString)
-
-			fullURL := fmt.Sprintf("%s?%s", baseURL, queryString)
-			req, err := http.NewRequest("GET", fullURL, nil)
-			if err != nil {
-				return nil, fmt.Errorf("ошибка создания запроса истории: %v", err)
-			}
-
-			req.Header.Set("X-BAPI-API-KEY", client.ApiKey)
-			req.Header.Set("X-BAPI-TIMESTAMP", timestamp)
-			req.Header.Set("X-BAPI-RECV-WINDOW", recvWindow)
-			req.Header.Set("X-BAPI-SIGN", signature)
-
-			// Выполняем запрос с retry и строгой проверкой ответа
-			var responseData spotpnl.ExecutionResponse
-			var body []byte
-			var res *http.Response
-			var reqErr error
-			maxReqAttempts := 3
-			for attemptReq := 1; attemptReq <= maxReqAttempts; attemptReq++ {
-				res, reqErr = httpClient.Do(req)
-				if reqErr != nil {
-					if attemptReq < maxReqAttempts {
-						log.Printf("[Storage] Попытка %d/%d: ошибка выполнения запроса истории: %v. Повтор через 2 сек...", attemptReq, maxReqAttempts, reqErr)
-						time.Sleep(2 * time.Second)
-						continue
-					}
-					return nil, fmt.Errorf("ошибка выполнения запроса истории: %v", reqErr)
-				}
-
-				// читаем тело
-				body, reqErr = io.ReadAll(res.Body)
-				res.Body.Close()
-				if reqErr != nil {
-					return nil, fmt.Errorf("ошибка чтения ответа истории: %v", reqErr)
-				}
-
-				// Проверяем HTTP статус
-				if res.StatusCode != 200 {
-					log.Printf("[Storage] Неверный HTTP статус %d при запросе истории. Body: %s", res.StatusCode, string(body))
-					if attemptReq < maxReqAttempts {
-						time.Sleep(2 * time.Second)
-						continue
-					}
-					return nil, fmt.Errorf("API вернул статус %d", res.StatusCode)
-				}
-
-				// Пробуем распарсить JSON
-				if err := json.Unmarshal(body, &responseData); err != nil {
-					// Логируем тело для диагностики, но не возвращаем его пользователю
-					log.Printf("[Storage] Ошибка парсинга JSON истории: %v. Body: %s", err, string(body))
-					if attemptReq < maxReqAttempts {
-						time.Sleep(2 * time.Second)
-						continue
-					}
-					return nil, fmt.Errorf("неверный формат ответа API при получении истории")
-				}
-
-				// Успешный парсинг
-				break
-			}
-
-			if responseData.RetCode != 0 {
-				return nil, fmt.Errorf("API ошибка: %s (код %d)", responseData.RetMsg, responseData.RetCode)
-			}
-
-			if len(responseData.Result.List) > 0 {
-				allTrades = append(allTrades, responseData.Result.List...)
-			}
-
-			if responseData.Result.NextPageCursor == "" {
-				break
-			}
-
-			cursor = responseData.Result.NextPageCursor
-			time.Sleep(100 * time.Millisecond)
-		}
-
-		currentStart = currentEnd
-		time.Sleep(100 * time.Millisecond)
-	}
-
-	if len(allTrades) > 0 {
-		log.Printf("[Storage] Загружено %d новых сделок", len(allTrades))
-	}
-	return allTrades, nil
-}
-
-func GetAllTradesWithCache(client *exchanges.BybitClient, userID int64) ([]spotpnl.Execution, error) {
-	cachedTrades, lastUpdate, err := GetTradesFromCache(userID)
-	if err != nil {
-		log.Printf("[Cache] Ошибка чтения: %v", err)
-	}
-
-	var allTrades []spotpnl.Execution
-
-	if lastUpdate == 0 {
-		log.Printf("[Cache] Первая загрузка за 725 дней...")
-		now := time.Now()
-		startTime := now.AddDate(0, 0, -725).UnixMilli()
-
-		allTrades, err = GetTradesHistorySince(client, startTime)
-		if err != nil {
-			return nil, err
-		}
-	} else {
-		allTrades = cachedTrades
-
-		newTrades, err := GetTradesHistorySince(client, lastUpdate)
-		if err != nil {
-			log.Printf("[Cache] Ошибка обновления: %v", err)
-			return cachedTrades, nil
-		}
-
-		if len(newTrades) > 0 {
-			allTrades = append(allTrades, newTrades...)
-		}
-	}
-
-	currentTime := time.Now().UnixMilli()
-	err = SaveTradesToCache(userID, allTrades, currentTime)
-	if err != nil {
-		log.Printf("[Cache] Ошибка сохранения: %v", err)
-	}
-
-	return allTrades, nil
-}
-
 func AddAlert(userID int64, symbol string, targetPrice float64, direction string) error {
 	query := "INSERT INTO alerts (user_id, symbol, target_price, direction) VALUES (?, ?, ?, ?)"
 
@@ -321,14 +102,71 @@ func DeactivateAlert(alertID int) error {
 	return err
 }
 
-func SaveOrUpdateUser(userID int64, apiKey, apiSecret string) error {
-	query := `INSERT INTO users (user_id, bybit_api_key, bybit_api_secret, notifications_enabled)
-	          VALUES (?, ?, ?, 0)
-	          ON CONFLICT(user_id) DO UPDATE SET
-	          bybit_api_key = excluded.bybit_api_key,
-	          bybit_api_secret = excluded.bybit_api_secret`
-	_, err := DB.Exec(query, userID, apiKey, apiSecret)
-	return err
+func encryptSecrets(values ...string) ([]string, error) {
+	encrypted := make([]string, len(values))
+	for i, value := range values {
+		var err error
+		if encrypted[i], err = secrets.Encrypt(value); err != nil {
+			return nil, err
+		}
+	}
+	return encrypted, nil
+}
+
+// decryptUser расшифровывает ключи пользователя, прочитанного из базы
+func decryptUser(u *User) error {
+	for _, field := range []*string{&u.ApiKey, &u.ApiSecret, &u.Passphrase} {
+		plain, err := secrets.Decrypt(*field)
+		if err != nil {
+			return err
+		}
+		*field = plain
+	}
+	return nil
+}
+
+// RotateSecrets перешифровывает текущим ключом записи, сохраненные открытым текстом
+// или прежним ключом. Возвращает число обновленных аккаунтов.
+func RotateSecrets() (int, error) {
+	rows, err := DB.Query("SELECT id, user_id, api_key, api_secret, api_passphrase FROM accounts")
+	if err != nil {
+		return 0, err
+	}
+	var stale []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.AccountID, &u.UserID, &u.ApiKey, &u.ApiSecret, &u.Passphrase); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if secrets.NeedsRotation(u.ApiKey) || secrets.NeedsRotation(u.ApiSecret) || secrets.NeedsRotation(u.Passphrase) {
+			stale = append(stale, u)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	updated := 0
+	for _, u := range stale {
+		var err error
+		for _, field := range []*string{&u.ApiKey, &u.ApiSecret, &u.Passphrase} {
+			if *field, err = secrets.Reencrypt(*field); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			log.Printf("[Storage] Ключи аккаунта %d пользователя %d не перешифрованы: %v", u.AccountID, u.UserID, err)
+			continue
+		}
+		query := "UPDATE accounts SET api_key = ?, api_secret = ?, api_passphrase = ? WHERE id = ?"
+		if _, err := DB.Exec(query, u.ApiKey, u.ApiSecret, u.Passphrase, u.AccountID); err != nil {
+			return updated, err
+		}
+		updated++
+	}
+	return updated, nil
 }
 
 func SetNotificationsEnabled(userID int64, enabled bool) error {
@@ -355,67 +193,95 @@ func SetNotificationsEnabled(userID int64, enabled bool) error {
 	return err
 }
 
-func SavePortfolioSnapshot(userID int64, value float64) error {
-	query := "INSERT INTO portfolio_snapshots (user_id, portfolio_value, timestamp) VALUES (?, ?, ?)"
-	_, err := DB.Exec(query, userID, value, time.Now().Unix())
+// SavePortfolioSnapshot сохраняет стоимость портфеля в валюте отчета currency
+func SavePortfolioSnapshot(userID int64, value float64, currency string) error {
+	query := "INSERT INTO portfolio_snapshots (user_id, portfolio_value, currency, timestamp) VALUES (?, ?, ?, ?)"
+	_, err := DB.Exec(query, userID, value, currency, time.Now().Unix())
 	return err
 }
 
-func GetLatestSnapshotBefore(userID int64, beforeTimestamp int64) (float64, error) {
-	query := "SELECT portfolio_value FROM portfolio_snapshots WHERE user_id = ? AND timestamp < ? ORDER BY timestamp DESC LIMIT 1"
+// GetLatestSnapshotBefore возвращает стоимость из последнего снимка до beforeTimestamp
+// и валюту, в которой она посчитана
+func GetLatestSnapshotBefore(userID int64, beforeTimestamp int64) (float64, string, error) {
+	query := "SELECT portfolio_value, COALESCE(currency, 'USD') FROM portfolio_snapshots WHERE user_id = ? AND timestamp < ? ORDER BY timestamp DESC LIMIT 1"
 
 	row := DB.QueryRow(query, userID, beforeTimestamp)
 
 	var value float64
-	err := row.Scan(&value)
-	return value, err
+	var currency string
+	err := row.Scan(&value, &currency)
+	return value, currency, err
 }
 
 func GetUserSettings(userID int64) (UserSettings, error) {
-	query := "SELECT notifications_enabled FROM users WHERE user_id = ?"
+	query := `SELECT notifications_enabled, COALESCE(fill_notifications, 0), COALESCE(cost_method, 'fifo'),
+	          COALESCE(report_currency, 'USD') FROM users WHERE user_id = ?`
 	row := DB.QueryRow(query, userID)
 
-	var notificationsEnabled int
-	err := row.Scan(&notificationsEnabled)
+	var notificationsEnabled, fillNotifications int
+	var costMethod, reportCurrency string
+	err := row.Scan(&notificationsEnabled, &fillNotifications, &costMethod, &reportCurrency)
 	if err != nil {
+		defaults := UserSettings{UserID: userID, NotificationsEnabled: false, CostMethod: "fifo", ReportCurrency: "USD"}
 		if err == sql.ErrNoRows {
 			// Если пользователя нет, создаем запись с выключенными уведомлениями
 			insertQuery := "INSERT INTO users (user_id, notifications_enabled) VALUES (?, 0)"
 			DB.Exec(insertQuery, userID)
-			return UserSettings{UserID: userID, NotificationsEnabled: false}, nil
+			return defaults, nil
 		}
-		return UserSettings{UserID: userID, NotificationsEnabled: false}, err
+		return defaults, err
 	}
 
 	settings := UserSettings{
 		UserID:               userID,
 		NotificationsEnabled: notificationsEnabled == 1,
+		FillNotifications:    fillNotifications == 1,
+		CostMethod:           costMethod,
+		ReportCurrency:       reportCurrency,
 	}
 	return settings, nil
 }
 
+// SetFillNotifications включает сообщения об исполненных ордерах
+func SetFillNotifications(userID int64, enabled bool) error {
+	var enabledInt int
+	if enabled {
+		enabledInt = 1
+	}
+
+	query := `INSERT INTO users (user_id, fill_notifications) VALUES (?, ?)
+	          ON CONFLICT(user_id) DO UPDATE SET fill_notifications = excluded.fill_notifications`
+	_, err := DB.Exec(query, userID, enabledInt)
+	return err
+}
+
+// SetCostMethod выбирает метод сопоставления продаж с покупками для реализованного PnL
+func SetCostMethod(userID int64, method string) error {
+	query := `INSERT INTO users (user_id, cost_method) VALUES (?, ?)
+	          ON CONFLICT(user_id) DO UPDATE SET cost_method = excluded.cost_method`
+	_, err := DB.Exec(query, userID, method)
+	return err
+}
+
+// SetReportCurrency выбирает валюту, в которой показываются балансы, PnL и отчеты
+func SetReportCurrency(userID int64, currency string) error {
+	query := `INSERT INTO users (user_id, report_currency) VALUES (?, ?)
+	          ON CONFLICT(user_id) DO UPDATE SET report_currency = excluded.report_currency`
+	_, err := DB.Exec(query, userID, currency)
+	return err
+}
+
+// GetUsersWithKeys возвращает все аккаунты указанной биржи
+func GetUsersWithKeys(exchange string) ([]User, error) {
+	return queryAccounts("a.exchange = ?", exchange)
+}
+
+// GetUsersWithNotificationsEnabled возвращает аккаунты пользователей с включенными уведомлениями
 func GetUsersWithNotificationsEnabled() ([]User, error) {
-	query := `SELECT user_id, bybit_api_key, bybit_api_secret 
-	          FROM users 
-	          WHERE notifications_enabled = 1 
-	          AND bybit_api_key IS NOT NULL 
-	          AND bybit_api_key != ''
-	          AND bybit_api_secret IS NOT NULL
-	          AND bybit_api_secret != ''`
-	rows, err := DB.Query(query)
+	users, err := queryAccounts("u.notifications_enabled = 1 ORDER BY a.user_id, a.id")
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-
-	var users []User
-	for rows.Next() {
-		var u User
-		if err := rows.Scan(&u.UserID, &u.ApiKey, &u.ApiSecret); err != nil {
-			return nil, err
-		}
-		users = append(users, u)
-	}
-	log.Printf("[GetUsersWithNotificationsEnabled] Найдено пользователей: %d", len(users))
+	log.Printf("[GetUsersWithNotificationsEnabled] Найдено аккаунтов: %d", len(users))
 	return users, nil
 }
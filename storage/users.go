@@ -0,0 +1,465 @@
+package storage
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"telegram-date-bot/exchanges"
+	"telegram-date-bot/secrets"
+	"time"
+)
+
+// AllAccounts — значение активного аккаунта, при котором портфель показывается
+// по всем аккаунтам пользователя сразу
+const AllAccounts int64 = -1
+
+const selectAccountsSQL = `SELECT a.user_id, a.id, a.name, a.exchange, a.api_key, a.api_secret, a.api_passphrase,
+	a.exchange_uid, a.is_master, a.include_subs, a.parent_id
+	FROM accounts a`
+
+// migrateAccountsTable заводит аккаунты: у пользователя может быть несколько ключей,
+// в том числе разных бирж. Ключи из users переносятся в аккаунт с названием биржи,
+// к нему же привязываются уже загруженные сделки (account_id = 0).
+func migrateAccountsTable(tx *sql.Tx) error {
+	createAccountsSQL := `CREATE TABLE IF NOT EXISTS accounts (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		exchange TEXT NOT NULL DEFAULT 'bybit',
+		api_key TEXT NOT NULL,
+		api_secret TEXT NOT NULL,
+		api_passphrase TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		UNIQUE(user_id, name)
+	);`
+	if _, err := tx.Exec(createAccountsSQL); err != nil {
+		return err
+	}
+	if err := addColumn(tx, "users", "active_account_id", "INTEGER DEFAULT 0"); err != nil {
+		return err
+	}
+
+	rows, err := tx.Query(`SELECT user_id, COALESCE(exchange, 'bybit'), bybit_api_key, bybit_api_secret, COALESCE(api_passphrase, '')
+		FROM users WHERE COALESCE(bybit_api_key, '') != '' AND COALESCE(bybit_api_secret, '') != ''`)
+	if err != nil {
+		return err
+	}
+	var legacy []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.UserID, &u.Exchange, &u.ApiKey, &u.ApiSecret, &u.Passphrase); err != nil {
+			rows.Close()
+			return err
+		}
+		legacy = append(legacy, u)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range legacy {
+		// ключи переносим как есть: у старых баз они открытым текстом, их зашифрует
+		// RotateSecrets, который InitDB вызывает после миграций
+		res, err := tx.Exec(`INSERT INTO accounts (user_id, name, exchange, api_key, api_secret, api_passphrase, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			u.UserID, exchanges.DisplayName(u.Exchange), u.Exchange, u.ApiKey, u.ApiSecret, u.Passphrase, time.Now().Unix())
+		if err != nil {
+			return err
+		}
+		accountID, err := res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		for _, query := range []string{
+			"UPDATE users SET active_account_id = ? WHERE user_id = ?",
+			"UPDATE executions SET account_id = ? WHERE user_id = ? AND account_id = 0",
+			"UPDATE executions_sync SET account_id = ? WHERE user_id = ? AND account_id = 0",
+		} {
+			if _, err := tx.Exec(query, accountID, u.UserID); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = tx.Exec("UPDATE users SET bybit_api_key = NULL, bybit_api_secret = NULL, api_passphrase = ''")
+	return err
+}
+
+// migrateSubAccounts добавляет аккаунтам id на бирже и связь субаккаунтов с мастер-аккаунтом
+func migrateSubAccounts(tx *sql.Tx) error {
+	columns := []struct{ name, definition string }{
+		{"exchange_uid", "TEXT NOT NULL DEFAULT ''"},
+		{"is_master", "INTEGER NOT NULL DEFAULT 0"},
+		{"include_subs", "INTEGER NOT NULL DEFAULT 0"},
+		{"parent_id", "INTEGER NOT NULL DEFAULT 0"},
+	}
+	for _, column := range columns {
+		if err := addColumn(tx, "accounts", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAccounts возвращает аккаунты пользователя с расшифрованными ключами в порядке добавления
+func GetAccounts(userID int64) ([]User, error) {
+	return queryAccounts("a.user_id = ? ORDER BY a.id", userID)
+}
+
+// GetActiveAccountID — выбранный пользователем аккаунт: id, AllAccounts или 0, если не выбран
+func GetActiveAccountID(userID int64) (int64, error) {
+	var accountID int64
+	err := DB.QueryRow("SELECT COALESCE(active_account_id, 0) FROM users WHERE user_id = ?", userID).Scan(&accountID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return accountID, err
+}
+
+// SetActiveAccount выбирает аккаунт, с которым работает пользователь, или AllAccounts
+func SetActiveAccount(userID, accountID int64) error {
+	if accountID != AllAccounts {
+		var exists int
+		if err := DB.QueryRow("SELECT COUNT(*) FROM accounts WHERE id = ? AND user_id = ?", accountID, userID).Scan(&exists); err != nil {
+			return err
+		}
+		if exists == 0 {
+			return fmt.Errorf("аккаунт не найден")
+		}
+	}
+
+	query := `INSERT INTO users (user_id, active_account_id) VALUES (?, ?)
+	          ON CONFLICT(user_id) DO UPDATE SET active_account_id = excluded.active_account_id`
+	_, err := DB.Exec(query, userID, accountID)
+	return err
+}
+
+// GetUser возвращает активный аккаунт пользователя, а если выбраны все аккаунты
+// или выбор не сделан — первый. Без аккаунтов возвращается запись без ключей.
+func GetUser(userID int64) (User, error) {
+	accounts, err := GetAccounts(userID)
+	if err != nil {
+		return User{UserID: userID}, err
+	}
+	if len(accounts) == 0 {
+		return User{UserID: userID, Exchange: "bybit"}, nil
+	}
+
+	activeID, err := GetActiveAccountID(userID)
+	if err != nil {
+		return User{UserID: userID}, err
+	}
+	for _, account := range accounts {
+		if account.AccountID == activeID {
+			return account, nil
+		}
+	}
+	return accounts[0], nil
+}
+
+// SaveAccount сохраняет ключи аккаунта в зашифрованном виде и делает его активным.
+// Аккаунт с тем же названием перезаписывается. Если у него сменились биржа или ключ,
+// id на бирже, признак мастер-аккаунта и связи с субаккаунтами относились к прежнему
+// ключу и сбрасываются.
+func SaveAccount(userID int64, name, exchange, apiKey, apiSecret, passphrase string) (int64, error) {
+	encrypted, err := encryptSecrets(apiKey, apiSecret, passphrase)
+	if err != nil {
+		return 0, err
+	}
+	keysChanged, err := accountKeysDiffer(userID, name, exchange, apiKey)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	query := `INSERT INTO accounts (user_id, name, exchange, api_key, api_secret, api_passphrase, created_at)
+	          VALUES (?, ?, ?, ?, ?, ?, ?)
+	          ON CONFLICT(user_id, name) DO UPDATE SET
+	          exchange = excluded.exchange,
+	          api_key = excluded.api_key,
+	          api_secret = excluded.api_secret,
+	          api_passphrase = excluded.api_passphrase`
+	if _, err := tx.Exec(query, userID, name, exchange, encrypted[0], encrypted[1], encrypted[2], time.Now().Unix()); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	var accountID int64
+	if err := tx.QueryRow("SELECT id FROM accounts WHERE user_id = ? AND name = ?", userID, name).Scan(&accountID); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	if keysChanged {
+		reset := []string{
+			"UPDATE accounts SET exchange_uid = '', is_master = 0, include_subs = 0, parent_id = 0 WHERE id = ?",
+			"UPDATE accounts SET parent_id = 0 WHERE parent_id = ?",
+		}
+		for _, query := range reset {
+			if _, err := tx.Exec(query, accountID); err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return accountID, SetActiveAccount(userID, accountID)
+}
+
+// SetAccountIdentity запоминает id аккаунта на бирже и то, что ключ от мастер-аккаунта
+func SetAccountIdentity(accountID int64, uid string, isMaster bool) error {
+	_, err := DB.Exec("UPDATE accounts SET exchange_uid = ?, is_master = ? WHERE id = ?", uid, boolToInt(isMaster), accountID)
+	return err
+}
+
+// SetIncludeSubAccounts включает показ субаккаунтов вместе с мастер-аккаунтом
+func SetIncludeSubAccounts(userID, accountID int64, enabled bool) error {
+	res, err := DB.Exec("UPDATE accounts SET include_subs = ? WHERE id = ? AND user_id = ?", boolToInt(enabled), accountID, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("аккаунт не найден")
+	}
+	return nil
+}
+
+// LinkSubAccounts привязывает к мастер-аккаунту аккаунты пользователя с ключами его
+// субаккаунтов (по id на бирже) и отвязывает те, что больше не в списке.
+// Возвращает число изменившихся аккаунтов.
+func LinkSubAccounts(userID, masterID int64, uids []string) (int, error) {
+	tx, err := DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+
+	placeholders := "''"
+	args := []interface{}{masterID, userID, masterID}
+	if len(uids) > 0 {
+		placeholders = strings.TrimSuffix(strings.Repeat("?,", len(uids)), ",")
+		for _, uid := range uids {
+			args = append(args, uid)
+		}
+	}
+
+	link := `UPDATE accounts SET parent_id = ?
+		WHERE user_id = ? AND id != ? AND parent_id = 0 AND exchange_uid != '' AND exchange_uid IN (` + placeholders + `)`
+	res, err := tx.Exec(link, args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	linked, _ := res.RowsAffected()
+
+	unlink := `UPDATE accounts SET parent_id = 0
+		WHERE parent_id = ? AND user_id = ? AND id != ? AND exchange_uid NOT IN (` + placeholders + `)`
+	res, err = tx.Exec(unlink, args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	unlinked, _ := res.RowsAffected()
+
+	return int(linked + unlinked), tx.Commit()
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// CleanAccountName убирает из названия аккаунта разметку Markdown и лишние пробелы
+func CleanAccountName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if strings.ContainsRune("*_`[]", r) {
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.Join(strings.Fields(name), " ")
+	if len([]rune(name)) > 32 {
+		name = string([]rune(name)[:32])
+	}
+	return name
+}
+
+// HasKeys — сохранены ли у пользователя ключи API
+func (u User) HasKeys() bool {
+	return u.ApiKey != "" && u.ApiSecret != ""
+}
+
+// queryAccounts читает аккаунты по условию where. Записи, которые не удалось
+// расшифровать, пропускаются, чтобы один аккаунт не останавливал рассылку остальным.
+func queryAccounts(where string, args ...interface{}) ([]User, error) {
+	query := selectAccountsSQL + " LEFT JOIN users u ON u.user_id = a.user_id"
+	if where != "" {
+		query += " WHERE " + where
+	}
+	rows, err := DB.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		var isMaster, includeSubs int
+		if err := rows.Scan(&u.UserID, &u.AccountID, &u.AccountName, &u.Exchange, &u.ApiKey, &u.ApiSecret, &u.Passphrase,
+			&u.ExchangeUID, &isMaster, &includeSubs, &u.ParentID); err != nil {
+			return nil, err
+		}
+		u.IsMaster = isMaster == 1
+		u.IncludeSubs = includeSubs == 1
+		if err := decryptUser(&u); err != nil {
+			log.Printf("[Storage] Ключи аккаунта %d пользователя %d не расшифрованы, аккаунт пропущен (проверьте SECRETS_KEY): %v", u.AccountID, u.UserID, err)
+			continue
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// legacyUser — запись users.json, где ключи хранились до переноса в SQLite
+type legacyUser struct {
+	ChatID         int64  `json:"chat_id"`
+	Exchange       string `json:"exchange"`
+	BybitApiKey    string `json:"bybit_api_key"`
+	BybitApiSecret string `json:"bybit_api_secret"`
+	Passphrase     string `json:"passphrase"`
+}
+
+// accountKeysDiffer — у пользователя уже есть аккаунт с названием name, но с другой
+// биржей или другим API-ключом. Ключ, который не удалось расшифровать, считается другим.
+func accountKeysDiffer(userID int64, name, exchange, apiKey string) (bool, error) {
+	var storedExchange, storedKey string
+	err := DB.QueryRow("SELECT exchange, api_key FROM accounts WHERE user_id = ? AND name = ?", userID, name).
+		Scan(&storedExchange, &storedKey)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	plain, err := secrets.Decrypt(storedKey)
+	return err != nil || storedExchange != exchange || plain != apiKey, nil
+}
+
+// ImportUsersFile переносит ключи из users.json в аккаунты. Раньше обработчики
+// читали ключи из файла, поэтому при расхождении побеждает файл. После импорта файл
+// удаляется: у старых установок ключи в нем лежат открытым текстом. Записи, которые
+// не удалось расшифровать, остаются в файле (зашифрованными) до следующего запуска.
+func ImportUsersFile(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var users map[int64]legacyUser
+	if err := json.Unmarshal(data, &users); err != nil {
+		return err
+	}
+
+	imported := 0
+	failed := make(map[int64]legacyUser)
+	for chatID, u := range users {
+		if u.ChatID == 0 {
+			u.ChatID = chatID
+		}
+		if u.Exchange == "" {
+			u.Exchange = "bybit"
+		}
+		stored := u
+		// значения в файле зашифрованы, у установок без шифрования — открытым текстом
+		if err := decryptLegacyUser(&u); err != nil {
+			log.Printf("[Storage] Ключи пользователя %d из %s не расшифрованы, запись оставлена в файле: %v", u.ChatID, path, err)
+			failed[chatID] = stored
+			continue
+		}
+		if u.BybitApiKey == "" || u.BybitApiSecret == "" {
+			continue
+		}
+		name := exchanges.DisplayName(u.Exchange)
+		keysChanged, err := accountKeysDiffer(u.ChatID, name, u.Exchange, u.BybitApiKey)
+		if err != nil {
+			return err
+		}
+		accountID, err := SaveAccount(u.ChatID, name, u.Exchange, u.BybitApiKey, u.BybitApiSecret, u.Passphrase)
+		if err != nil {
+			return err
+		}
+		// сделки, загруженные прежними ключами аккаунта с тем же названием, к новым не относятся
+		if keysChanged {
+			if err := ClearTradesCache(u.ChatID, accountID); err != nil {
+				return err
+			}
+		}
+		imported++
+	}
+
+	if len(failed) > 0 {
+		if err := writeLegacyUsers(path, failed); err != nil {
+			return err
+		}
+		log.Printf("[Storage] Импортировано пользователей из %s: %d. Не расшифровано: %d, они остались в файле "+
+			"и будут импортированы при следующем запуске с нужным SECRETS_KEY", path, imported, len(failed))
+		return nil
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	log.Printf("[Storage] Импортировано пользователей из %s: %d. Файл удален", path, imported)
+	return nil
+}
+
+func decryptLegacyUser(u *legacyUser) error {
+	for _, field := range []*string{&u.BybitApiKey, &u.BybitApiSecret, &u.Passphrase} {
+		plain, err := secrets.Decrypt(*field)
+		if err != nil {
+			return err
+		}
+		*field = plain
+	}
+	return nil
+}
+
+// writeLegacyUsers перезаписывает users.json записями, которые не удалось импортировать.
+// Поля, сохраненные открытым текстом, шифруются: на диске не остается открытых ключей.
+func writeLegacyUsers(path string, users map[int64]legacyUser) error {
+	for chatID, u := range users {
+		for _, field := range []*string{&u.BybitApiKey, &u.BybitApiSecret, &u.Passphrase} {
+			plain, err := secrets.Decrypt(*field)
+			if err != nil {
+				continue
+			}
+			if *field, err = secrets.Encrypt(plain); err != nil {
+				return err
+			}
+		}
+		users[chatID] = u
+	}
+
+	data, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	// WriteFile не меняет права уже существующего файла
+	return os.Chmod(path, 0600)
+}
@@ -0,0 +1,294 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"telegram-date-bot/secrets"
+	"telegram-date-bot/spotpnl"
+	"testing"
+)
+
+// loadTestKey загружает случайный ключ шифрования и возвращает его
+func loadTestKey(t *testing.T) string {
+	t.Helper()
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		t.Fatalf("ключ: %v", err)
+	}
+	encoded := base64.StdEncoding.EncodeToString(raw)
+	t.Setenv("SECRETS_KEY", encoded)
+	if err := secrets.Load(); err != nil {
+		t.Fatalf("secrets.Load: %v", err)
+	}
+	return encoded
+}
+
+func writeUsersFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "users.json")
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("users.json: %v", err)
+	}
+	return path
+}
+
+// assertNoPlaintextOnDisk проверяет, что ни в одном файле каталога dir нет открытых ключей
+func assertNoPlaintextOnDisk(t *testing.T, dir string, plaintexts ...string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("каталог: %v", err)
+	}
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			t.Fatalf("%s: %v", entry.Name(), err)
+		}
+		for _, plain := range plaintexts {
+			if strings.Contains(string(data), plain) {
+				t.Errorf("в %s остался открытый ключ %q", entry.Name(), plain)
+			}
+		}
+	}
+}
+
+func TestImportUsersFile(t *testing.T) {
+	openMigratedDB(t)
+	loadTestKey(t)
+	encryptedSecret, err := secrets.Encrypt("secret-2")
+	if err != nil {
+		t.Fatalf("Encrypt: %v", err)
+	}
+	// 100 — старая запись без биржи с ключами открытым текстом, 200 — зашифрованная
+	// запись OKX, 300 — без ключей
+	path := writeUsersFile(t, `{
+		"100": {"bybit_api_key": "key-1", "bybit_api_secret": "secret-1"},
+		"200": {"chat_id": 200, "exchange": "okx", "bybit_api_key": "key-2", "bybit_api_secret": "`+encryptedSecret+`", "passphrase": "pass-2"},
+		"300": {"chat_id": 300}
+	}`)
+
+	if err := ImportUsersFile(path); err != nil {
+		t.Fatalf("ImportUsersFile: %v", err)
+	}
+
+	u, err := GetUser(100)
+	if err != nil {
+		t.Fatalf("GetUser(100): %v", err)
+	}
+	if u.Exchange != "bybit" || u.ApiKey != "key-1" || u.ApiSecret != "secret-1" || u.AccountName != "Bybit" {
+		t.Errorf("пользователь 100 = %+v", u)
+	}
+	u, err = GetUser(200)
+	if err != nil {
+		t.Fatalf("GetUser(200): %v", err)
+	}
+	if u.Exchange != "okx" || u.ApiSecret != "secret-2" || u.Passphrase != "pass-2" {
+		t.Errorf("пользователь 200 = %+v", u)
+	}
+	if accounts, _ := GetAccounts(300); len(accounts) != 0 {
+		t.Errorf("пользователю без ключей заведены аккаунты: %+v", accounts)
+	}
+
+	// в базе ключи зашифрованы
+	var storedKey string
+	if err := DB.QueryRow("SELECT api_key FROM accounts WHERE user_id = 100").Scan(&storedKey); err != nil {
+		t.Fatalf("api_key: %v", err)
+	}
+	if storedKey == "key-1" || secrets.NeedsRotation(storedKey) {
+		t.Errorf("ключ сохранен не зашифрованным текущим ключом: %q", storedKey)
+	}
+
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("users.json не удален: %v", err)
+	}
+	assertNoPlaintextOnDisk(t, filepath.Dir(path), "key-1", "secret-1", "secret-2", "pass-2")
+	// при следующем запуске файла нет, импорт ничего не делает
+	if err := ImportUsersFile(path); err != nil {
+		t.Errorf("повторный импорт: %v", err)
+	}
+}
+
+func TestImportUsersFileClearsTradesOfReplacedKeys(t *testing.T) {
+	openMigratedDB(t)
+	loadTestKey(t)
+	trade := []spotpnl.Execution{{ExecID: "1", Symbol: "BTCUSDT", Side: "Buy", Price: "100", Quantity: "1", ExecTime: "1000"}}
+
+	// у 100 аккаунт Bybit уже с тем же ключом, у 200 — с другим
+	sameID, err := SaveAccount(100, "Bybit", "bybit", "key-1", "secret-1", "")
+	if err != nil {
+		t.Fatalf("SaveAccount: %v", err)
+	}
+	otherID, err := SaveAccount(200, "Bybit", "bybit", "old-key", "old-secret", "")
+	if err != nil {
+		t.Fatalf("SaveAccount: %v", err)
+	}
+	for _, a := range []struct{ userID, accountID int64 }{{100, sameID}, {200, otherID}} {
+		if _, err := saveTrades(a.userID, a.accountID, trade, 5000); err != nil {
+			t.Fatalf("saveTrades: %v", err)
+		}
+	}
+
+	path := writeUsersFile(t, `{
+		"100": {"bybit_api_key": "key-1", "bybit_api_secret": "secret-1"},
+		"200": {"bybit_api_key": "new-key", "bybit_api_secret": "new-secret"}
+	}`)
+	if err := ImportUsersFile(path); err != nil {
+		t.Fatalf("ImportUsersFile: %v", err)
+	}
+
+	if n := countExecutions(t, 100, sameID); n != 1 {
+		t.Errorf("сделок аккаунта с прежним ключом %d, ожидалась 1", n)
+	}
+	if n := countExecutions(t, 200, otherID); n != 0 {
+		t.Errorf("сделки прежнего ключа не удалены: %d", n)
+	}
+	if lastUpdate, _ := GetTradesSyncTime(200, otherID); lastUpdate != 0 {
+		t.Errorf("отметка синхронизации прежнего ключа не сброшена: %d", lastUpdate)
+	}
+	if u, _ := GetUser(200); u.ApiKey != "new-key" || u.AccountID != otherID {
+		t.Errorf("пользователь 200 = %+v", u)
+	}
+}
+
+func TestImportUsersFileKeepsUndecryptable(t *testing.T) {
+	openMigratedDB(t)
+	foreignKey := loadTestKey(t)
+	// запись 100 зашифрована ключом, которого у процесса пока нет
+	var foreign []string
+	for _, plain := range []string{"key-1", "secret-1"} {
+		value, err := secrets.Encrypt(plain)
+		if err != nil {
+			t.Fatalf("Encrypt: %v", err)
+		}
+		foreign = append(foreign, value)
+	}
+	currentKey := loadTestKey(t)
+
+	path := writeUsersFile(t, `{
+		"100": {"bybit_api_key": "`+foreign[0]+`", "bybit_api_secret": "`+foreign[1]+`", "passphrase": "plain-pass"},
+		"200": {"bybit_api_key": "key-2", "bybit_api_secret": "secret-2"}
+	}`)
+	if err := os.Chmod(path, 0644); err != nil {
+		t.Fatalf("Chmod: %v", err)
+	}
+	if err := ImportUsersFile(path); err != nil {
+		t.Fatalf("ImportUsersFile: %v", err)
+	}
+	if accounts, _ := GetAccounts(100); len(accounts) != 0 {
+		t.Errorf("импортирован аккаунт с нерасшифрованными ключами: %+v", accounts)
+	}
+	if u, _ := GetUser(200); u.ApiKey != "key-2" {
+		t.Errorf("пользователь 200 = %+v", u)
+	}
+
+	// в файле осталась только запись 100, без открытых значений и недоступная другим
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("файл с нерасшифрованными записями удален: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("права файла %v, ожидалось 0600", info.Mode().Perm())
+	}
+	assertNoPlaintextOnDisk(t, filepath.Dir(path), "key-2", "secret-2", "plain-pass")
+
+	// со старым ключом в SECRETS_KEY запись импортируется, а файл удаляется
+	t.Setenv("SECRETS_KEY", currentKey+","+foreignKey)
+	if err := secrets.Load(); err != nil {
+		t.Fatalf("secrets.Load: %v", err)
+	}
+	if err := ImportUsersFile(path); err != nil {
+		t.Fatalf("повторный импорт: %v", err)
+	}
+	if u, _ := GetUser(100); u.ApiKey != "key-1" || u.ApiSecret != "secret-1" || u.Passphrase != "plain-pass" {
+		t.Errorf("пользователь 100 = %+v", u)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("users.json не удален после импорта: %v", err)
+	}
+}
+
+func TestQueryAccountsSkipsUndecryptable(t *testing.T) {
+	openMigratedDB(t)
+	loadTestKey(t)
+	if _, err := SaveAccount(100, "Bybit", "bybit", "key-1", "secret-1", ""); err != nil {
+		t.Fatalf("SaveAccount: %v", err)
+	}
+	if _, err := SaveAccount(100, "OKX", "okx", "key-2", "secret-2", "pass-2"); err != nil {
+		t.Fatalf("SaveAccount: %v", err)
+	}
+	// ключ шифрования OKX-аккаунта потерян
+	mustExec(t, "UPDATE accounts SET api_secret = 'enc:v1:00000000:AAAA' WHERE name = 'OKX'")
+
+	accounts, err := GetAccounts(100)
+	if err != nil {
+		t.Fatalf("GetAccounts: %v", err)
+	}
+	if len(accounts) != 1 || accounts[0].AccountName != "Bybit" || accounts[0].ApiSecret != "secret-1" {
+		t.Errorf("аккаунты = %+v, ожидался только Bybit", accounts)
+	}
+}
+
+func TestSaveAccountResetsIdentityWhenKeyChanges(t *testing.T) {
+	openMigratedDB(t)
+	loadTestKey(t)
+	masterID, err := SaveAccount(100, "Bybit", "bybit", "master-key", "secret", "")
+	if err != nil {
+		t.Fatalf("SaveAccount: %v", err)
+	}
+	subID, err := SaveAccount(100, "Sub", "bybit", "sub-key", "secret", "")
+	if err != nil {
+		t.Fatalf("SaveAccount: %v", err)
+	}
+	if err := SetAccountIdentity(masterID, "111", true); err != nil {
+		t.Fatalf("SetAccountIdentity: %v", err)
+	}
+	if err := SetAccountIdentity(subID, "222", false); err != nil {
+		t.Fatalf("SetAccountIdentity: %v", err)
+	}
+	if err := SetIncludeSubAccounts(100, masterID, true); err != nil {
+		t.Fatalf("SetIncludeSubAccounts: %v", err)
+	}
+	if _, err := LinkSubAccounts(100, masterID, []string{"222"}); err != nil {
+		t.Fatalf("LinkSubAccounts: %v", err)
+	}
+
+	accountByID := func(id int64) User {
+		t.Helper()
+		accounts, err := GetAccounts(100)
+		if err != nil {
+			t.Fatalf("GetAccounts: %v", err)
+		}
+		for _, account := range accounts {
+			if account.AccountID == id {
+				return account
+			}
+		}
+		t.Fatalf("нет аккаунта %d", id)
+		return User{}
+	}
+
+	// тот же ключ с новым секретом: аккаунт на бирже тот же, связи остаются
+	if _, err := SaveAccount(100, "Bybit", "bybit", "master-key", "new-secret", ""); err != nil {
+		t.Fatalf("SaveAccount: %v", err)
+	}
+	if master := accountByID(masterID); !master.IsMaster || !master.IncludeSubs || master.ExchangeUID != "111" {
+		t.Errorf("мастер-аккаунт после смены секрета = %+v", master)
+	}
+	if sub := accountByID(subID); sub.ParentID != masterID {
+		t.Errorf("субаккаунт отвязан после смены секрета: %+v", sub)
+	}
+
+	// другой ключ — другой аккаунт на бирже: его id, флаги и субаккаунты сбрасываются
+	if _, err := SaveAccount(100, "Bybit", "bybit", "other-key", "secret", ""); err != nil {
+		t.Fatalf("SaveAccount: %v", err)
+	}
+	if master := accountByID(masterID); master.IsMaster || master.IncludeSubs || master.ExchangeUID != "" {
+		t.Errorf("мастер-аккаунт после смены ключа = %+v", master)
+	}
+	if sub := accountByID(subID); sub.ParentID != 0 || sub.ExchangeUID != "222" {
+		t.Errorf("субаккаунт после смены ключа мастера = %+v", sub)
+	}
+}